@@ -2,87 +2,333 @@ package application
 
 import (
 	"context"
-	"github.com/elastic/go-elasticsearch"
-	"github.com/oschwald/maxminddb-golang"
 	kafkaGo "github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/admin"
+	"kafka-to-elastic-pipeline/pkg/enrich"
 	"kafka-to-elastic-pipeline/pkg/geoip"
+	"kafka-to-elastic-pipeline/pkg/metrics"
 	"kafka-to-elastic-pipeline/pkg/monitor"
 	"kafka-to-elastic-pipeline/pkg/readers/kafka"
 	"kafka-to-elastic-pipeline/pkg/types"
+	"kafka-to-elastic-pipeline/pkg/workers"
 	"kafka-to-elastic-pipeline/pkg/writers/elastic"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func Application() {
-	logger, err := zap.NewProduction()
+func Application(cfg *config.Config) {
+	// The level can be changed at runtime by the admin API
+	loggerConfig := zap.NewProductionConfig()
+	logger, err := loggerConfig.Build()
 	if err != nil {
 		panic(err)
 	}
 	defer logger.Sync()
 
-	geoIPReader, err := maxminddb.Open(config.GeoIPDBFile)
+	geoIPDB, err := geoip.OpenDatabase(cfg.GeoIP.DBFile, "City", logger)
 	if err != nil {
-		logger.Fatal("Failed to open GeoIP reader")
+		logger.Fatal("Failed to open GeoIP database", zap.Error(err))
 	}
-	defer geoIPReader.Close()
+	defer geoIPDB.Close()
+	geoIPDBs := []*geoip.Database{geoIPDB}
 
-	es, err := elasticsearch.NewDefaultClient()
+	var asnDB *geoip.Database
+	if cfg.GeoIP.ASNDBFile != "" {
+		asnDB, err = geoip.OpenDatabase(cfg.GeoIP.ASNDBFile, "ASN", logger)
+		if err != nil {
+			logger.Fatal("Failed to open GeoIP ASN database", zap.Error(err))
+		}
+		defer asnDB.Close()
+		geoIPDBs = append(geoIPDBs, asnDB)
+	}
+
+	es, esTransport, err := elastic.NewClient(cfg.Elastic, logger)
+	if err != nil {
+		logger.Fatal("failed to create elastic client", zap.Error(err))
+	}
+	if cfg.Elastic.SniffInterval > 0 {
+		if err := esTransport.Sniff(context.Background()); err != nil {
+			logger.Warn("failed to sniff elastic nodes, using configured addresses", zap.Error(err))
+		}
+	}
+
+	if cfg.Elastic.Templates {
+		if err := elastic.BootstrapTemplates(context.Background(), es, cfg.Elastic, cfg.Routes, logger); err != nil {
+			logger.Fatal("failed to bootstrap index templates", zap.Error(err))
+		}
+	}
+	for _, route := range cfg.Routes {
+		if route.ILMPolicy == "" {
+			continue
+		}
+		if err := elastic.BootstrapRollover(context.Background(), es, route.Index, route.ILMPolicy, logger); err != nil {
+			logger.Fatal("failed to bootstrap rollover", zap.Error(err))
+		}
+	}
+
+	dialer, certificate, err := kafka.NewDialer(cfg.Kafka, logger)
+	if err != nil {
+		logger.Fatal("failed to create kafka dialer", zap.Error(err))
+	}
+
+	breaker := elastic.NewBreaker(es, cfg.Elastic.BreakerProbeInterval, logger)
+
+	failureSink, err := elastic.NewFailureSink(cfg.Elastic, logger)
 	if err != nil {
-		logger.Fatal("Error creating the client: %s", zap.Error(err))
+		logger.Fatal("failed to create failure sink", zap.Error(err))
 	}
+	defer failureSink.Close()
 
-	group, ctx := errgroup.WithContext(context.Background())
+	// Readers are held back while ES is unavailable, unless objects are spilled and the spill has room for them
+	var spill *elastic.Spill
+	var gate kafka.Gate = breaker
+	if cfg.Elastic.Spill.Dir != "" {
+		spill, err = elastic.OpenSpill(cfg.Elastic, es, breaker, failureSink, logger)
+		if err != nil {
+			logger.Fatal("failed to open spill", zap.Error(err))
+		}
+		defer spill.Close()
+		gate = spill
+	}
+
+	// `ctx` aborts the pipeline: when a brick fails or graceful shutdown takes too long.
+	// Graceful shutdown goes stage by stage: readers stop fetching, every next stage drains channels of the previous
+	// one and exits once they are closed, writers flush buffers, and committers commit offsets of written objects.
+	rootCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	group, ctx := errgroup.WithContext(rootCtx)
+	readCtx, stopReading := context.WithCancel(ctx)
+	monitorCtx, stopMonitoring := context.WithCancel(ctx)
+
+	var readersDone, committersDone sync.WaitGroup
+	written := make(chan struct{})
+
+	poisonHandler := kafka.NewPoisonHandler(cfg.Kafka, dialer, logger)
+	defer poisonHandler.Close()
 
-	usrChan := make(chan types.User, config.ChannelsBufferSize)
-	tweetsChan := make(chan types.Tweet, config.ChannelsBufferSize)
-	enrichedTweetsChan := make(chan types.EnrichedTweet, config.ChannelsBufferSize)
+	enrichers := map[string]enrich.Enricher{
+		config.EnricherGeoIP: geoip.NewEnricher(geoIPDB, asnDB, cfg.GeoIP),
+	}
+
+	// With autoscaling, workers of enrichers and writers are scaled between configured numbers and the max ones
+	var scaled []monitor.Scaled
+	maxWorkers := func(workers, max int) int {
+		if cfg.Autoscale.Interval == 0 {
+			return workers
+		}
+		return max
+	}
 
-	for i := 0; i < config.NumPartitionsKafkaUsersTopic; i++ {
-		usersReader := kafkaGo.NewReader(kafkaGo.ReaderConfig{
-			Brokers:   config.KafkaBrokers,
-			Partition: i,
-			Topic:     config.KafkaUsersTopic,
-			MinBytes:  1, // in dev we want to read up to every single byte from kafka (for tests reliability);
-			MaxBytes:  10e6,
+	// Records of all routes end up in one channel writers read. Readers of a route with enrichers send records to
+	// the route channel, and its enrichment chain closes channels one after another once the route channel is
+	// closed; readers of a route without enrichers send records right to writers.
+	records := make(chan *types.Record, cfg.ChannelsBufferSize)
+	channels := map[string]chan *types.Record{"elastic": records}
+	var routeChannels []chan *types.Record
+	var lastStages []*workers.Pool
+	var allReaders []*kafkaGo.Reader
+	topics := map[string]admin.Topic{}
+	flushTrigger := elastic.NewFlushTrigger()
+	var registry *kafka.SchemaRegistry
+	if cfg.SchemaRegistry.URL != "" {
+		registry = kafka.NewSchemaRegistry(cfg.SchemaRegistry)
+	}
+	for _, route := range cfg.Routes {
+		route := route
+		decoder, err := kafka.NewDecoder(route, registry)
+		if err != nil {
+			logger.Fatal("failed to create decoder", zap.String("route", route.Name), zap.Error(err))
+		}
+
+		in := records
+		if len(route.Enrichers) > 0 {
+			in = make(chan *types.Record, cfg.ChannelsBufferSize)
+			channels[route.Name] = in
+			routeChannels = append(routeChannels, in)
+
+			var stages []enrich.Stage
+			for _, enricherCfg := range route.Enrichers {
+				stages = append(stages, enrich.Stage{
+					Name:       enricherCfg.Name,
+					Route:      route.Name,
+					Enricher:   enrichers[enricherCfg.Name],
+					Workers:    enricherCfg.Workers,
+					MaxWorkers: maxWorkers(enricherCfg.Workers, cfg.Autoscale.MaxEnricherWorkers),
+
+					Partitioned: cfg.Elastic.Ordering == config.OrderingPartition,
+				})
+			}
+			outs, pools := enrich.Chain(ctx, group, stages, in, records, cfg.ChannelsBufferSize, logger)
+			stageIn := in
+			for i, out := range outs {
+				name := stages[i].FullName()
+				if out != records {
+					channels[name] = out
+				}
+				scaled = append(scaled, monitor.Scaled{Pool: pools[i], In: stageIn, Out: out, Throughput: func() float64 {
+					return metrics.Total(metrics.EnrichedRecords.WithLabelValues(name))
+				}})
+				stageIn = out
+			}
+			lastStages = append(lastStages, pools[len(pools)-1])
+		}
+
+		readers, err := kafka.NewReaders(ctx, cfg.Kafka, dialer, route.Topic, route.Readers)
+		if err != nil {
+			logger.Fatal("failed to create readers", zap.String("route", route.Name), zap.Error(err))
+		}
+		topic := admin.Topic{Pause: kafka.NewPause()}
+		routeGate := kafka.Gates{gate, topic.Pause}
+		for _, reader := range readers {
+			reader := reader
+			committer := kafka.NewCommitter(reader, logger)
+			topic.Committers = append(topic.Committers, committer)
+			readersDone.Add(1)
+			group.Go(func() error {
+				defer readersDone.Done()
+				return kafka.Read(readCtx, reader, committer, poisonHandler, routeGate, route.Name, decoder, registry, in, logger)
+			})
+			committersDone.Add(1)
+			group.Go(func() error {
+				defer committersDone.Done()
+				return committer.Run(ctx, cfg.Kafka.CommitInterval, written)
+			})
+		}
+		allReaders = append(allReaders, readers...)
+		topics[route.Topic] = topic
+	}
+
+	// With "partition" ordering, records of a kafka partition go through one enricher worker and one writer, in order
+	var writers *workers.Pool
+	if cfg.Elastic.Ordering == config.OrderingPartition {
+		writers = workers.NewPartitionedPool("writers", group, cfg.Elastic.Writers, maxWorkers(cfg.Elastic.Writers, cfg.Autoscale.MaxWriters), cfg.ChannelsBufferSize, records, func(lane chan *types.Record) error {
+			return elastic.Write(ctx, cfg.Elastic, cfg.Routes, es, breaker, spill, flushTrigger, failureSink, lane, nil, logger)
+		})
+	} else {
+		writers = workers.NewPool("writers", group, cfg.Elastic.Writers, maxWorkers(cfg.Elastic.Writers, cfg.Autoscale.MaxWriters), func(quit <-chan struct{}) error {
+			return elastic.Write(ctx, cfg.Elastic, cfg.Routes, es, breaker, spill, flushTrigger, failureSink, records, quit, logger)
 		})
+	}
+	scaled = append(scaled, monitor.Scaled{Pool: writers, In: records, Throughput: func() float64 {
+		return metrics.Total(metrics.Documents)
+	}})
+
+	group.Go(func() error {
+		readersDone.Wait()
+		for _, channel := range routeChannels {
+			close(channel)
+		}
+		for _, pool := range lastStages {
+			pool.Wait()
+		}
+		close(records)
+		writers.Wait()
+		close(written)
+		committersDone.Wait()
+
+		for _, reader := range allReaders {
+			if err := reader.Close(); err != nil {
+				logger.Warn("failed to close kafka reader", zap.Error(err))
+			}
+		}
+		stopMonitoring()
+		return nil
+	})
 
+	group.Go(func() error {
+		return monitor.MonitorFillness(monitorCtx, channels, allReaders, logger)
+	})
+
+	if cfg.Autoscale.Interval > 0 {
 		group.Go(func() error {
-			return kafka.ReadUsers(ctx, usersReader, usrChan, logger)
+			return monitor.Autoscale(monitorCtx, cfg.Autoscale, scaled, logger)
 		})
 	}
-	for i := 0; i < config.NumPartitionsKafkaTweetsTopic; i++ {
-		tweetsReader := kafkaGo.NewReader(kafkaGo.ReaderConfig{
-			Brokers:   config.KafkaBrokers,
-			Partition: i,
-			Topic:     config.KafkaTweetsTopic,
-			MinBytes:  1, // in dev we want to read up to every single byte from kafka (for tests reliability);
-			MaxBytes:  10e6,
+
+	if cfg.GeoIP.ReloadInterval > 0 {
+		for _, db := range geoIPDBs {
+			db := db
+			group.Go(func() error {
+				return db.Watch(monitorCtx, cfg.GeoIP.ReloadInterval)
+			})
+		}
+	}
+
+	group.Go(func() error {
+		return breaker.Run(monitorCtx)
+	})
+
+	if spill != nil {
+		group.Go(func() error {
+			return spill.Run(monitorCtx)
+		})
+	}
+
+	if cfg.Elastic.SniffInterval > 0 {
+		group.Go(func() error {
+			return esTransport.SniffNodes(monitorCtx, cfg.Elastic.SniffInterval)
 		})
+	}
+
+	if certificate != nil && cfg.Kafka.TLS.ReloadInterval > 0 {
 		group.Go(func() error {
-			return kafka.ReadTweets(ctx, tweetsReader, tweetsChan, logger)
+			return certificate.Watch(monitorCtx, cfg.Kafka.TLS.ReloadInterval)
 		})
 	}
 
-	for i := 0; i < config.NumGeoIPWorkers; i++ {
+	if cfg.AdminAddress != "" {
+		var pools []*workers.Pool
+		for _, s := range scaled {
+			pools = append(pools, s.Pool)
+		}
+		server := &admin.Server{
+			Brokers: cfg.Kafka.Brokers,
+			Dialer:  dialer,
+			Topics:  topics,
+			Pools:   pools,
+			Flush:   flushTrigger,
+			Level:   loggerConfig.Level,
+			Logger:  logger,
+		}
 		group.Go(func() error {
-			return geoip.Fetcher(ctx, geoIPReader, tweetsChan, enrichedTweetsChan, logger)
+			return server.Serve(monitorCtx, cfg.AdminAddress)
 		})
 	}
 
-	for i := 0; i < config.NumElasticWriters; i++ {
+	if cfg.MetricsAddress != "" {
 		group.Go(func() error {
-			return elastic.Write(ctx, es, usrChan, enrichedTweetsChan, logger)
+			return metrics.Serve(monitorCtx, cfg.MetricsAddress, logger)
 		})
 	}
 
-	group.Go(func() error {
-		return monitor.MonitorFillness(ctx, usrChan, tweetsChan, enrichedTweetsChan, logger)
-	})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			logger.Info("shutting down", zap.Stringer("signal", sig), zap.Duration("timeout", cfg.ShutdownTimeout))
+			stopReading()
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(cfg.ShutdownTimeout):
+			logger.Error("shutdown timed out, aborting")
+			abort()
+		}
+	}()
 
 	logger.Info("...program started")
 	if err := group.Wait(); err != nil {
 		logger.Fatal("error has happened", zap.Error(err))
 	}
+	logger.Info("...program stopped")
 }
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
 	"io/ioutil"
 	"kafka-to-elastic-pipeline/application"
 	"kafka-to-elastic-pipeline/config"
+	kafkaReaders "kafka-to-elastic-pipeline/pkg/readers/kafka"
 	"kafka-to-elastic-pipeline/test/test_data"
 	"log"
 	"net/http"
@@ -20,19 +22,39 @@ const (
 	testNumTweets = 400e3
 )
 
+// Default GeoIP database, relative to the package directory tests run in
+const testDBFile = "../assets/GeoLite2-City_20190312/GeoLite2-City.mmdb"
+
+var cfg *config.Config
+
+// The pipeline runs with the default configuration, for the dev services, without environment variables of the
+// pipeline; the test is skipped if the GeoIP database is not in assets
 func TestMain(m *testing.M) {
+	if _, err := os.Stat(testDBFile); err != nil {
+		log.Printf("skipping integration test, GeoIP database is not available: %s", err)
+		os.Exit(0)
+	}
+	cfg = config.Default()
+	cfg.GeoIP.DBFile = testDBFile
 
-	kafkaConn, _ := kafka.Dial("tcp", config.KafkaBrokers[0])
-	if err := kafkaConn.DeleteTopics(config.KafkaUsersTopic, config.KafkaTweetsTopic); err != nil {
+	dialer, _, err := kafkaReaders.NewDialer(cfg.Kafka, zap.NewNop())
+	if err != nil {
+		log.Fatalf("failed to create kafka dialer: %s", err)
+	}
+	kafkaConn, err := dialer.Dial("tcp", cfg.Kafka.Brokers[0])
+	if err != nil {
+		log.Fatalf("failed to connect to kafka: %s", err)
+	}
+	if err := kafkaConn.DeleteTopics(cfg.Route("users").Topic, cfg.Route("tweets").Topic); err != nil {
 		if err.Error() != "[3] Unknown Topic Or Partition: the request is for a topic or partition that does not exist on this broker" {
 			log.Fatalf("failed to delete topics: %s", err)
 		}
 	}
 	time.Sleep(time.Second * 5) // give kafka some time to delete topics for real
 
-	err := kafkaConn.CreateTopics(
-		kafka.TopicConfig{Topic: config.KafkaUsersTopic, NumPartitions: config.NumPartitionsKafkaUsersTopic, ReplicationFactor: 1},
-		kafka.TopicConfig{Topic: config.KafkaTweetsTopic, NumPartitions: config.NumPartitionsKafkaTweetsTopic, ReplicationFactor: 1},
+	err = kafkaConn.CreateTopics(
+		kafka.TopicConfig{Topic: cfg.Route("users").Topic, NumPartitions: test_data.UsersPartitions, ReplicationFactor: 1},
+		kafka.TopicConfig{Topic: cfg.Route("tweets").Topic, NumPartitions: test_data.TweetsPartitions, ReplicationFactor: 1},
 	)
 	if err != nil {
 		log.Fatalf("failed to create topics: %s", err)
@@ -41,33 +63,32 @@ func TestMain(m *testing.M) {
 		log.Fatal("failed to close connection to kafka")
 	}
 
-	if err := test_data.CreateUsersInKafka(testNumUsers); err != nil {
+	if err := test_data.CreateUsersInKafka(cfg.Kafka, dialer, cfg.Route("users").Topic, testNumUsers); err != nil {
 		log.Fatalf("failed to create users in kafka: %s", err)
 	}
-	if err := test_data.CreateTweetsInKafka(testNumTweets); err != nil {
+	if err := test_data.CreateTweetsInKafka(cfg.Kafka, dialer, cfg.Route("tweets").Topic, testNumTweets); err != nil {
 		log.Fatalf("failed to create tweets in kafka: %s", err)
 	}
 
+	// Indices are created by the pipeline from its index templates
 	client := &http.Client{}
-	for _, method := range []string{"DELETE", "PUT"} {
-		for _, index := range []string{config.ESUsersIndex, config.ESTweetsIndex} {
-			req, err := http.NewRequest(method, fmt.Sprintf("%s/%s", config.ElasticAddress, index), nil)
-			if err != nil {
-				log.Fatalf("failed to prepare request: %s", err)
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Fatalf("failed to run request: %s", err)
-			}
-			_ = resp.Body.Close()
+	for _, index := range []string{cfg.Route("users").Index, cfg.Route("tweets").Index} {
+		req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/%s", cfg.Elastic.Addresses[0], index), nil)
+		if err != nil {
+			log.Fatalf("failed to prepare request: %s", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Fatalf("failed to run request: %s", err)
 		}
+		_ = resp.Body.Close()
 	}
 
 	os.Exit(m.Run())
 }
 
 func TestIntegration(t *testing.T) {
-	go application.Application()
+	go application.Application(cfg)
 
 	currNumUsers := int32(0)
 	currNumTweets := int32(0)
@@ -78,7 +99,7 @@ func TestIntegration(t *testing.T) {
 
 	for {
 		time.Sleep(time.Second * 5)
-		resp, err := http.Get(fmt.Sprintf("%s/%s,%s/_stats/indexing", config.ElasticAddress, config.ESUsersIndex, config.ESTweetsIndex))
+		resp, err := http.Get(fmt.Sprintf("%s/%s,%s/_stats/indexing", cfg.Elastic.Addresses[0], cfg.Route("users").Index, cfg.Route("tweets").Index))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -92,8 +113,8 @@ func TestIntegration(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		indexedUsers := int32(result["indices"].(map[string]interface{})[config.ESUsersIndex].(map[string]interface{})["primaries"].(map[string]interface{})["indexing"].(map[string]interface{})["index_total"].(float64))
-		indexedTweets := int32(result["indices"].(map[string]interface{})[config.ESTweetsIndex].(map[string]interface{})["primaries"].(map[string]interface{})["indexing"].(map[string]interface{})["index_total"].(float64))
+		indexedUsers := int32(result["indices"].(map[string]interface{})[cfg.Route("users").Index].(map[string]interface{})["primaries"].(map[string]interface{})["indexing"].(map[string]interface{})["index_total"].(float64))
+		indexedTweets := int32(result["indices"].(map[string]interface{})[cfg.Route("tweets").Index].(map[string]interface{})["primaries"].(map[string]interface{})["indexing"].(map[string]interface{})["index_total"].(float64))
 
 		if indexedUsers == testNumUsers && indexedTweets == testNumTweets {
 			// everything is good, the job is done
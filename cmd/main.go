@@ -1,10 +1,22 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"kafka-to-elastic-pipeline/application"
+	"kafka-to-elastic-pipeline/config"
+	"os"
 )
 
 // Make `main` just call another function for the sake of integration testing
 func main() {
-	application.Application()
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	application.Application(cfg)
 }
@@ -1,31 +1,922 @@
 package config
 
-import "time"
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
-// Topics and indexes
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the whole pipeline configuration.
+//
+// It is built by Load from (in order of increasing precedence) built-in defaults, a YAML or JSON file,
+// environment variables and command-line flags.
+type Config struct {
+	Kafka   Kafka   `yaml:"kafka"`
+	Elastic Elastic `yaml:"elastic"`
+	GeoIP   GeoIP   `yaml:"geoip"`
+
+	SchemaRegistry SchemaRegistry `yaml:"schema_registry"`
+
+	// Flows of records from kafka topics to elastic indices; by default users and tweets
+	Routes []Route `yaml:"routes"`
+
+	Autoscale Autoscale `yaml:"autoscale"`
+
+	ChannelsBufferSize int `yaml:"channels_buffer_size"` // one setting for several channels, for simplicity
+
+	MetricsAddress string `yaml:"metrics_address"` // address of prometheus `/metrics` endpoint; empty disables it
+
+	// Address of the admin HTTP API, to pause and resume topics, inspect offsets and workers, change log level and get
+	// profiles; empty disables it. It has no authentication, so it should only be reachable by operators.
+	AdminAddress string `yaml:"admin_address"`
+
+	// On SIGINT/SIGTERM the pipeline drains channels and flushes writers; if this takes longer, it is aborted
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// Policies for messages that fail to decode
 const (
-	KafkaUsersTopic  = "users"
-	KafkaTweetsTopic = "tweets"
+	PoisonPolicySkip = "skip"
+	PoisonPolicyDLQ  = "dlq"
+)
+
+type Kafka struct {
+	Brokers []string `yaml:"brokers"`
+
+	// Security of all connections to kafka: of readers, partition lookups and the DLQ writer
+	TLS  KafkaTLS  `yaml:"tls"`
+	SASL KafkaSASL `yaml:"sasl"`
+
+	// With GroupID set, readers are members of the consumer group and get partitions assigned by it,
+	// otherwise there is a reader per partition of each topic.
+	GroupID string `yaml:"group_id"`
+
+	// What to do with messages that fail to decode: skip them, or publish them to DLQTopic;
+	// once there are more than MaxPoisonMessages of them within PoisonWindow, the pipeline halts.
+	// The count starts over every PoisonWindow; zero window never resets it.
+	PoisonPolicy      string        `yaml:"poison_policy"`
+	DLQTopic          string        `yaml:"dlq_topic"`
+	MaxPoisonMessages int           `yaml:"max_poison_messages"`
+	PoisonWindow      time.Duration `yaml:"poison_window"`
+
+	// Offsets are committed once messages are written to elastic, in batches every CommitInterval
+	CommitInterval time.Duration `yaml:"commit_interval"`
+
+	MinBytes int `yaml:"min_bytes"`
+	MaxBytes int `yaml:"max_bytes"`
+}
+
+type KafkaTLS struct {
+	Enabled bool   `yaml:"enabled"`
+	CAFile  string `yaml:"ca_file"` // PEM bundle of CAs brokers' certificates are verified by; system ones if empty
 
-	ESUsersIndex  = "users"
-	ESTweetsIndex = "tweets"
+	// Client certificate and key in PEM, for brokers that authenticate clients by certificates. The files are checked
+	// for changes every ReloadInterval (0 disables reloading), and new connections present the new certificate.
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	ServerName         string `yaml:"server_name"` // SNI and name brokers' certificates are verified for; host of the broker if empty
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// SASL mechanisms; empty mechanism disables SASL
+const (
+	SASLMechanismPlain       = "plain"
+	SASLMechanismSCRAMSHA256 = "scram-sha-256"
+	SASLMechanismSCRAMSHA512 = "scram-sha-512"
 )
 
-var KafkaBrokers = []string{"localhost:9092"}
-var ElasticAddress = "http://localhost:9200"
+type KafkaSASL struct {
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
 
-// Hard-coded path for simplicity. Shall be replaced by something like environment variable.
-var GeoIPDBFile = "/home/max/GolandProjects/kafka-to-elastic-pipeline/assets/GeoLite2-City_20190312/GeoLite2-City.mmdb"
+// Strategies of document IDs
+const (
+	IDStrategyAuto   = "auto"   // generated by elastic
+	IDStrategyHash   = "hash"   // hash of the document
+	IDStrategyOffset = "offset" // topic-partition-offset of the kafka message
+	IDStrategyKey    = "key"    // key of the kafka message
+	IDStrategyField  = "field:" // followed by a dot-separated path of a document field, e.g. field:User.Id
+)
 
-// Performance config
+// Bulk actions documents are written with; tombstones are deleted, or handed to the failure sink (see Tombstones*)
 const (
-	NumPartitionsKafkaUsersTopic  = 2
-	NumPartitionsKafkaTweetsTopic = 10
+	ActionIndex  = "index"  // create or replace
+	ActionCreate = "create" // create, documents that already exist are left as they are
+	ActionUpdate = "update" // partial update, documents that don't exist are created (doc_as_upsert)
+	ActionScript = "script" // update by painless script with the document in params.doc; missing ones are created
+)
 
-	NumGeoIPWorkers    = 3
-	NumElasticWriters  = 2
-	ChannelsBufferSize = 100 // one setting for several channels, for simplicity
+// What to do with tombstones (messages with null value) of a route
+const (
+	TombstonesDelete = "delete" // delete the document with the ID of the tombstone
+	TombstonesFail   = "fail"   // hand the tombstone to the failure sink
+)
 
-	ElasticWorkerBuffer        = 3000
-	ElasticForcedFlushInterval = time.Second * 5
+// Timestamps index name templates are resolved by
+const (
+	TimestampKafka = "kafka"  // time of the kafka message
+	TimestampField = "field:" // followed by a dot-separated path of a document field with RFC 3339 time or epoch millis
 )
+
+// Ordering of bulk requests in flight
+const (
+	OrderingPartition = "partition" // objects of a kafka partition are written in order of offsets
+	OrderingNone      = "none"
+)
+
+// What to do when mappings of existing indices conflict with index templates
+const (
+	TemplateConflictsWarn = "warn"
+	TemplateConflictsFail = "fail"
+)
+
+type Elastic struct {
+	// Requests go to the nodes round-robin; a node that fails to respond is skipped for a while, and the request is
+	// retried on the next one. With SniffInterval set, nodes of the cluster are discovered, starting from Addresses.
+	Addresses      []string      `yaml:"addresses"`
+	SniffInterval  time.Duration `yaml:"sniff_interval"`  // 0 disables sniffing
+	RequestTimeout time.Duration `yaml:"request_timeout"` // of a single request, including reading the response
+	Compression    bool          `yaml:"compression"`     // gzip bodies of bulk requests
+
+	// Authentication, by at most one of: username and password, API key (base64 of id:key, as ES returns it),
+	// or bearer token
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	APIKey      string `yaml:"api_key"`
+	BearerToken string `yaml:"bearer_token"`
+
+	TLS ElasticTLS `yaml:"tls"` // of https addresses
+
+	// Index templates of routes are installed on startup, and existing indices are checked against them
+	Templates         bool   `yaml:"templates"`
+	TemplateConflicts string `yaml:"template_conflicts"`
+
+	// A writer buffers documents and writes them in a bulk request once it has WorkerBuffer of them, or MaxBulkBytes
+	// of them, or ForcedFlushInterval after the first one was buffered
+	Writers             int           `yaml:"writers"`
+	WorkerBuffer        int           `yaml:"worker_buffer"`
+	MaxBulkBytes        int           `yaml:"max_bulk_bytes"`
+	ForcedFlushInterval time.Duration `yaml:"forced_flush_interval"`
+
+	// While up to MaxInFlight bulk requests of a writer are in flight, it buffers the next one; once all are in flight,
+	// it stops reading its channels. With "partition" ordering, records of a kafka partition are dispatched to one
+	// enricher worker and one writer, and a request waits for earlier ones with objects of the same partitions;
+	// with "none", workers and requests go at once, in any order
+	MaxInFlight int    `yaml:"max_in_flight"`
+	Ordering    string `yaml:"ordering"`
+
+	// Objects ES is temporarily unable to index (429, 503) are retried with exponential backoff
+	MaxRetries      int           `yaml:"max_retries"`
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff"`
+
+	// When a bulk request fails as a whole because ES is unavailable (no node responds, or 502-504), the circuit
+	// breaker opens: writers keep their objects and kafka readers stop fetching, until the cluster health, probed every
+	// BreakerProbeInterval, is back
+	BreakerProbeInterval time.Duration `yaml:"breaker_probe_interval"`
+
+	// With Spill.Dir set, objects that can't be indexed for now are spilled to disk and acknowledged, instead of
+	// being held in memory
+	Spill ElasticSpill `yaml:"spill"`
+
+	// Objects that can't be indexed go to the failure sink: "log" or "file" (JSON lines appended to FailureFile)
+	FailureSink string `yaml:"failure_sink"`
+	FailureFile string `yaml:"failure_file"`
+}
+
+// Objects are spilled when ES is unavailable, or when they are still retryable after MaxRetries, and are written
+// again from the spill, in order, once ES is available
+type ElasticSpill struct {
+	Dir          string `yaml:"dir"`           // empty disables spilling
+	MaxBytes     int    `yaml:"max_bytes"`     // of all segment files; once there is no room, objects are held in memory
+	SegmentBytes int    `yaml:"segment_bytes"` // size a segment file is rolled at
+}
+
+type ElasticTLS struct {
+	CAFile             string `yaml:"ca_file"` // PEM bundle of CAs nodes are verified by; system ones if empty
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type GeoIP struct {
+	// Database files, or directories with them, in which case the newest database is used
+	DBFile       string `yaml:"db_file"`
+	ASNDBFile    string `yaml:"asn_db_file"`   // GeoLite2-ASN database, required for asn field only
+	AddressField string `yaml:"address_field"` // document field with IP address to look up
+
+	CacheSize int `yaml:"cache_size"` // number of addresses lookup results are cached for; 0 disables the cache
+
+	// How often database files are checked for updates, which are loaded without restart; 0 disables reloading
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	Fields   []string `yaml:"fields"`   // which of GeoIPField* to add to documents
+	Language string   `yaml:"language"` // names in this language (or English, if missing) instead of all of them
+}
+
+// Data geoip enricher can add to documents
+const (
+	GeoIPFieldCity         = "city"
+	GeoIPFieldCountry      = "country"
+	GeoIPFieldContinent    = "continent"
+	GeoIPFieldSubdivisions = "subdivisions"
+	GeoIPFieldPostalCode   = "postal_code"
+	GeoIPFieldLocation     = "location"
+	GeoIPFieldTimeZone     = "time_zone"
+	GeoIPFieldASN          = "asn"
+)
+
+var geoIPFields = []string{
+	GeoIPFieldCity, GeoIPFieldCountry, GeoIPFieldContinent, GeoIPFieldSubdivisions,
+	GeoIPFieldPostalCode, GeoIPFieldLocation, GeoIPFieldTimeZone, GeoIPFieldASN,
+}
+
+// Known enrichers
+const (
+	EnricherGeoIP = "geoip"
+)
+
+type Enricher struct {
+	Name    string `yaml:"name"`
+	Workers int    `yaml:"workers"`
+}
+
+// Known decoders of kafka messages. Avro and protobuf messages are in Confluent wire format: magic byte 0 and
+// schema ID, resolved by the schema registry, followed by the encoded message.
+const (
+	DecoderJSON     = "json"
+	DecoderAvro     = "avro"
+	DecoderProtobuf = "protobuf"
+	DecoderAuto     = "auto" // messages starting with the magic byte by their schema, JSON otherwise
+)
+
+var decoders = []string{DecoderJSON, DecoderAvro, DecoderProtobuf, DecoderAuto}
+
+// SchemaRegistry is Confluent schema registry, for avro, protobuf and auto decoders. Schemas are cached forever,
+// as schema IDs are never reused.
+type SchemaRegistry struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"` // of a request for a schema
+
+	// While the registry is unavailable, a reader retries to fetch the schema of its message with exponential backoff
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff"`
+}
+
+// Built-in index templates
+const (
+	TemplateUsers  = "users"
+	TemplateTweets = "tweets"
+)
+
+// Route is a flow of records from a kafka topic, decoded and enriched, to an elastic index; adding a topic to the
+// pipeline is adding a route. Routes in the configuration file replace the default ones as a whole, and values they
+// don't set get defaults of their own (see setDefaults).
+type Route struct {
+	Name    string `yaml:"name"` // in logs and metrics, and name of the index template
+	Topic   string `yaml:"topic"`
+	Readers int    `yaml:"readers"` // consumer group members reading the topic
+	Decoder string `yaml:"decoder"` // json, avro, protobuf or auto
+
+	// Ordered chain of enrichers records go through before being written
+	Enrichers []Enricher `yaml:"enrichers"`
+
+	// Index name may be a template with date patterns (yyyy, yy, MM, dd, HH) in braces, e.g. tweets-{yyyy.MM.dd},
+	// resolved per document by its timestamp, in UTC.
+	// With ILM policy set, index name is a write alias, rolled over by the policy to indices <alias>-000001, ...;
+	// the first index is created on startup if the alias doesn't exist
+	Index     string `yaml:"index"`
+	Timestamp string `yaml:"timestamp"`
+	ILMPolicy string `yaml:"ilm_policy"`
+
+	// Index template: built-in users or tweets, or path to a JSON file with one; empty for none
+	Template string `yaml:"template"`
+
+	// Documents with IDs (anything but auto) are replaced, rather than duplicated, when messages are read again
+	ID     string `yaml:"id"`
+	Action string `yaml:"action"`
+	Script string `yaml:"script"` // for script action
+
+	// Tombstones can only be deleted from a single index: the document may be in any index of a template or of an
+	// ILM alias, and a tombstone has no document to resolve a template by
+	Tombstones string `yaml:"tombstones"`
+}
+
+func (r *Route) setDefaults() {
+	if r.Readers == 0 {
+		r.Readers = 1
+	}
+	if r.Decoder == "" {
+		r.Decoder = DecoderJSON
+	}
+	if r.Timestamp == "" {
+		r.Timestamp = TimestampKafka
+	}
+	if r.ID == "" {
+		r.ID = IDStrategyAuto
+	}
+	if r.Action == "" {
+		r.Action = ActionIndex
+	}
+	if r.Tombstones == "" {
+		r.Tombstones = TombstonesDelete
+	}
+}
+
+// Route returns the route with the name, or nil
+func (c *Config) Route(name string) *Route {
+	for i := range c.Routes {
+		if c.Routes[i].Name == name {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// Autoscale adds workers to enrichers and elastic writers while their input channel is filling up and that helps
+// their throughput, and removes them while the channel is mostly empty. Configured numbers of workers are the lower
+// bounds.
+type Autoscale struct {
+	Interval           time.Duration `yaml:"interval"`      // between decisions; 0 disables autoscaling
+	HighFillness       int           `yaml:"high_fillness"` // percent of channel capacity
+	LowFillness        int           `yaml:"low_fillness"`
+	MaxEnricherWorkers int           `yaml:"max_enricher_workers"` // of every enricher
+	MaxWriters         int           `yaml:"max_writers"`
+}
+
+// Default returns configuration suitable for the dev services from `dev.services.docker-compose.yml`.
+func Default() *Config {
+	return &Config{
+		Kafka: Kafka{
+			Brokers: []string{"localhost:9092"},
+			GroupID: "kafka-to-elastic-pipeline",
+
+			TLS: KafkaTLS{
+				ReloadInterval: time.Minute,
+			},
+
+			PoisonPolicy:      PoisonPolicySkip,
+			DLQTopic:          "pipeline-dlq",
+			MaxPoisonMessages: 1000,
+			PoisonWindow:      time.Hour,
+
+			CommitInterval: time.Second,
+
+			MinBytes: 1, // in dev we want to read up to every single byte from kafka (for tests reliability);
+			MaxBytes: 10e6,
+		},
+		Elastic: Elastic{
+			Addresses:      []string{"http://localhost:9200"},
+			RequestTimeout: time.Minute,
+
+			Templates:         true,
+			TemplateConflicts: TemplateConflictsWarn,
+
+			Writers:             2,
+			WorkerBuffer:        3000,
+			MaxBulkBytes:        5 << 20,
+			ForcedFlushInterval: time.Second * 5,
+			MaxInFlight:         2,
+			Ordering:            OrderingPartition,
+
+			MaxRetries:      5,
+			RetryBackoff:    time.Millisecond * 100,
+			MaxRetryBackoff: time.Second * 10,
+
+			BreakerProbeInterval: time.Second * 5,
+			Spill: ElasticSpill{
+				MaxBytes:     1 << 30,
+				SegmentBytes: 64 << 20,
+			},
+
+			FailureSink: "log",
+		},
+		GeoIP: GeoIP{
+			DBFile:         "assets/GeoLite2-City_20190312/GeoLite2-City.mmdb",
+			AddressField:   "RemoteAddress",
+			CacheSize:      10000,
+			ReloadInterval: time.Minute,
+			Fields:         []string{GeoIPFieldCity, GeoIPFieldCountry, GeoIPFieldLocation},
+		},
+		SchemaRegistry: SchemaRegistry{
+			Timeout:         time.Second * 5,
+			RetryBackoff:    time.Second,
+			MaxRetryBackoff: time.Second * 30,
+		},
+		Routes: []Route{
+			{
+				Name:       "users",
+				Topic:      "users",
+				Readers:    2,
+				Decoder:    DecoderJSON,
+				Index:      "users",
+				Timestamp:  TimestampKafka,
+				Template:   TemplateUsers,
+				ID:         IDStrategyField + "Id", // one document per user, updated by every next message about the user
+				Action:     ActionUpdate,
+				Tombstones: TombstonesDelete,
+			},
+			{
+				Name:       "tweets",
+				Topic:      "tweets",
+				Readers:    10,
+				Decoder:    DecoderJSON,
+				Enrichers:  []Enricher{{Name: EnricherGeoIP, Workers: 3}},
+				Index:      "tweets",
+				Timestamp:  TimestampKafka,
+				Template:   TemplateTweets,
+				ID:         IDStrategyOffset,
+				Action:     ActionIndex,
+				Tombstones: TombstonesDelete,
+			},
+		},
+		Autoscale: Autoscale{
+			Interval:           time.Second * 10,
+			HighFillness:       80,
+			LowFillness:        10,
+			MaxEnricherWorkers: 16,
+			MaxWriters:         8,
+		},
+		ChannelsBufferSize: 100,
+
+		MetricsAddress: ":2112",
+
+		ShutdownTimeout: time.Second * 30,
+	}
+}
+
+// A setting is a single configuration value that can be overridden by an environment variable and by a flag.
+type setting struct {
+	name  string // flag name; environment variable name is derived from it
+	usage string
+	value func(cfg *Config) flag.Value
+}
+
+func (s setting) env() string {
+	return "PIPELINE_" + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+var settings = []setting{
+	{"kafka-brokers", "comma separated list of kafka brokers", func(c *Config) flag.Value { return (*stringsValue)(&c.Kafka.Brokers) }},
+	{"kafka-tls", "connect to kafka over TLS", func(c *Config) flag.Value { return (*boolValue)(&c.Kafka.TLS.Enabled) }},
+	{"kafka-tls-ca-file", "PEM bundle of CAs kafka brokers are verified by; system CAs if empty", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.TLS.CAFile) }},
+	{"kafka-tls-cert-file", "PEM client certificate presented to kafka brokers", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.TLS.CertFile) }},
+	{"kafka-tls-key-file", "PEM key of the client certificate", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.TLS.KeyFile) }},
+	{"kafka-tls-reload-interval", "how often client certificate files are checked for changes; 0 disables reloading", func(c *Config) flag.Value { return (*durationValue)(&c.Kafka.TLS.ReloadInterval) }},
+	{"kafka-tls-server-name", "server name kafka brokers are verified for; host of the broker if empty", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.TLS.ServerName) }},
+	{"kafka-tls-insecure-skip-verify", "don't verify certificates of kafka brokers", func(c *Config) flag.Value { return (*boolValue)(&c.Kafka.TLS.InsecureSkipVerify) }},
+	{"kafka-sasl-mechanism", "SASL mechanism: plain, scram-sha-256 or scram-sha-512; empty disables SASL", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.SASL.Mechanism) }},
+	{"kafka-sasl-username", "SASL username", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.SASL.Username) }},
+	{"kafka-sasl-password", "SASL password", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.SASL.Password) }},
+	{"kafka-group-id", "kafka consumer group; if empty, every partition is read by its own reader", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.GroupID) }},
+	{"kafka-poison-policy", "what to do with messages that fail to decode: skip or dlq", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.PoisonPolicy) }},
+	{"kafka-dlq-topic", "dead-letter queue topic for messages that fail to decode, for dlq policy", func(c *Config) flag.Value { return (*stringValue)(&c.Kafka.DLQTopic) }},
+	{"kafka-max-poison-messages", "number of messages failed to decode within the poison window after which the pipeline halts", func(c *Config) flag.Value { return (*intValue)(&c.Kafka.MaxPoisonMessages) }},
+	{"kafka-poison-window", "how often the count of messages failed to decode starts over; 0 never", func(c *Config) flag.Value { return (*durationValue)(&c.Kafka.PoisonWindow) }},
+	{"kafka-commit-interval", "how often offsets of written messages are committed", func(c *Config) flag.Value { return (*durationValue)(&c.Kafka.CommitInterval) }},
+	{"kafka-min-bytes", "min number of bytes to fetch from kafka in each request", func(c *Config) flag.Value { return (*intValue)(&c.Kafka.MinBytes) }},
+	{"kafka-max-bytes", "max number of bytes to fetch from kafka in each request", func(c *Config) flag.Value { return (*intValue)(&c.Kafka.MaxBytes) }},
+
+	{"elastic-addresses", "comma separated list of elasticsearch node URLs", func(c *Config) flag.Value { return (*stringsValue)(&c.Elastic.Addresses) }},
+	{"elastic-sniff-interval", "how often nodes of elasticsearch cluster are discovered; 0 disables sniffing", func(c *Config) flag.Value { return (*durationValue)(&c.Elastic.SniffInterval) }},
+	{"elastic-request-timeout", "timeout of a request to elasticsearch", func(c *Config) flag.Value { return (*durationValue)(&c.Elastic.RequestTimeout) }},
+	{"elastic-compression", "gzip bodies of bulk requests", func(c *Config) flag.Value { return (*boolValue)(&c.Elastic.Compression) }},
+	{"elastic-username", "username of elasticsearch basic authentication", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.Username) }},
+	{"elastic-password", "password of elasticsearch basic authentication", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.Password) }},
+	{"elastic-api-key", "elasticsearch API key, base64 encoded id:key", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.APIKey) }},
+	{"elastic-bearer-token", "elasticsearch bearer token", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.BearerToken) }},
+	{"elastic-tls-ca-file", "PEM bundle of CAs elasticsearch nodes are verified by; system CAs if empty", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.TLS.CAFile) }},
+	{"elastic-tls-cert-file", "PEM client certificate presented to elasticsearch", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.TLS.CertFile) }},
+	{"elastic-tls-key-file", "PEM key of the client certificate", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.TLS.KeyFile) }},
+	{"elastic-tls-insecure-skip-verify", "don't verify certificates of elasticsearch nodes", func(c *Config) flag.Value { return (*boolValue)(&c.Elastic.TLS.InsecureSkipVerify) }},
+	{"elastic-templates", "install index templates of users and tweets on startup", func(c *Config) flag.Value { return (*boolValue)(&c.Elastic.Templates) }},
+	{"elastic-template-conflicts", "what to do when existing indices conflict with templates: warn or fail", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.TemplateConflicts) }},
+	{"elastic-writers", "number of elasticsearch writers", func(c *Config) flag.Value { return (*intValue)(&c.Elastic.Writers) }},
+	{"elastic-worker-buffer", "number of documents a writer buffers before flushing", func(c *Config) flag.Value { return (*intValue)(&c.Elastic.WorkerBuffer) }},
+	{"elastic-max-bulk-bytes", "approximate number of bytes of documents a writer buffers before flushing", func(c *Config) flag.Value { return (*intValue)(&c.Elastic.MaxBulkBytes) }},
+	{"elastic-forced-flush-interval", "max time documents stay in a writer buffer", func(c *Config) flag.Value { return (*durationValue)(&c.Elastic.ForcedFlushInterval) }},
+	{"elastic-max-in-flight", "number of bulk requests a writer has in flight at once", func(c *Config) flag.Value { return (*intValue)(&c.Elastic.MaxInFlight) }},
+	{"elastic-ordering", "ordering of bulk requests in flight: partition or none", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.Ordering) }},
+	{"elastic-max-retries", "how many times objects are retried when ES is temporarily unable to index them", func(c *Config) flag.Value { return (*intValue)(&c.Elastic.MaxRetries) }},
+	{"elastic-retry-backoff", "delay before the first retry, doubled with every next one", func(c *Config) flag.Value { return (*durationValue)(&c.Elastic.RetryBackoff) }},
+	{"elastic-max-retry-backoff", "max delay between retries", func(c *Config) flag.Value { return (*durationValue)(&c.Elastic.MaxRetryBackoff) }},
+	{"elastic-breaker-probe-interval", "how often cluster health is probed while ES is unavailable", func(c *Config) flag.Value { return (*durationValue)(&c.Elastic.BreakerProbeInterval) }},
+	{"elastic-spill-dir", "directory objects that can't be indexed for now are spilled to; empty disables spilling", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.Spill.Dir) }},
+	{"elastic-spill-max-bytes", "max size of spilled objects", func(c *Config) flag.Value { return (*intValue)(&c.Elastic.Spill.MaxBytes) }},
+	{"elastic-spill-segment-bytes", "size a spill segment file is rolled at", func(c *Config) flag.Value { return (*intValue)(&c.Elastic.Spill.SegmentBytes) }},
+	{"elastic-failure-sink", "where objects ES refused to index go: log or file", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.FailureSink) }},
+	{"elastic-failure-file", "file failed objects are appended to, for file failure sink", func(c *Config) flag.Value { return (*stringValue)(&c.Elastic.FailureFile) }},
+
+	{"geoip-db-file", "path to MaxMind GeoIP2/GeoLite2 city database, or directory with them", func(c *Config) flag.Value { return (*stringValue)(&c.GeoIP.DBFile) }},
+	{"geoip-asn-db-file", "path to MaxMind GeoLite2 ASN database, or directory with them, for asn field", func(c *Config) flag.Value { return (*stringValue)(&c.GeoIP.ASNDBFile) }},
+	{"geoip-fields", "comma separated list of geo data added to documents: " + strings.Join(geoIPFields, ", "), func(c *Config) flag.Value { return (*stringsValue)(&c.GeoIP.Fields) }},
+	{"geoip-language", "language of names (e.g. en, de); empty for names in all languages", func(c *Config) flag.Value { return (*stringValue)(&c.GeoIP.Language) }},
+	{"geoip-cache-size", "number of addresses geoip lookup results are cached for; 0 disables the cache", func(c *Config) flag.Value { return (*intValue)(&c.GeoIP.CacheSize) }},
+	{"geoip-reload-interval", "how often geoip databases are checked for updates; 0 disables reloading", func(c *Config) flag.Value { return (*durationValue)(&c.GeoIP.ReloadInterval) }},
+	{"geoip-address-field", "document field with IP address to look up", func(c *Config) flag.Value { return (*stringValue)(&c.GeoIP.AddressField) }},
+
+	{"schema-registry-url", "URL of the schema registry for avro, protobuf and auto decoders", func(c *Config) flag.Value { return (*stringValue)(&c.SchemaRegistry.URL) }},
+	{"schema-registry-timeout", "timeout of a request to the schema registry", func(c *Config) flag.Value { return (*durationValue)(&c.SchemaRegistry.Timeout) }},
+	{"schema-registry-retry-backoff", "delay before the first retry to fetch a schema, doubled with every next one", func(c *Config) flag.Value { return (*durationValue)(&c.SchemaRegistry.RetryBackoff) }},
+	{"schema-registry-max-retry-backoff", "max delay between retries to fetch a schema", func(c *Config) flag.Value { return (*durationValue)(&c.SchemaRegistry.MaxRetryBackoff) }},
+
+	// Settings of the default routes; they fail if routes of the configuration file don't have users or tweets
+	{"kafka-users-topic", "kafka topic with users", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.Topic) })},
+	{"kafka-tweets-topic", "kafka topic with tweets", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.Topic) })},
+	{"kafka-users-readers", "number of consumer group members reading users topic", routeValue("users", func(r *Route) flag.Value { return (*intValue)(&r.Readers) })},
+	{"kafka-tweets-readers", "number of consumer group members reading tweets topic", routeValue("tweets", func(r *Route) flag.Value { return (*intValue)(&r.Readers) })},
+	{"enrichers-users", "comma separated chain of name:workers enrichers for users", routeValue("users", func(r *Route) flag.Value { return (*enrichersValue)(&r.Enrichers) })},
+	{"enrichers-tweets", "comma separated chain of name:workers enrichers for tweets", routeValue("tweets", func(r *Route) flag.Value { return (*enrichersValue)(&r.Enrichers) })},
+	{"elastic-users-index", "elasticsearch index for users", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.Index) })},
+	{"elastic-tweets-index", "elasticsearch index for tweets", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.Index) })},
+	{"elastic-users-timestamp", "timestamp users index template is resolved by: kafka or field:<path>", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.Timestamp) })},
+	{"elastic-tweets-timestamp", "timestamp tweets index template is resolved by: kafka or field:<path>", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.Timestamp) })},
+	{"elastic-users-ilm-policy", "ILM policy rolling over users index, which becomes a write alias", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.ILMPolicy) })},
+	{"elastic-tweets-ilm-policy", "ILM policy rolling over tweets index, which becomes a write alias", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.ILMPolicy) })},
+	{"elastic-users-id", "id of users documents: auto, hash, offset, key or field:<path>", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.ID) })},
+	{"elastic-tweets-id", "id of tweets documents: auto, hash, offset, key or field:<path>", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.ID) })},
+	{"elastic-users-action", "bulk action users are written with: index, create, update or script", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.Action) })},
+	{"elastic-tweets-action", "bulk action tweets are written with: index, create, update or script", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.Action) })},
+	{"elastic-users-script", "painless script updating users, for script action; the user is in params.doc", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.Script) })},
+	{"elastic-tweets-script", "painless script updating tweets, for script action; the tweet is in params.doc", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.Script) })},
+	{"elastic-users-tombstones", "what to do with tombstones of users: delete or fail (hand them to the failure sink)", routeValue("users", func(r *Route) flag.Value { return (*stringValue)(&r.Tombstones) })},
+	{"elastic-tweets-tombstones", "what to do with tombstones of tweets: delete or fail (hand them to the failure sink)", routeValue("tweets", func(r *Route) flag.Value { return (*stringValue)(&r.Tombstones) })},
+
+	{"autoscale-interval", "interval of scaling workers of enrichers and writers; 0 disables autoscaling", func(c *Config) flag.Value { return (*durationValue)(&c.Autoscale.Interval) }},
+	{"autoscale-high-fillness", "percent of input channel fillness above which workers are added", func(c *Config) flag.Value { return (*intValue)(&c.Autoscale.HighFillness) }},
+	{"autoscale-low-fillness", "percent of input channel fillness below which workers are removed", func(c *Config) flag.Value { return (*intValue)(&c.Autoscale.LowFillness) }},
+	{"autoscale-max-enricher-workers", "max number of workers of every enricher", func(c *Config) flag.Value { return (*intValue)(&c.Autoscale.MaxEnricherWorkers) }},
+	{"autoscale-max-writers", "max number of elasticsearch writers", func(c *Config) flag.Value { return (*intValue)(&c.Autoscale.MaxWriters) }},
+
+	{"channels-buffer-size", "size of channels between pipeline bricks", func(c *Config) flag.Value { return (*intValue)(&c.ChannelsBufferSize) }},
+	{"shutdown-timeout", "max time of graceful shutdown, after which the pipeline is aborted", func(c *Config) flag.Value { return (*durationValue)(&c.ShutdownTimeout) }},
+	{"metrics-address", "address of prometheus /metrics endpoint; empty disables it", func(c *Config) flag.Value { return (*stringValue)(&c.MetricsAddress) }},
+	{"admin-address", "address of the admin HTTP API; empty disables it", func(c *Config) flag.Value { return (*stringValue)(&c.AdminAddress) }},
+}
+
+// routeValue points into the route with the name
+func routeValue(name string, value func(r *Route) flag.Value) func(c *Config) flag.Value {
+	return func(c *Config) flag.Value {
+		if route := c.Route(name); route != nil {
+			return value(route)
+		}
+		return missingRouteValue(name)
+	}
+}
+
+// Load builds configuration from defaults, the file given by `-config` flag (or PIPELINE_CONFIG environment variable),
+// PIPELINE_* environment variables and command-line flags, each one overriding the previous.
+func Load(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("pipeline", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("PIPELINE_CONFIG"), "path to YAML or JSON configuration file")
+
+	// Flags are only recorded while parsing: they have to be applied after the file and the environment.
+	defaults := Default()
+	for _, s := range settings {
+		flags.Var(&rawValue{raw: s.value(defaults).String()}, s.name, fmt.Sprintf("%s (env %s)", s.usage, s.env()))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		if err := loadFile(*configFile, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(s.env()); ok {
+			if err := s.value(cfg).Set(raw); err != nil {
+				return nil, errors.Wrapf(err, "invalid value of %s", s.env())
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && err == nil {
+				err = errors.Wrapf(s.value(cfg).Set(f.Value.String()), "invalid value of -%s", s.name)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to read config file")
+	}
+	// JSON is a subset of YAML, so one decoder serves both formats
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return errors.Wrapf(err, "failed to parse config file %s", path)
+	}
+	for i := range cfg.Routes {
+		cfg.Routes[i].setDefaults()
+	}
+	return nil
+}
+
+// Literal parts of index names, and date patterns in braces
+var indexTemplate = regexp.MustCompile(`^([^{}]|\{(yyyy|yy|MM|dd|HH|[.\-_])*(yyyy|yy|MM|dd|HH)(yyyy|yy|MM|dd|HH|[.\-_])*\})*$`)
+
+// Validate reports all missing or invalid values at once.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(len(c.Kafka.Brokers) > 0, "kafka brokers are not set")
+	for _, broker := range c.Kafka.Brokers {
+		check(broker != "", "kafka broker address is empty")
+	}
+	tls := c.Kafka.TLS
+	check(tls.Enabled || tls.CAFile == "" && tls.CertFile == "" && tls.KeyFile == "", "kafka tls files are set, but tls is not enabled")
+	check((tls.CertFile == "") == (tls.KeyFile == ""), "kafka tls cert file and key file must be set together")
+	check(tls.ReloadInterval >= 0, "kafka tls reload interval must not be negative, got %s", tls.ReloadInterval)
+	switch c.Kafka.SASL.Mechanism {
+	case "":
+	case SASLMechanismPlain, SASLMechanismSCRAMSHA256, SASLMechanismSCRAMSHA512:
+		check(c.Kafka.SASL.Username != "" && c.Kafka.SASL.Password != "", "kafka sasl username and password are not set")
+	default:
+		check(false, "kafka sasl mechanism must be %s, %s or %s, got %q", SASLMechanismPlain, SASLMechanismSCRAMSHA256, SASLMechanismSCRAMSHA512, c.Kafka.SASL.Mechanism)
+	}
+	switch c.Kafka.PoisonPolicy {
+	case PoisonPolicySkip:
+	case PoisonPolicyDLQ:
+		check(c.Kafka.DLQTopic != "", "kafka dlq topic is not set")
+	default:
+		check(false, "kafka poison policy must be %s or %s, got %q", PoisonPolicySkip, PoisonPolicyDLQ, c.Kafka.PoisonPolicy)
+	}
+	check(c.Kafka.MaxPoisonMessages >= 0, "kafka max poison messages must not be negative, got %d", c.Kafka.MaxPoisonMessages)
+	check(c.Kafka.PoisonWindow >= 0, "kafka poison window must not be negative, got %s", c.Kafka.PoisonWindow)
+	check(c.Kafka.CommitInterval > 0, "kafka commit interval must be positive, got %s", c.Kafka.CommitInterval)
+	check(c.Kafka.MinBytes > 0, "kafka min bytes must be positive, got %d", c.Kafka.MinBytes)
+	check(c.Kafka.MaxBytes >= c.Kafka.MinBytes, "kafka max bytes (%d) must not be less than min bytes (%d)", c.Kafka.MaxBytes, c.Kafka.MinBytes)
+
+	check(len(c.Elastic.Addresses) > 0, "elastic addresses are not set")
+	for _, address := range c.Elastic.Addresses {
+		u, err := url.Parse(address)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "elastic address %q is not a http(s) URL", address)
+	}
+	check(c.Elastic.SniffInterval >= 0, "elastic sniff interval must not be negative, got %s", c.Elastic.SniffInterval)
+	check(c.Elastic.RequestTimeout > 0, "elastic request timeout must be positive, got %s", c.Elastic.RequestTimeout)
+	auths := 0
+	for _, set := range []bool{c.Elastic.Username != "" || c.Elastic.Password != "", c.Elastic.APIKey != "", c.Elastic.BearerToken != ""} {
+		if set {
+			auths++
+		}
+	}
+	check(auths <= 1, "elastic authentication must be one of username and password, api key or bearer token")
+	check(c.Elastic.Password == "" || c.Elastic.Username != "", "elastic username is not set")
+	check((c.Elastic.TLS.CertFile == "") == (c.Elastic.TLS.KeyFile == ""), "elastic tls cert file and key file must be set together")
+	check(c.Elastic.TemplateConflicts == TemplateConflictsWarn || c.Elastic.TemplateConflicts == TemplateConflictsFail,
+		"elastic template conflicts must be %s or %s, got %q", TemplateConflictsWarn, TemplateConflictsFail, c.Elastic.TemplateConflicts)
+	check(c.Elastic.Writers > 0, "elastic writers must be positive, got %d", c.Elastic.Writers)
+	check(c.Elastic.WorkerBuffer > 0, "elastic worker buffer must be positive, got %d", c.Elastic.WorkerBuffer)
+	check(c.Elastic.MaxBulkBytes > 0, "elastic max bulk bytes must be positive, got %d", c.Elastic.MaxBulkBytes)
+	check(c.Elastic.ForcedFlushInterval > 0, "elastic forced flush interval must be positive, got %s", c.Elastic.ForcedFlushInterval)
+	check(c.Elastic.MaxInFlight > 0, "elastic max in flight must be positive, got %d", c.Elastic.MaxInFlight)
+	check(c.Elastic.Ordering == OrderingPartition || c.Elastic.Ordering == OrderingNone,
+		"elastic ordering must be %s or %s, got %q", OrderingPartition, OrderingNone, c.Elastic.Ordering)
+
+	check(c.Elastic.MaxRetries >= 0, "elastic max retries must not be negative, got %d", c.Elastic.MaxRetries)
+	check(c.Elastic.RetryBackoff > 0, "elastic retry backoff must be positive, got %s", c.Elastic.RetryBackoff)
+	check(c.Elastic.MaxRetryBackoff >= c.Elastic.RetryBackoff, "elastic max retry backoff (%s) must not be less than retry backoff (%s)", c.Elastic.MaxRetryBackoff, c.Elastic.RetryBackoff)
+	check(c.Elastic.BreakerProbeInterval > 0, "elastic breaker probe interval must be positive, got %s", c.Elastic.BreakerProbeInterval)
+	if c.Elastic.Spill.Dir != "" {
+		check(c.Elastic.Spill.SegmentBytes > 0, "elastic spill segment bytes must be positive, got %d", c.Elastic.Spill.SegmentBytes)
+		check(c.Elastic.Spill.MaxBytes >= c.Elastic.MaxBulkBytes, "elastic spill max bytes (%d) must not be less than max bulk bytes (%d)", c.Elastic.Spill.MaxBytes, c.Elastic.MaxBulkBytes)
+	}
+	switch c.Elastic.FailureSink {
+	case "log":
+	case "file":
+		check(c.Elastic.FailureFile != "", "elastic failure file is not set")
+	default:
+		check(false, "elastic failure sink must be log or file, got %q", c.Elastic.FailureSink)
+	}
+
+	check(c.GeoIP.DBFile != "", "geoip db file is not set")
+	check(c.GeoIP.AddressField != "", "geoip address field is not set")
+	check(c.GeoIP.CacheSize >= 0, "geoip cache size must not be negative, got %d", c.GeoIP.CacheSize)
+	check(c.GeoIP.ReloadInterval >= 0, "geoip reload interval must not be negative, got %s", c.GeoIP.ReloadInterval)
+	for _, field := range c.GeoIP.Fields {
+		known := false
+		for _, geoIPField := range geoIPFields {
+			known = known || field == geoIPField
+		}
+		check(known, "unknown geoip field %q", field)
+		check(field != GeoIPFieldASN || c.GeoIP.ASNDBFile != "", "geoip asn db file is not set")
+	}
+
+	if c.SchemaRegistry.URL != "" {
+		u, err := url.Parse(c.SchemaRegistry.URL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "schema registry url %q is not a http(s) URL", c.SchemaRegistry.URL)
+	}
+	check(c.SchemaRegistry.Timeout > 0, "schema registry timeout must be positive, got %s", c.SchemaRegistry.Timeout)
+	check(c.SchemaRegistry.RetryBackoff > 0, "schema registry retry backoff must be positive, got %s", c.SchemaRegistry.RetryBackoff)
+	check(c.SchemaRegistry.MaxRetryBackoff >= c.SchemaRegistry.RetryBackoff, "schema registry max retry backoff (%s) must not be less than retry backoff (%s)",
+		c.SchemaRegistry.MaxRetryBackoff, c.SchemaRegistry.RetryBackoff)
+
+	check(len(c.Routes) > 0, "routes are not set")
+	names, topics := map[string]bool{}, map[string]string{}
+	for _, route := range c.Routes {
+		c.validateRoute(route, check)
+		check(!names[route.Name], "route %s is set twice", route.Name)
+		check(topics[route.Topic] == "", "routes %s and %s read the same topic %s", topics[route.Topic], route.Name, route.Topic)
+		names[route.Name], topics[route.Topic] = true, route.Name
+	}
+
+	if c.Autoscale.Interval != 0 {
+		check(c.Autoscale.Interval > 0, "autoscale interval must not be negative, got %s", c.Autoscale.Interval)
+		check(0 <= c.Autoscale.LowFillness && c.Autoscale.LowFillness < c.Autoscale.HighFillness && c.Autoscale.HighFillness <= 100,
+			"autoscale fillness must be 0 <= low < high <= 100, got low %d and high %d", c.Autoscale.LowFillness, c.Autoscale.HighFillness)
+		check(c.Elastic.Writers <= c.Autoscale.MaxWriters,
+			"elastic writers must not be more than autoscale max writers %d, got %d", c.Autoscale.MaxWriters, c.Elastic.Writers)
+		check(c.ChannelsBufferSize > 0, "autoscaling needs channels with buffers, channels buffer size is 0")
+	}
+	check(c.ChannelsBufferSize >= 0, "channels buffer size must not be negative, got %d", c.ChannelsBufferSize)
+	check(c.ShutdownTimeout > 0, "shutdown timeout must be positive, got %s", c.ShutdownTimeout)
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateRoute checks the route; problems mention it by name, e.g. "kafka users topic is not set"
+func (c *Config) validateRoute(route Route, check func(ok bool, format string, args ...interface{})) {
+	name := route.Name
+	check(name != "", "route name is not set")
+	check(route.Topic != "", "kafka %s topic is not set", name)
+	check(route.Readers > 0, "kafka %s readers must be positive, got %d", name, route.Readers)
+	knownDecoder := false
+	for _, decoder := range decoders {
+		knownDecoder = knownDecoder || route.Decoder == decoder
+	}
+	check(knownDecoder, "%s decoder must be one of %s, got %q", name, strings.Join(decoders, ", "), route.Decoder)
+	check(route.Decoder == DecoderJSON || c.SchemaRegistry.URL != "", "schema registry url is not set, %s decoder %s needs it", name, route.Decoder)
+
+	for _, enricher := range route.Enrichers {
+		check(enricher.Name == EnricherGeoIP, "unknown %s enricher %q", name, enricher.Name)
+		check(enricher.Workers > 0, "%s enricher %s workers must be positive, got %d", name, enricher.Name, enricher.Workers)
+		check(c.Autoscale.Interval == 0 || enricher.Workers <= c.Autoscale.MaxEnricherWorkers,
+			"%s enricher %s workers must not be more than autoscale max enricher workers %d, got %d", name, enricher.Name, c.Autoscale.MaxEnricherWorkers, enricher.Workers)
+	}
+
+	check(route.Index != "", "elastic %s index is not set", name)
+	check(indexTemplate.MatchString(route.Index), "elastic %s index %q is not a valid template", name, route.Index)
+	check(route.ILMPolicy == "" || !strings.Contains(route.Index, "{"), "elastic %s index with ilm policy must not be a template", name)
+	check(route.Timestamp == TimestampKafka || strings.HasPrefix(route.Timestamp, TimestampField) && route.Timestamp != TimestampField,
+		"elastic %s timestamp must be kafka or field:<path>, got %q", name, route.Timestamp)
+
+	switch {
+	case route.ID == IDStrategyAuto, route.ID == IDStrategyHash, route.ID == IDStrategyOffset, route.ID == IDStrategyKey:
+	case strings.HasPrefix(route.ID, IDStrategyField):
+		check(route.ID != IDStrategyField, "elastic %s id field is not set", name)
+	default:
+		check(false, "elastic %s id must be auto, hash, offset, key or field:<path>, got %q", name, route.ID)
+	}
+
+	switch route.Action {
+	case ActionIndex, ActionCreate:
+	case ActionUpdate, ActionScript:
+		check(route.ID != IDStrategyAuto, "elastic %s action %s needs document id", name, route.Action)
+		check(route.Action != ActionScript || route.Script != "", "elastic %s script is not set", name)
+	default:
+		check(false, "elastic %s action must be index, create, update or script, got %q", name, route.Action)
+	}
+
+	switch route.Tombstones {
+	case TombstonesDelete:
+		check(!strings.Contains(route.Index, "{") && route.ILMPolicy == "",
+			"elastic %s tombstones can't be deleted from index template or ilm alias %q, set them to %s", name, route.Index, TombstonesFail)
+	case TombstonesFail:
+	default:
+		check(false, "elastic %s tombstones must be %s or %s, got %q", name, TombstonesDelete, TombstonesFail, route.Tombstones)
+	}
+}
+
+// flag.Value implementations pointing into Config fields
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return errors.Errorf("%q is not an integer", s)
+	}
+	*v = intValue(i)
+	return nil
+}
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.Errorf("%q is not a boolean", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v = durationValue(d)
+	return nil
+}
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+type stringsValue []string
+
+func (v *stringsValue) Set(s string) error {
+	*v = nil
+	for _, el := range strings.Split(s, ",") {
+		if el = strings.TrimSpace(el); el != "" {
+			*v = append(*v, el)
+		}
+	}
+	return nil
+}
+func (v *stringsValue) String() string { return strings.Join(*v, ",") }
+
+type enrichersValue []Enricher
+
+func (v *enrichersValue) Set(s string) error {
+	*v = nil
+	for _, el := range strings.Split(s, ",") {
+		if el = strings.TrimSpace(el); el == "" {
+			continue
+		}
+		enricher := Enricher{Name: el, Workers: 1}
+		if i := strings.LastIndex(el, ":"); i >= 0 {
+			workers, err := strconv.Atoi(el[i+1:])
+			if err != nil {
+				return errors.Errorf("%q is not name:workers", el)
+			}
+			enricher = Enricher{Name: el[:i], Workers: workers}
+		}
+		*v = append(*v, enricher)
+	}
+	return nil
+}
+func (v *enrichersValue) String() string {
+	var enrichers []string
+	for _, enricher := range *v {
+		enrichers = append(enrichers, fmt.Sprintf("%s:%d", enricher.Name, enricher.Workers))
+	}
+	return strings.Join(enrichers, ",")
+}
+
+// missingRouteValue stands for settings of a route that is not configured
+type missingRouteValue string
+
+func (v missingRouteValue) Set(string) error { return errors.Errorf("there is no route %s", string(v)) }
+func (v missingRouteValue) String() string   { return "" }
+
+// rawValue remembers a flag value as is, to be applied later
+type rawValue struct {
+	raw string
+}
+
+func (v *rawValue) Set(s string) error { v.raw = s; return nil }
+func (v *rawValue) String() string     { return v.raw }
@@ -0,0 +1,201 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Fatalf("unexpected config; got %+v, want %+v", cfg, Default())
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "pipeline.yml")
+	data := `
+kafka:
+  brokers: [kafka-1:9092, kafka-2:9092]
+elastic:
+  writers: 7
+  forced_flush_interval: 2s
+routes:
+  - name: users
+    topic: file-users
+    index: users
+  - name: tweets
+    topic: file-tweets
+    index: tweets
+    enrichers:
+      - name: geoip
+        workers: 5
+`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer setenv(t, "PIPELINE_CONFIG", file)()
+	defer setenv(t, "PIPELINE_KAFKA_TWEETS_TOPIC", "env-tweets")()
+	defer setenv(t, "PIPELINE_ENRICHERS_TWEETS", "geoip:6")()
+
+	cfg, err := Load([]string{"-enrichers-tweets", "geoip:9"})
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	if want := []string{"kafka-1:9092", "kafka-2:9092"}; !reflect.DeepEqual(cfg.Kafka.Brokers, want) {
+		t.Fatalf("unexpected brokers; got %s, want %s", cfg.Kafka.Brokers, want)
+	}
+	if cfg.Route("users").Topic != "file-users" {
+		t.Fatalf("file must override defaults; got %s", cfg.Route("users").Topic)
+	}
+	if cfg.Route("tweets").Topic != "env-tweets" {
+		t.Fatalf("environment must override file; got %s", cfg.Route("tweets").Topic)
+	}
+	if want := []Enricher{{Name: EnricherGeoIP, Workers: 9}}; !reflect.DeepEqual(cfg.Route("tweets").Enrichers, want) {
+		t.Fatalf("flags must override environment; got %+v", cfg.Route("tweets").Enrichers)
+	}
+	if users := cfg.Route("users"); users.Readers != 1 || users.Decoder != DecoderJSON || users.ID != IDStrategyAuto || users.Action != ActionIndex || users.Tombstones != TombstonesDelete {
+		t.Fatalf("values missing in routes of the file must get defaults of routes; got %+v", users)
+	}
+	if cfg.Elastic.Writers != 7 || cfg.Elastic.ForcedFlushInterval != time.Second*2 {
+		t.Fatalf("unexpected elastic config %+v", cfg.Elastic)
+	}
+	if cfg.Elastic.WorkerBuffer != Default().Elastic.WorkerBuffer {
+		t.Fatalf("values missing in file must keep defaults; got %d", cfg.Elastic.WorkerBuffer)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	defer setenv(t, "PIPELINE_ELASTIC_WRITERS", "0")()
+
+	_, err := Load([]string{"-kafka-brokers", "", "-elastic-addresses", "localhost:9200"})
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, want := range []string{"kafka brokers are not set", "elastic writers must be positive", `elastic address "localhost:9200"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q doesn't mention %q", err, want)
+		}
+	}
+
+	if _, err := Load([]string{"-elastic-writers", "many"}); err == nil {
+		t.Fatal("expected error for malformed number")
+	}
+	if _, err := Load([]string{"-enrichers-tweets", "geoip:many"}); err == nil {
+		t.Fatal("expected error for malformed enricher")
+	}
+	if _, err := Load([]string{"-enrichers-users", "geoip,sentiment:2"}); err == nil || !strings.Contains(err.Error(), `unknown users enricher "sentiment"`) {
+		t.Fatalf("expected error for unknown enricher, got %v", err)
+	}
+	if _, err := Load([]string{"-elastic-users-id", "auto"}); err == nil || !strings.Contains(err.Error(), "elastic users action update needs document id") {
+		t.Fatalf("expected error for update without id, got %v", err)
+	}
+	if _, err := Load([]string{"-elastic-tweets-index", "tweets-{week}"}); err == nil || !strings.Contains(err.Error(), `elastic tweets index "tweets-{week}" is not a valid template`) {
+		t.Fatalf("expected error for invalid index template, got %v", err)
+	}
+	if _, err := Load([]string{"-elastic-tweets-index", "tweets-{yyyy.MM.dd}"}); err == nil || !strings.Contains(err.Error(), `elastic tweets tombstones can't be deleted from index template or ilm alias "tweets-{yyyy.MM.dd}"`) {
+		t.Fatalf("expected error for tombstones deleted from index template, got %v", err)
+	}
+	if _, err := Load([]string{"-elastic-tweets-index", "tweets-{yyyy.MM.dd}", "-elastic-tweets-tombstones", "fail"}); err != nil && strings.Contains(err.Error(), "tombstones") {
+		t.Fatalf("tombstones of index template may go to failure sink: %s", err)
+	}
+	if _, err := Load([]string{"-elastic-users-ilm-policy", "users-policy"}); err == nil || !strings.Contains(err.Error(), `elastic users tombstones can't be deleted from index template or ilm alias "users"`) {
+		t.Fatalf("expected error for tombstones deleted from ilm alias, got %v", err)
+	}
+	if _, err := Load([]string{"-kafka-sasl-mechanism", "scram-sha-512", "-kafka-tls-cert-file", "client.pem"}); err == nil ||
+		!strings.Contains(err.Error(), "kafka sasl username and password are not set") || !strings.Contains(err.Error(), "kafka tls files are set, but tls is not enabled") ||
+		!strings.Contains(err.Error(), "kafka tls cert file and key file must be set together") {
+		t.Fatalf("expected errors for incomplete kafka security settings, got %v", err)
+	}
+	if _, err := Load([]string{"-elastic-password", "secret", "-elastic-api-key", "aWQ6a2V5", "-elastic-tls-cert-file", "client.pem"}); err == nil ||
+		!strings.Contains(err.Error(), "elastic authentication must be one of username and password, api key or bearer token") ||
+		!strings.Contains(err.Error(), "elastic username is not set") || !strings.Contains(err.Error(), "elastic tls cert file and key file must be set together") {
+		t.Fatalf("expected errors for conflicting elastic security settings, got %v", err)
+	}
+	if _, err := Load([]string{"-elastic-spill-dir", "spill", "-elastic-spill-max-bytes", "1000"}); err == nil ||
+		!strings.Contains(err.Error(), "elastic spill max bytes (1000) must not be less than max bulk bytes") {
+		t.Fatalf("expected error for too small spill, got %v", err)
+	}
+	if _, err := Load([]string{"-schema-registry-retry-backoff", "1m"}); err == nil || !strings.Contains(err.Error(), "schema registry max retry backoff (30s) must not be less than retry backoff (1m0s)") {
+		t.Fatalf("expected error for retry backoff above max, got %v", err)
+	}
+	if _, err := Load([]string{"-geoip-fields", "city,asn"}); err == nil || !strings.Contains(err.Error(), "geoip asn db file is not set") {
+		t.Fatalf("expected error for asn field without database, got %v", err)
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "pipeline.yml")
+	data := `
+routes:
+  - name: orders
+    topic: orders
+    index: orders-{yyyy.MM}
+    id: key
+    tombstones: fail
+  - name: payments
+    topic: orders
+    index: payments
+    action: update
+    decoder: avro
+`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer setenv(t, "PIPELINE_CONFIG", file)()
+
+	_, err = Load(nil)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+	for _, want := range []string{"routes orders and payments read the same topic orders", "elastic payments action update needs document id",
+		"schema registry url is not set, payments decoder avro needs it"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("error %q doesn't mention %q", err, want)
+		}
+	}
+
+	if _, err := Load([]string{"-kafka-payments-topic", "payments"}); err == nil {
+		t.Fatal("expected error for unknown flag")
+	}
+	if _, err := Load([]string{"-kafka-users-topic", "users"}); err == nil || !strings.Contains(err.Error(), "there is no route users") {
+		t.Fatalf("expected error for setting of missing route, got %v", err)
+	}
+}
+
+// setenv sets an environment variable and returns a function restoring its previous state
+func setenv(t *testing.T, key, value string) func() {
+	previous, existed := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if existed {
+			_ = os.Setenv(key, previous)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	}
+}
@@ -4,11 +4,11 @@ go 1.12
 
 require (
 	github.com/elastic/go-elasticsearch v0.0.0
-	github.com/golang/snappy v0.0.1 // indirect
 	github.com/oschwald/maxminddb-golang v1.3.0
-	github.com/pierrec/lz4 v2.0.5+incompatible // indirect
 	github.com/pkg/errors v0.8.1
-	github.com/segmentio/kafka-go v0.2.2
+	github.com/prometheus/client_golang v0.9.2
+	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
+	github.com/segmentio/kafka-go v0.3.5
 	github.com/stretchr/testify v1.3.0 // indirect
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
@@ -16,4 +16,5 @@ require (
 	golang.org/x/net v0.0.0-20190424112056-4829fb13d2c6 // indirect
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
 	golang.org/x/sys v0.0.0-20190426135247-a129542de9ae // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,193 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	kafkaGo "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/pkg/readers/kafka"
+	"kafka-to-elastic-pipeline/pkg/workers"
+	"kafka-to-elastic-pipeline/pkg/writers/elastic"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// End offsets of all partitions are looked up within this time
+const endOffsetsTimeout = time.Second * 10
+
+// Topic is what the admin API controls and inspects of a topic: its pause, and committers of its readers
+type Topic struct {
+	Pause      *kafka.Pause
+	Committers []*kafka.Committer
+}
+
+// Server is the admin HTTP API of the pipeline:
+//
+// - GET /topics - topics, if they are paused, and offsets and lag of partitions;
+// - POST /topics/<topic>/pause, POST /topics/<topic>/resume - pause and resume reading of a topic;
+// - POST /flush - make writers flush their buffers right away;
+// - GET /workers - numbers of workers of stages, and their bounds;
+// - GET /log/level, PUT /log/level - get and change the log level, e.g. {"level": "debug"};
+// - /debug/pprof/ - profiles, e.g. /debug/pprof/goroutine?debug=2 dumps goroutines.
+type Server struct {
+	Brokers []string
+	Dialer  *kafkaGo.Dialer
+	Topics  map[string]Topic
+	Pools   []*workers.Pool
+	Flush   *elastic.FlushTrigger
+	Level   zap.AtomicLevel
+	Logger  *zap.Logger
+}
+
+// Handler returns the handler of the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topics", s.topics)
+	mux.HandleFunc("/topics/", s.pause)
+	mux.HandleFunc("/flush", s.flush)
+	mux.HandleFunc("/workers", s.workers)
+	mux.Handle("/log/level", s.Level)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// Serve serves the API on the address, until the context is cancelled.
+func (s *Server) Serve(ctx context.Context, address string) error {
+	server := &http.Server{Addr: address, Handler: s.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			s.Logger.Warn("failed to shutdown admin server", zap.Error(err))
+		}
+	}()
+
+	s.Logger.Info("serving admin API", zap.String("address", address))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+type topicState struct {
+	Paused     bool             `json:"paused"`
+	Partitions []partitionState `json:"partitions"`
+}
+
+// Lag is the number of messages of the partition not written yet: up to the end offset after the acknowledged one
+type partitionState struct {
+	kafka.PartitionOffsets
+	EndOffset int64  `json:"end_offset"`
+	Lag       int64  `json:"lag"`
+	Error     string `json:"error,omitempty"` // of the end offset lookup
+}
+
+func (s *Server) topics(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodGet) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), endOffsetsTimeout)
+	defer cancel()
+
+	topics := map[string]topicState{}
+	for name, topic := range s.Topics {
+		state := topicState{Paused: topic.Pause.Paused(), Partitions: []partitionState{}}
+		for _, committer := range topic.Committers {
+			for _, offsets := range committer.Offsets() {
+				partition := partitionState{PartitionOffsets: offsets}
+				end, err := kafka.EndOffset(ctx, s.Dialer, s.Brokers, name, offsets.Partition)
+				if err != nil {
+					partition.Error = err.Error()
+				} else {
+					partition.EndOffset, partition.Lag = end, end-offsets.Acknowledged-1
+				}
+				state.Partitions = append(state.Partitions, partition)
+			}
+		}
+		sort.Slice(state.Partitions, func(i, j int) bool { return state.Partitions[i].Partition < state.Partitions[j].Partition })
+		topics[name] = state
+	}
+	respond(w, http.StatusOK, topics)
+}
+
+// pause handles /topics/<topic>/pause and /topics/<topic>/resume
+func (s *Server) pause(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/topics/"), "/")
+	if len(path) != 2 || path[1] != "pause" && path[1] != "resume" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowed(w, r, http.MethodPost) {
+		return
+	}
+	name, action := path[0], path[1]
+	topic, ok := s.Topics[name]
+	if !ok {
+		respond(w, http.StatusNotFound, map[string]string{"error": "there is no topic " + name})
+		return
+	}
+
+	var changed bool
+	if action == "pause" {
+		changed = topic.Pause.Pause()
+	} else {
+		changed = topic.Pause.Resume()
+	}
+	if changed {
+		s.Logger.Info("reading of topic changed by admin API", zap.String("topic", name), zap.String("action", action))
+	}
+	respond(w, http.StatusOK, map[string]interface{}{"topic": name, "paused": topic.Pause.Paused()})
+}
+
+func (s *Server) flush(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodPost) {
+		return
+	}
+	s.Flush.Flush()
+	s.Logger.Info("writers flush triggered by admin API")
+	respond(w, http.StatusAccepted, map[string]string{"status": "flush triggered"})
+}
+
+type poolState struct {
+	Workers int `json:"workers"`
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+}
+
+func (s *Server) workers(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r, http.MethodGet) {
+		return
+	}
+	pools := map[string]poolState{}
+	for _, pool := range s.Pools {
+		min, max := pool.Bounds()
+		pools[pool.Name()] = poolState{Workers: pool.Size(), Min: min, Max: max}
+	}
+	respond(w, http.StatusOK, pools)
+}
+
+func allowed(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	respond(w, http.StatusMethodNotAllowed, map[string]string{"error": method + " only"})
+	return false
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(body)
+}
@@ -0,0 +1,92 @@
+package admin
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sync/errgroup"
+	"kafka-to-elastic-pipeline/pkg/readers/kafka"
+	"kafka-to-elastic-pipeline/pkg/workers"
+	"kafka-to-elastic-pipeline/pkg/writers/elastic"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func request(t *testing.T, handler http.Handler, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	var response map[string]interface{}
+	if strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: malformed response %s", method, path, recorder.Body.String())
+		}
+	}
+	return recorder.Code, response
+}
+
+func TestServer(t *testing.T) {
+	var group errgroup.Group
+	quit := make(chan struct{})
+	writers := workers.NewPool("writers", &group, 2, 4, func(stop <-chan struct{}) error {
+		select {
+		case <-stop:
+		case <-quit:
+		}
+		return nil
+	})
+	defer func() {
+		close(quit)
+		_ = group.Wait()
+	}()
+
+	tweets := Topic{Pause: kafka.NewPause()}
+	level := zap.NewAtomicLevel()
+	server := &Server{
+		Topics: map[string]Topic{"tweets": tweets},
+		Pools:  []*workers.Pool{writers},
+		Flush:  elastic.NewFlushTrigger(),
+		Level:  level,
+		Logger: zap.NewNop(),
+	}
+	handler := server.Handler()
+
+	status, response := request(t, handler, http.MethodPost, "/topics/tweets/pause", "")
+	if status != http.StatusOK || response["paused"] != true || !tweets.Pause.Paused() {
+		t.Fatalf("topic must be paused; got %d %v", status, response)
+	}
+	status, response = request(t, handler, http.MethodGet, "/topics", "")
+	if want := map[string]interface{}{"tweets": map[string]interface{}{"paused": true, "partitions": []interface{}{}}}; status != http.StatusOK || !reflect.DeepEqual(response, want) {
+		t.Fatalf("unexpected topics %d %v", status, response)
+	}
+	status, response = request(t, handler, http.MethodPost, "/topics/tweets/resume", "")
+	if status != http.StatusOK || response["paused"] != false || tweets.Pause.Paused() {
+		t.Fatalf("topic must be resumed; got %d %v", status, response)
+	}
+	if status, _ := request(t, handler, http.MethodPost, "/topics/users/pause", ""); status != http.StatusNotFound {
+		t.Fatalf("unknown topic must not be found; got %d", status)
+	}
+	if status, _ := request(t, handler, http.MethodGet, "/topics/tweets/pause", ""); status != http.StatusMethodNotAllowed {
+		t.Fatalf("pause must be posted; got %d", status)
+	}
+
+	if status, _ := request(t, handler, http.MethodPost, "/flush", ""); status != http.StatusAccepted {
+		t.Fatalf("flush must be accepted; got %d", status)
+	}
+
+	status, response = request(t, handler, http.MethodGet, "/workers", "")
+	if want := map[string]interface{}{"writers": map[string]interface{}{"workers": 2.0, "min": 2.0, "max": 4.0}}; status != http.StatusOK || !reflect.DeepEqual(response, want) {
+		t.Fatalf("unexpected workers %d %v", status, response)
+	}
+
+	if status, _ := request(t, handler, http.MethodPut, "/log/level", `{"level": "debug"}`); status != http.StatusOK || level.Level() != zapcore.DebugLevel {
+		t.Fatalf("log level must be changed; got %d, level %s", status, level.Level())
+	}
+
+	if status, _ := request(t, handler, http.MethodGet, "/debug/pprof/goroutine?debug=2", ""); status != http.StatusOK {
+		t.Fatalf("goroutines must be dumped; got %d", status)
+	}
+}
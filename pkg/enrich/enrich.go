@@ -0,0 +1,110 @@
+package enrich
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"kafka-to-elastic-pipeline/pkg/workers"
+)
+
+// Enricher adds data to records on their way from kafka to elastic.
+// An enricher is shared by all workers of its stage, so it must be safe for concurrent use.
+type Enricher interface {
+	// Enrich modifies the record in place. Error means that the record can't be enriched:
+	// it is logged, and the record goes on as is.
+	Enrich(ctx context.Context, record *types.Record) error
+}
+
+// Stage is an enricher run by a number of workers, between `Workers` and `MaxWorkers`; they are scaled at runtime
+type Stage struct {
+	Name       string // of the enricher
+	Route      string
+	Enricher   Enricher
+	Workers    int
+	MaxWorkers int
+
+	// Records of a kafka partition are enriched by one worker, so they stay in order of offsets; see
+	// workers.NewPartitionedPool
+	Partitioned bool
+}
+
+// FullName tells stages of different routes apart, e.g. in metrics: "tweets geoip"
+func (s Stage) FullName() string {
+	return s.Route + " " + s.Name
+}
+
+// Chain runs stages in the group one after another, records going from `in` through all of them to `out`.
+// It returns output channels of the stages, the last one being `out`, and worker pools of the stages.
+// Once `in` is closed, every stage drains its input and closes its output, so closing propagates to the end;
+// `out` is not closed though, as it is shared by chains of all routes: the caller closes it once pools of the last
+// stages are done.
+func Chain(ctx context.Context, group *errgroup.Group, stages []Stage, in, out chan *types.Record, bufferSize int, logger *zap.Logger) ([]chan *types.Record, []*workers.Pool) {
+	var outs []chan *types.Record
+	var pools []*workers.Pool
+	for i, stage := range stages {
+		stage := stage
+		stageIn := in
+		stageOut := out
+		if i < len(stages)-1 {
+			stageOut = make(chan *types.Record, bufferSize)
+		}
+
+		var pool *workers.Pool
+		if stage.Partitioned {
+			pool = workers.NewPartitionedPool(stage.FullName(), group, stage.Workers, stage.MaxWorkers, bufferSize, stageIn, func(lane chan *types.Record) error {
+				return Work(ctx, stage, lane, stageOut, nil, logger)
+			})
+		} else {
+			pool = workers.NewPool(stage.FullName(), group, stage.Workers, stage.MaxWorkers, func(quit <-chan struct{}) error {
+				return Work(ctx, stage, stageIn, stageOut, quit, logger)
+			})
+		}
+		if stageOut != out {
+			group.Go(func() error {
+				pool.Wait()
+				close(stageOut)
+				return nil
+			})
+		}
+
+		outs = append(outs, stageOut)
+		pools = append(pools, pool)
+		in = stageOut
+	}
+	return outs, pools
+}
+
+// Work enriches records from `in` and sends them to `out`, until `in` is closed, or `quit` is (then the worker is
+// not needed anymore, while others go on).
+func Work(ctx context.Context, stage Stage, in chan *types.Record, out chan *types.Record, quit <-chan struct{}, logger *zap.Logger) error {
+	enriched := metrics.EnrichedRecords.WithLabelValues(stage.FullName())
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-quit:
+			return nil
+
+		case record, ok := <-in:
+			if !ok {
+				return nil
+			}
+
+			if record.Tombstone() {
+				// nothing to enrich
+			} else if err := stage.Enricher.Enrich(ctx, record); err != nil {
+				logger.Warn("failed to enrich record", zap.String("enricher", stage.Name), zap.String("route", stage.Route), zap.Error(err))
+			}
+
+			select {
+			case out <- record:
+				enriched.Inc()
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
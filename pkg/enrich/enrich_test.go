@@ -0,0 +1,99 @@
+package enrich
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// trail appends its name to Trail of documents, and fails on documents of the key it is given
+type trail struct {
+	name string
+	fail string
+}
+
+func (e trail) Enrich(ctx context.Context, record *types.Record) error {
+	if record.Key == e.fail {
+		return errors.New("can't enrich")
+	}
+	record.Doc["Trail"] = append(record.Doc["Trail"].([]string), e.name)
+	return nil
+}
+
+func TestChain(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		enrichers   []trail
+		partitioned bool
+		want        map[string][]string // trails by keys; nil for tombstones
+	}{
+		{"one stage", []trail{{name: "geoip"}}, false,
+			map[string][]string{"a": {"geoip"}, "b": {"geoip"}, "tombstone": nil}},
+		{"stages in order", []trail{{name: "geoip"}, {name: "asn"}, {name: "sentiment"}}, false,
+			map[string][]string{"a": {"geoip", "asn", "sentiment"}, "b": {"geoip", "asn", "sentiment"}, "tombstone": nil}},
+		{"partitioned stages in order", []trail{{name: "geoip"}, {name: "asn"}}, true,
+			map[string][]string{"a": {"geoip", "asn"}, "b": {"geoip", "asn"}, "tombstone": nil}},
+		{"record failed to enrich goes on", []trail{{name: "geoip", fail: "b"}, {name: "asn"}}, false,
+			map[string][]string{"a": {"geoip", "asn"}, "b": {"asn"}, "tombstone": nil}},
+		{"record failed to enrich by the last stage goes on", []trail{{name: "geoip"}, {name: "asn", fail: "a"}}, true,
+			map[string][]string{"a": {"geoip"}, "b": {"geoip", "asn"}, "tombstone": nil}},
+	} {
+		var stages []Stage
+		for _, enricher := range test.enrichers {
+			stages = append(stages, Stage{Name: enricher.name, Route: "tweets", Enricher: enricher, Workers: 2, MaxWorkers: 4, Partitioned: test.partitioned})
+		}
+
+		in, out := make(chan *types.Record, 3), make(chan *types.Record, 3)
+		for i, key := range []string{"a", "b", "tombstone"} {
+			record := &types.Record{Route: "tweets", Key: key, Offset: types.Offset{Topic: "tweets", Partition: i}}
+			if key != "tombstone" {
+				record.Doc = map[string]interface{}{"Trail": []string{}}
+			}
+			in <- record
+		}
+		close(in)
+
+		var group errgroup.Group
+		outs, pools := Chain(context.Background(), &group, stages, in, out, 1, zap.NewNop())
+		if len(outs) != len(stages) || len(pools) != len(stages) || outs[len(outs)-1] != out {
+			t.Fatalf("%s: chain must have an output and a pool per stage, the last output being out; got %d and %d", test.name, len(outs), len(pools))
+		}
+
+		// closing of the input goes down the chain: every stage closes its output, except the last one
+		done := make(chan error, 1)
+		go func() {
+			done <- group.Wait()
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("%s: chain failed: %s", test.name, err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("%s: chain must stop once its input is closed", test.name)
+		}
+		for _, stageOut := range outs[:len(outs)-1] {
+			if _, ok := <-stageOut; ok {
+				t.Fatalf("%s: outputs of stages but the last one must be closed", test.name)
+			}
+		}
+
+		got := map[string][]string{}
+		for len(out) > 0 {
+			record := <-out
+			if record.Tombstone() {
+				got[record.Key] = nil
+			} else {
+				got[record.Key] = record.Doc["Trail"].([]string)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: unexpected records; got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package geoip
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cache keeps results of the most recently used lookups; it is safe for concurrent use
+type cache struct {
+	size int
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key    string
+	result lookupResult
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: make(map[string]*list.Element, size), order: list.New()}
+}
+
+func (c *cache) get(key string) (lookupResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return lookupResult{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).result, true
+}
+
+// put adds the result, evicting the least recently used one if the cache is full
+func (c *cache) put(key string, result lookupResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry).result = result
+		c.order.MoveToFront(element)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, result: result})
+}
@@ -0,0 +1,31 @@
+package geoip
+
+import (
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	c := newCache(2)
+	c.put("a", lookupResult{found: true})
+	c.put("b", lookupResult{found: true})
+
+	// "a" becomes the most recently used, so "b" is evicted
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a must be cached")
+	}
+	c.put("c", lookupResult{found: true})
+	if _, ok := c.get("b"); ok {
+		t.Fatal("b must be evicted")
+	}
+
+	c.put("a", lookupResult{versions: [2]uint64{1, 0}})
+	if result, ok := c.get("a"); !ok || result.found || result.versions[0] != 1 {
+		t.Fatalf("a must be updated; got %+v", result)
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatal("c must be cached")
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Fatalf("cache must keep 2 entries; got %d, %d", len(c.entries), c.order.Len())
+	}
+}
@@ -0,0 +1,201 @@
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Database is a MaxMind database that can be replaced while in use.
+//
+// The path is either a database file, or a directory with databases, e.g. with dated ones like
+// `GeoLite2-City_20190312/GeoLite2-City.mmdb`, in which case the database of the expected type with the latest
+// build epoch is used. When files change, the new database is opened and verified, lookups are switched to it,
+// and the old one is closed once lookups in progress are finished.
+type Database struct {
+	path   string
+	dbType string // part of database type from metadata, e.g. City or ASN
+	logger *zap.Logger
+
+	reloading sync.Mutex
+	state     string // files the reader was chosen from, to tell when they change
+
+	mutex   sync.RWMutex // read-locked for lookups, so the reader isn't closed under them
+	reader  *maxminddb.Reader
+	version uint64 // incremented on every reload, so results of older lookups can be told apart
+}
+
+// OpenDatabase opens the database of dbType found at the path
+func OpenDatabase(path, dbType string, logger *zap.Logger) (*Database, error) {
+	d := &Database{path: path, dbType: dbType, logger: logger}
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Lookup decodes the record of the IP address into result and tells if the address is in the database
+func (d *Database) Lookup(ip net.IP, result interface{}) (bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	offset, err := d.reader.LookupOffset(ip)
+	if err != nil || offset == maxminddb.NotFound {
+		return false, err
+	}
+	return true, d.reader.Decode(offset, result)
+}
+
+// Version identifies the database in use; it changes when the database is reloaded
+func (d *Database) Version() uint64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.version
+}
+
+// Watch reloads the database when its files change, checking them every interval, until the context is cancelled.
+// Databases that fail to open or verify are logged and skipped, and the current one stays in use.
+func (d *Database) Watch(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			if err := d.Reload(); err != nil {
+				d.logger.Warn("failed to reload geoip database", zap.String("path", d.path), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Reload switches to the newest database at the path, if files there have changed since the last reload
+func (d *Database) Reload() error {
+	d.reloading.Lock()
+	defer d.reloading.Unlock()
+
+	files, err := candidates(d.path)
+	if err != nil {
+		return err
+	}
+	state, err := filesState(files)
+	if err != nil {
+		return err
+	}
+	if state == d.state {
+		return nil
+	}
+
+	reader, file, err := d.newest(files)
+	if err != nil {
+		return err
+	}
+	if err := reader.Verify(); err != nil {
+		_ = reader.Close()
+		return errors.Wrapf(err, "geoip database %s is corrupted", file)
+	}
+
+	d.mutex.Lock()
+	old := d.reader
+	d.reader = reader
+	d.version++
+	d.mutex.Unlock()
+	d.state = state
+
+	if old != nil {
+		if err := old.Close(); err != nil {
+			d.logger.Warn("failed to close geoip database", zap.Error(err))
+		}
+	}
+
+	buildTime := time.Unix(int64(reader.Metadata.BuildEpoch), 0)
+	metrics.GeoIPBuildEpoch.WithLabelValues(strings.ToLower(d.dbType)).Set(float64(reader.Metadata.BuildEpoch))
+	d.logger.Info("geoip database loaded", zap.String("file", file), zap.String("type", reader.Metadata.DatabaseType), zap.Time("build", buildTime))
+	return nil
+}
+
+// newest opens the database of the expected type with the latest build epoch out of the files
+func (d *Database) newest(files []string) (*maxminddb.Reader, string, error) {
+	var newest *maxminddb.Reader
+	var newestFile string
+	var problems []string
+	for _, file := range files {
+		reader, err := maxminddb.Open(file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", file, err))
+			continue
+		}
+		if !strings.Contains(reader.Metadata.DatabaseType, d.dbType) {
+			problems = append(problems, fmt.Sprintf("%s: type is %s", file, reader.Metadata.DatabaseType))
+			_ = reader.Close()
+			continue
+		}
+		if newest != nil && newest.Metadata.BuildEpoch >= reader.Metadata.BuildEpoch {
+			_ = reader.Close()
+			continue
+		}
+		if newest != nil {
+			_ = newest.Close()
+		}
+		newest, newestFile = reader, file
+	}
+
+	if newest == nil {
+		return nil, "", errors.Errorf("no geoip %s database at %s: %s", d.dbType, d.path, strings.Join(problems, "; "))
+	}
+	return newest, newestFile, nil
+}
+
+// Close closes the database in use
+func (d *Database) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.reader.Close()
+}
+
+// candidates lists database files at the path: the file itself, or *.mmdb files in the directory and its
+// subdirectories
+func candidates(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find geoip database")
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.mmdb"))
+	if err != nil {
+		return nil, err
+	}
+	nested, err := filepath.Glob(filepath.Join(path, "*", "*.mmdb"))
+	if err != nil {
+		return nil, err
+	}
+	return append(files, nested...), nil
+}
+
+// filesState describes names, sizes and modification times of the files
+func filesState(files []string) (string, error) {
+	var state strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to stat geoip database")
+		}
+		fmt.Fprintf(&state, "%s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return state.String(), nil
+}
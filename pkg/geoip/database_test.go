@@ -0,0 +1,97 @@
+package geoip
+
+import (
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCandidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		filepath.Join(dir, "GeoLite2-City.mmdb"),
+		filepath.Join(dir, "GeoLite2-City_20190312", "GeoLite2-City.mmdb"),
+		filepath.Join(dir, "GeoLite2-City_20190319", "GeoLite2-City.mmdb"),
+	}
+	for _, file := range append(files, filepath.Join(dir, "GeoLite2-City_20190319", "COPYRIGHT.txt")) {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := candidates(dir)
+	if err != nil {
+		t.Fatalf("failed to list candidates: %s", err)
+	}
+	if !reflect.DeepEqual(got, files) {
+		t.Fatalf("unexpected candidates; got %s, want %s", got, files)
+	}
+
+	got, err = candidates(files[1])
+	if err != nil {
+		t.Fatalf("failed to list candidates: %s", err)
+	}
+	if !reflect.DeepEqual(got, files[1:2]) {
+		t.Fatalf("file must be the only candidate; got %s", got)
+	}
+
+	if _, err := candidates(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected error for missing path")
+	}
+}
+
+func TestDatabaseReload(t *testing.T) {
+	data, err := ioutil.ReadFile(testConfig(t).GeoIP.DBFile)
+	if err != nil {
+		t.Fatalf("Failed to read GeoIP database: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "GeoLite2-City.mmdb"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDatabase(dir, "City", zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP database: %s", err)
+	}
+	defer db.Close()
+
+	// A broken database must not replace the working one
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.mmdb"), []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, "GeoLite2-City.mmdb"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Fatalf("Failed to reload GeoIP database: %s", err)
+	}
+
+	var geoAddr geoAddress
+	found, err := db.Lookup(net.ParseIP("213.113.90.242"), &geoAddr)
+	if err != nil || !found {
+		t.Fatalf("Failed to look up after reload: found %t, error %v", found, err)
+	}
+	if geoAddr.Country.IsoCode != "SE" {
+		t.Fatalf("unexpected country %s", geoAddr.Country.IsoCode)
+	}
+}
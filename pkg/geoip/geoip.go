@@ -2,48 +2,185 @@ package geoip
 
 import (
 	"context"
-	"github.com/oschwald/maxminddb-golang"
-	"go.uber.org/zap"
+	"github.com/pkg/errors"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
 	"kafka-to-elastic-pipeline/pkg/types"
 	"net"
 )
 
-// We don't want the whole geo data, but just city and country names
+type names map[string]string
+
+// Part of GeoIP2/GeoLite2 city record we can add to documents
 type geoAddress struct {
 	City struct {
-		Names map[string]string `maxminddb:"names"`
+		Names names `maxminddb:"names"`
 	} `maxminddb:"city"`
+	Continent struct {
+		Code  string `maxminddb:"code"`
+		Names names  `maxminddb:"names"`
+	} `maxminddb:"continent"`
 	Country struct {
-		Names map[string]string `maxminddb:"names"`
+		IsoCode string `maxminddb:"iso_code"`
+		Names   names  `maxminddb:"names"`
 	} `maxminddb:"country"`
+	Location struct {
+		AccuracyRadius uint16   `maxminddb:"accuracy_radius"`
+		Latitude       *float64 `maxminddb:"latitude"`
+		Longitude      *float64 `maxminddb:"longitude"`
+		TimeZone       string   `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+		Names   names  `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
 }
 
-func Fetcher(ctx context.Context, reader *maxminddb.Reader, tweetChannel chan types.Tweet, enrichedTweetChannel chan types.EnrichedTweet, logger *zap.Logger) error {
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
+// GeoLite2-ASN record
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
 
-		case inTweet := <-tweetChannel:
-			enrichedTweet := types.EnrichedTweet{
-				Message:       inTweet.Message,
-				User:          inTweet.User,
-				Tags:          inTweet.Tags,
-				RemoteAddress: inTweet.RemoteAddress,
-			}
+// Result of looking up an address in city and ASN databases, with versions of the databases
+type lookupResult struct {
+	geoAddr  geoAddress
+	asn      asnRecord
+	found    bool
+	versions [2]uint64
+}
 
-			ip := net.ParseIP(inTweet.RemoteAddress)
+// Enricher adds geo data to records, looked up by IP address in the record field configured by `AddressField`.
+// Added fields are selected by `Fields`; names are either maps of all languages or, with `Language` set,
+// names in that language. With `CacheSize` set, results of lookups are cached until databases are reloaded.
+type Enricher struct {
+	db           *Database
+	asnDB        *Database // nil unless asn field is selected
+	addressField string
+	language     string
+	fields       map[string]bool
+	cache        *cache // nil if disabled
+}
 
-			var geoAddr geoAddress
-			err := reader.Lookup(ip, &geoAddr)
-			if err != nil {
-				logger.Warn("failed to get geoip data", zap.Error(err))
-			}
+func NewEnricher(db, asnDB *Database, cfg config.GeoIP) *Enricher {
+	fields := map[string]bool{}
+	for _, field := range cfg.Fields {
+		fields[field] = true
+	}
+	e := &Enricher{db: db, asnDB: asnDB, addressField: cfg.AddressField, language: cfg.Language, fields: fields}
+	if cfg.CacheSize > 0 {
+		e.cache = newCache(cfg.CacheSize)
+	}
+	return e
+}
+
+func (e *Enricher) Enrich(ctx context.Context, record *types.Record) error {
+	address, _ := record.Doc[e.addressField].(string)
+	ip := net.ParseIP(address)
+	if ip == nil {
+		metrics.GeoIPLookups.WithLabelValues("error").Inc()
+		return errors.Errorf("failed to get geoip data: invalid IP address %q", address)
+	}
 
-			enrichedTweet.City = geoAddr.City.Names
-			enrichedTweet.Country = geoAddr.Country.Names
+	result, err := e.lookup(ip)
+	if err != nil {
+		metrics.GeoIPLookups.WithLabelValues("error").Inc()
+		return err
+	}
+	geoAddr, asn := result.geoAddr, result.asn
+	if result.found {
+		metrics.GeoIPLookups.WithLabelValues("hit").Inc()
+	} else {
+		metrics.GeoIPLookups.WithLabelValues("miss").Inc()
+	}
 
-			enrichedTweetChannel <- enrichedTweet
+	doc := record.Doc
+	if e.fields[config.GeoIPFieldCity] {
+		doc["City"] = e.localize(geoAddr.City.Names)
+	}
+	if e.fields[config.GeoIPFieldCountry] {
+		doc["Country"] = e.localize(geoAddr.Country.Names)
+		doc["CountryIsoCode"] = geoAddr.Country.IsoCode
+	}
+	if e.fields[config.GeoIPFieldContinent] {
+		doc["Continent"] = e.localize(geoAddr.Continent.Names)
+		doc["ContinentCode"] = geoAddr.Continent.Code
+	}
+	if e.fields[config.GeoIPFieldSubdivisions] {
+		subdivisions := make([]interface{}, 0, len(geoAddr.Subdivisions))
+		isoCodes := make([]string, 0, len(geoAddr.Subdivisions))
+		for _, subdivision := range geoAddr.Subdivisions {
+			subdivisions = append(subdivisions, e.localize(subdivision.Names))
+			isoCodes = append(isoCodes, subdivision.IsoCode)
 		}
+		doc["Subdivisions"] = subdivisions
+		doc["SubdivisionsIsoCodes"] = isoCodes
+	}
+	if e.fields[config.GeoIPFieldPostalCode] {
+		doc["PostalCode"] = geoAddr.Postal.Code
+	}
+	if e.fields[config.GeoIPFieldLocation] {
+		// Object with lat and lon is one of the formats of elasticsearch geo_point
+		if geoAddr.Location.Latitude != nil && geoAddr.Location.Longitude != nil {
+			doc["Location"] = map[string]float64{"lat": *geoAddr.Location.Latitude, "lon": *geoAddr.Location.Longitude}
+		} else {
+			doc["Location"] = nil
+		}
+		doc["AccuracyRadius"] = geoAddr.Location.AccuracyRadius
+	}
+	if e.fields[config.GeoIPFieldTimeZone] {
+		doc["TimeZone"] = geoAddr.Location.TimeZone
+	}
+	if e.fields[config.GeoIPFieldASN] {
+		doc["ASNumber"] = asn.Number
+		doc["ASOrganization"] = asn.Organization
+	}
+	return nil
+}
+
+// lookup looks the address up in the cache, or, if it is not there or databases were reloaded since, in databases
+func (e *Enricher) lookup(ip net.IP) (lookupResult, error) {
+	result := lookupResult{versions: [2]uint64{e.db.Version()}}
+	if e.asnDB != nil {
+		result.versions[1] = e.asnDB.Version()
+	}
+
+	key := string(ip.To16())
+	if e.cache != nil {
+		if cached, ok := e.cache.get(key); ok && cached.versions == result.versions {
+			metrics.GeoIPCache.WithLabelValues("hit").Inc()
+			return cached, nil
+		}
+		metrics.GeoIPCache.WithLabelValues("miss").Inc()
+	}
+
+	var err error
+	if result.found, err = e.db.Lookup(ip, &result.geoAddr); err != nil {
+		return result, errors.Wrap(err, "failed to get geoip data")
+	}
+	if e.fields[config.GeoIPFieldASN] {
+		if _, err := e.asnDB.Lookup(ip, &result.asn); err != nil {
+			return result, errors.Wrap(err, "failed to get asn data")
+		}
+	}
+
+	if e.cache != nil {
+		e.cache.put(key, result)
+	}
+	return result, nil
+}
+
+// localize returns the name in the configured language, falling back to English, or all the names if no language
+// is configured
+func (e *Enricher) localize(all names) interface{} {
+	if e.language == "" {
+		return map[string]string(all)
+	}
+	if name, ok := all[e.language]; ok {
+		return name
 	}
+	return all["en"]
 }
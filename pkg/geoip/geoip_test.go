@@ -3,107 +3,138 @@ package geoip
 import (
 	"context"
 	"fmt"
-	"github.com/oschwald/maxminddb-golang"
 	"go.uber.org/zap"
 	"kafka-to-elastic-pipeline/config"
 	"kafka-to-elastic-pipeline/pkg/types"
 	"math/rand"
+	"os"
 	"reflect"
 	"testing"
-	"time"
 )
 
-func TestFetcher(t *testing.T) {
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
-	defer cancel()
+// Default GeoIP database, relative to the package directory tests run in
+const testDBFile = "../../assets/GeoLite2-City_20190312/GeoLite2-City.mmdb"
+
+// testConfig returns the default configuration with the test database, without environment variables of the
+// pipeline; tests are skipped if the database is not in assets
+func testConfig(tb testing.TB) *config.Config {
+	if _, err := os.Stat(testDBFile); err != nil {
+		tb.Skipf("GeoIP database is not available: %s", err)
+	}
+	cfg := config.Default()
+	cfg.GeoIP.DBFile = testDBFile
+	return cfg
+}
 
-	geoIPReader, err := maxminddb.Open(config.GeoIPDBFile)
+func TestEnricher(t *testing.T) {
+	cfg := testConfig(t)
+
+	db, err := OpenDatabase(cfg.GeoIP.DBFile, "City", zap.NewNop())
 	if err != nil {
 		t.Fatalf("Failed to open GeoIP reader: %s", err)
 	}
-	defer geoIPReader.Close()
+	defer db.Close()
 
-	tweetCh := make(chan types.Tweet)
-	enrichedTweetCh := make(chan types.EnrichedTweet)
+	enricher := NewEnricher(db, nil, cfg.GeoIP)
 
-	logger, err := zap.NewDevelopment()
-	if err != nil {
-		t.Fatalf("Failed to initilaize logger: %s", err)
-	}
-
-	go Fetcher(ctx, geoIPReader, tweetCh, enrichedTweetCh, logger)
-
-	fetcherIsAlive := false
-	select {
-	case tweetCh <- types.Tweet{RemoteAddress: "213.113.90.242"}:
-		fetcherIsAlive = true
-	case enrichedTweetCh := <-enrichedTweetCh:
-		want := map[string]string{
-			"de":    "Stockholm",
-			"en":    "Stockholm",
-			"es":    "Estocolmo",
-			"fr":    "Stockholm",
-			"ja":    "ストックホルム",
-			"pt-BR": "Estocolmo",
-			"ru":    "Стокгольм",
-			"zh-CN": "斯德哥尔摩",
-		}
-		if !reflect.DeepEqual(enrichedTweetCh.City, want) {
-			t.Fatalf("uneexpected result; got %s, want %s", enrichedTweetCh.City, want)
-		}
-
-		want = map[string]string{
-			"de":    "Schweden",
-			"en":    "Sweden",
-			"es":    "Suecia",
-			"fr":    "Suède",
-			"ja":    "スウェーデン王国",
-			"pt-BR": "Suécia",
-			"ru":    "Швеция",
-			"zh-CN": "瑞典",
-		}
-		if !reflect.DeepEqual(enrichedTweetCh.Country, want) {
-			t.Fatalf("uneexpected result; got %s, want %s", enrichedTweetCh.Country, want)
-		}
-	case <-ctx.Done():
-		if fetcherIsAlive {
-			t.Fatal("geoip fetcher didn't return")
-		} else {
-			t.Fatal("geoip fetcher didn't read from source channel")
-		}
+	record := &types.Record{Doc: map[string]interface{}{"RemoteAddress": "213.113.90.242"}}
+	if err := enricher.Enrich(context.Background(), record); err != nil {
+		t.Fatalf("Failed to enrich record: %s", err)
+	}
+
+	want := map[string]string{
+		"de":    "Stockholm",
+		"en":    "Stockholm",
+		"es":    "Estocolmo",
+		"fr":    "Stockholm",
+		"ja":    "ストックホルム",
+		"pt-BR": "Estocolmo",
+		"ru":    "Стокгольм",
+		"zh-CN": "斯德哥尔摩",
+	}
+	if !reflect.DeepEqual(record.Doc["City"], want) {
+		t.Fatalf("uneexpected result; got %s, want %s", record.Doc["City"], want)
+	}
+
+	want = map[string]string{
+		"de":    "Schweden",
+		"en":    "Sweden",
+		"es":    "Suecia",
+		"fr":    "Suède",
+		"ja":    "スウェーデン王国",
+		"pt-BR": "Suécia",
+		"ru":    "Швеция",
+		"zh-CN": "瑞典",
+	}
+	if !reflect.DeepEqual(record.Doc["Country"], want) {
+		t.Fatalf("uneexpected result; got %s, want %s", record.Doc["Country"], want)
+	}
+	if record.Doc["CountryIsoCode"] != "SE" {
+		t.Fatalf("unexpected country iso code %v", record.Doc["CountryIsoCode"])
+	}
+	if location, ok := record.Doc["Location"].(map[string]float64); !ok || location["lat"] == 0 || location["lon"] == 0 {
+		t.Fatalf("unexpected location %v", record.Doc["Location"])
 	}
 }
 
-func BenchmarkFetcher(b *testing.B) {
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
-	defer cancel()
+func TestEnricherLanguage(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.GeoIP.Language = "de"
+	cfg.GeoIP.Fields = []string{config.GeoIPFieldCity, config.GeoIPFieldCountry, config.GeoIPFieldContinent, config.GeoIPFieldTimeZone}
 
-	geoIPReader, err := maxminddb.Open(config.GeoIPDBFile)
+	db, err := OpenDatabase(cfg.GeoIP.DBFile, "City", zap.NewNop())
 	if err != nil {
-		b.Fatalf("Failed to open GeoIP reader: %s", err)
+		t.Fatalf("Failed to open GeoIP reader: %s", err)
 	}
-	defer geoIPReader.Close()
+	defer db.Close()
 
-	tweetCh := make(chan types.Tweet)
-	enrichedTweetCh := make(chan types.EnrichedTweet)
+	record := &types.Record{Doc: map[string]interface{}{"RemoteAddress": "213.113.90.242"}}
+	if err := NewEnricher(db, nil, cfg.GeoIP).Enrich(context.Background(), record); err != nil {
+		t.Fatalf("Failed to enrich record: %s", err)
+	}
 
-	logger, err := zap.NewDevelopment()
+	want := map[string]interface{}{
+		"RemoteAddress":  "213.113.90.242",
+		"City":           "Stockholm",
+		"Country":        "Schweden",
+		"CountryIsoCode": "SE",
+		"Continent":      "Europa",
+		"ContinentCode":  "EU",
+		"TimeZone":       "Europe/Stockholm",
+	}
+	if !reflect.DeepEqual(record.Doc, want) {
+		t.Fatalf("unexpected result; got %v, want %v", record.Doc, want)
+	}
+}
+
+// Real traffic repeats addresses, so they are taken from a pool; compare results with and without the cache.
+func BenchmarkEnricher(b *testing.B) {
+	cfg := testConfig(b)
+
+	db, err := OpenDatabase(cfg.GeoIP.DBFile, "City", zap.NewNop())
 	if err != nil {
-		b.Fatalf("Failed to initilaize logger: %s", err)
+		b.Fatalf("Failed to open GeoIP reader: %s", err)
 	}
+	defer db.Close()
+
+	addresses := make([]string, 1000)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("%d.%d.%d.%d", rand.Intn(255), rand.Intn(255), rand.Intn(255), rand.Intn(255))
+	}
+	ctx := context.Background()
 
-	go Fetcher(ctx, geoIPReader, tweetCh, enrichedTweetCh, logger)
+	for _, cacheSize := range []int{0, len(addresses)} {
+		geoIPCfg := cfg.GeoIP
+		geoIPCfg.CacheSize = cacheSize
+		enricher := NewEnricher(db, nil, geoIPCfg)
 
-	for i := 0; i < b.N; i++ {
-		tweetCh <- types.Tweet{
-			RemoteAddress: fmt.Sprintf("%d.%d.%d.%d", rand.Intn(255), rand.Intn(255), rand.Intn(255), rand.Intn(255)),
-		}
-		select {
-		case <-enrichedTweetCh:
-		case <-ctx.Done():
-			b.Fatal("timed out")
-		}
+		b.Run(fmt.Sprintf("cache-%d", cacheSize), func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					record := &types.Record{Doc: map[string]interface{}{"RemoteAddress": addresses[i%len(addresses)]}}
+					_ = enricher.Enrich(ctx, record)
+				}
+			})
+		})
 	}
 }
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const namespace = "pipeline"
+
+// Registry holds metrics of all the bricks. It is a registry of its own (not the default one),
+// so that only metrics of the pipeline and of the process are exposed.
+var Registry = prometheus.NewRegistry()
+
+var (
+	ChannelLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "channel_length",
+		Help:      "Number of objects waiting in a channel between bricks.",
+	}, []string{"channel"})
+
+	ChannelCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "channel_capacity",
+		Help:      "Capacity of a channel between bricks.",
+	}, []string{"channel"})
+
+	MessagesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_messages_read_total",
+		Help:      "Number of messages read from kafka.",
+	}, []string{"topic", "partition"})
+
+	PoisonMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_poison_messages_total",
+		Help:      "Number of kafka messages that failed to decode.",
+	}, []string{"topic"})
+
+	ConsumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_consumer_lag",
+		Help:      "Number of messages the reader is behind the end of partition it fetched last.",
+	}, []string{"topic", "reader"})
+
+	EnrichedRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "enriched_records_total",
+		Help:      "Number of records that went through enrichment stages, by stage (topic and enricher).",
+	}, []string{"stage"})
+
+	Workers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers",
+		Help:      "Number of workers of pipeline stages, that are scaled at runtime.",
+	}, []string{"stage"})
+
+	GeoIPLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "geoip_lookups_total",
+		Help:      "Number of geoip lookups by result: hit, miss (no data for the address) or error.",
+	}, []string{"result"})
+	GeoIPCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "geoip_cache_requests_total",
+		Help:      "Number of geoip cache requests by result: hit or miss.",
+	}, []string{"result"})
+	GeoIPBuildEpoch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "geoip_build_epoch_seconds",
+		Help:      "Build time of the geoip database in use, as reported by its metadata.",
+	}, []string{"database"})
+
+	Documents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "elastic_documents_total",
+		Help:      "Number of documents sent to elastic by result: succeeded, retried, spilled or failed.",
+	}, []string{"index", "result"})
+
+	BulkDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "elastic_bulk_duration_seconds",
+		Help:      "Latency of elastic bulk requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14), // 5ms .. 40s
+	})
+
+	BulkSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "elastic_bulk_size_bytes",
+		Help:      "Size of elastic bulk request bodies.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10), // 1KiB .. 256MiB
+	})
+
+	BulksInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "elastic_bulks_in_flight",
+		Help:      "Number of elastic bulk requests in flight, including ones waiting for earlier requests of the same partitions.",
+	})
+
+	BreakerOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "elastic_breaker_open",
+		Help:      "1 while elastic is unavailable and the circuit breaker holds writing and reading back, 0 otherwise.",
+	})
+
+	SpilledBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "elastic_spilled_bytes",
+		Help:      "Size of objects spilled to disk and waiting to be written to elastic.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		ChannelLength,
+		ChannelCapacity,
+		MessagesRead,
+		PoisonMessages,
+		ConsumerLag,
+		EnrichedRecords,
+		Workers,
+		GeoIPLookups,
+		GeoIPCache,
+		GeoIPBuildEpoch,
+		Documents,
+		BulkDuration,
+		BulkSize,
+		BulksInFlight,
+		BreakerOpen,
+		SpilledBytes,
+	)
+}
+
+// Total returns sum of all counters of the collector, e.g. of a counter vector with all its label values
+func Total(collector prometheus.Collector) float64 {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(metrics)
+		close(metrics)
+	}()
+
+	total := 0.0
+	for metric := range metrics {
+		var m dto.Metric
+		if err := metric.Write(&m); err == nil && m.Counter != nil {
+			total += m.Counter.GetValue()
+		}
+	}
+	return total
+}
+
+// Serve exposes metrics at `/metrics` on the address, until the context is cancelled.
+func Serve(ctx context.Context, address string, logger *zap.Logger) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: address, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to shutdown metrics server", zap.Error(err))
+		}
+	}()
+
+	logger.Info("serving metrics", zap.String("address", address))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
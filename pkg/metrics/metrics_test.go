@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	MessagesRead.WithLabelValues("tweets", "3").Add(2)
+	Documents.WithLabelValues("tweets", "succeeded").Inc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, address, zap.NewNop())
+	}()
+
+	var body string
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+		res, err := http.Get("http://" + address + "/metrics")
+		if err == nil {
+			data, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			body = string(data)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics are not served: %s", err)
+		}
+	}
+	for _, want := range []string{
+		`pipeline_kafka_messages_read_total{partition="3",topic="tweets"} 2`,
+		`pipeline_elastic_documents_total{index="tweets",result="succeeded"} 1`,
+		"pipeline_elastic_breaker_open 0",
+		"pipeline_elastic_bulk_duration_seconds_bucket",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics don't have %s:\n%s", want, body)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("metrics server failed: %s", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("metrics server must stop with the context")
+	}
+}
+
+func TestTotal(t *testing.T) {
+	PoisonMessages.WithLabelValues("users").Add(3)
+	PoisonMessages.WithLabelValues("orders").Add(4)
+	if total := Total(PoisonMessages); total < 7 {
+		t.Fatalf("total must sum counters of all labels; got %f", total)
+	}
+}
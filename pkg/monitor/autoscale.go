@@ -0,0 +1,114 @@
+package monitor
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"kafka-to-elastic-pipeline/pkg/workers"
+	"time"
+)
+
+// Scaled is a pool of workers scaled by fillness of its channels and by its throughput
+type Scaled struct {
+	Pool       *workers.Pool
+	In         chan *types.Record
+	Out        chan *types.Record // nil for writers
+	Throughput func() float64     // number of records handled so far
+}
+
+// Scaling is additive increase, multiplicative decrease: a worker is added while the input channel of a pool is
+// filling up, and the pool is halved (towards its min) once that doesn't help
+const (
+	minGain = 1.05 // throughput has to grow at least by 5% for an added worker to be worth it
+	samples = 10   // fillness is averaged over that many samples per interval
+)
+
+// Autoscale changes numbers of workers of the pools every `cfg.Interval`, until the context is cancelled:
+//
+// - while the input channel of a pool is filled above `cfg.HighFillness` percent, a worker is added, unless the output
+// channel is filled as well (then workers wait for the next stage, and more of them won't help);
+//
+// - if throughput hasn't grown since a worker was added (e.g. elastic itself is the bottleneck), the pool is halved;
+//
+// - while the input channel is filled below `cfg.LowFillness` percent, the pool is halved.
+//
+// Every change is logged.
+func Autoscale(ctx context.Context, cfg config.Autoscale, pools []Scaled, logger *zap.Logger) error {
+	states := make([]scaleState, len(pools))
+	for i, pool := range pools {
+		states[i].throughput = pool.Throughput()
+	}
+
+	ticker := time.NewTicker(cfg.Interval / samples)
+	defer ticker.Stop()
+	last := time.Now()
+	for tick := 1; ; tick++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for i, pool := range pools {
+			states[i].in += fillness(pool.In)
+			states[i].out += fillness(pool.Out)
+		}
+		if tick%samples != 0 {
+			continue
+		}
+
+		elapsed := time.Since(last).Seconds()
+		last = time.Now()
+		for i, pool := range pools {
+			state := &states[i]
+			throughput := pool.Throughput()
+			rate := (throughput - state.throughput) / elapsed
+			in, out := state.in/samples, state.out/samples
+
+			size := pool.Pool.Size()
+			min, _ := pool.Pool.Bounds()
+			wanted, reason := decide(cfg, size, min, in, out, rate, state.rate, state.grown)
+			if wanted != size {
+				wanted = pool.Pool.Resize(wanted)
+			}
+			if wanted != size {
+				logger.Info("scaling workers", zap.String("stage", pool.Pool.Name()), zap.Int("from", size), zap.Int("to", wanted),
+					zap.String("reason", reason), zap.Float64("in fillness %", in), zap.Float64("out fillness %", out),
+					zap.Float64("throughput per second", rate))
+			}
+
+			*state = scaleState{throughput: throughput, rate: rate, grown: wanted > size}
+		}
+	}
+}
+
+type scaleState struct {
+	in, out    float64 // sums of fillness samples
+	throughput float64 // at the last decision
+	rate       float64 // throughput per second before the last decision
+	grown      bool    // if a worker was added by the last decision
+}
+
+// decide returns the number of workers the pool should have, and why
+func decide(cfg config.Autoscale, size, min int, in, out, rate, previousRate float64, grown bool) (int, string) {
+	high, low := float64(cfg.HighFillness), float64(cfg.LowFillness)
+	halved := size - (size-min+1)/2
+	switch {
+	case in >= high && grown && rate < previousRate*minGain:
+		return halved, "throughput hasn't grown with the added worker"
+	case in >= high && out < high:
+		return size + 1, "input channel is filling up"
+	case in <= low && size > min:
+		return halved, "input channel is mostly empty"
+	}
+	return size, ""
+}
+
+// fillness of the channel in percent; nil channels are empty
+func fillness(channel chan *types.Record) float64 {
+	if cap(channel) == 0 {
+		return 0
+	}
+	return 100 * float64(len(channel)) / float64(cap(channel))
+}
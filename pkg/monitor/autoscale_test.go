@@ -0,0 +1,32 @@
+package monitor
+
+import (
+	"kafka-to-elastic-pipeline/config"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	cfg := config.Default().Autoscale
+
+	for _, test := range []struct {
+		name               string
+		size, min          int
+		in, out            float64
+		rate, previousRate float64
+		grown              bool
+		want               int
+	}{
+		{"input filling up", 2, 1, 90, 10, 100, 100, false, 3},
+		{"input and output filling up", 2, 1, 90, 90, 100, 100, false, 2},
+		{"added worker helped", 3, 1, 90, 10, 150, 100, true, 4},
+		{"added worker didn't help", 5, 1, 90, 10, 101, 100, true, 3},
+		{"input mostly empty", 5, 1, 5, 0, 100, 100, false, 3},
+		{"input mostly empty, at min", 2, 2, 5, 0, 100, 100, false, 2},
+		{"halved down to min", 3, 2, 5, 0, 100, 100, false, 2},
+		{"input half full", 2, 1, 50, 10, 100, 100, true, 2},
+	} {
+		if size, _ := decide(cfg, test.size, test.min, test.in, test.out, test.rate, test.previousRate, test.grown); size != test.want {
+			t.Errorf("%s: got %d workers, want %d", test.name, size, test.want)
+		}
+	}
+}
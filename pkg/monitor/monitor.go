@@ -2,27 +2,56 @@ package monitor
 
 import (
 	"context"
+	kafkaGo "github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/pkg/metrics"
 	"kafka-to-elastic-pipeline/pkg/types"
+	"sort"
+	"strconv"
 	"time"
 )
 
 // Monitors fillness of channels. High fillness means that sink layer is slower than source layer.
-func MonitorFillness(ctx context.Context, usersChan chan types.User, tweetsChan chan types.Tweet, enrichedTweetsChan chan types.EnrichedTweet, logger *zap.Logger) error {
+// Fillness is logged and, together with lag of kafka readers, exposed as metrics, until the context is cancelled.
+func MonitorFillness(ctx context.Context, channels map[string]chan *types.Record, readers []*kafkaGo.Reader, logger *zap.Logger) error {
 	tickChannel := time.NewTicker(time.Second * 10).C
 
+	var names []string
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return nil
 
 		case <-tickChannel:
-			logger.Info(
-				"Channels fillness %",
-				zap.Float32("users", 100*float32(len(usersChan))/float32(cap(usersChan))),
-				zap.Float32("tweets", 100*float32(len(tweetsChan))/float32(cap(tweetsChan))),
-				zap.Float32("enriched tweets", 100*float32(len(enrichedTweetsChan))/float32(cap(enrichedTweetsChan))),
-			)
+			var fields []zap.Field
+			for _, name := range names {
+				channel := channels[name]
+				observeChannel(name, len(channel), cap(channel))
+				fields = append(fields, zap.Float32(name, 100*float32(len(channel))/float32(cap(channel))))
+			}
+			observeLag(readers)
+
+			logger.Info("Channels fillness %", fields...)
 		}
 	}
 }
+
+func observeChannel(name string, length, capacity int) {
+	metrics.ChannelLength.WithLabelValues(name).Set(float64(length))
+	metrics.ChannelCapacity.WithLabelValues(name).Set(float64(capacity))
+}
+
+// Readers are labeled by their number within a topic
+func observeLag(readers []*kafkaGo.Reader) {
+	numbers := map[string]int{}
+	for _, reader := range readers {
+		stats := reader.Stats()
+		metrics.ConsumerLag.WithLabelValues(stats.Topic, strconv.Itoa(numbers[stats.Topic])).Set(float64(stats.Lag))
+		numbers[stats.Topic]++
+	}
+}
@@ -0,0 +1,317 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math"
+	"strings"
+)
+
+// avroType is a parsed avro schema; messages are decoded by the schema they were written with, so there is no
+// schema resolution, and defaults, aliases and orders of fields don't matter
+type avroType struct {
+	kind     string // primitive type name, or record, enum, array, map, union or fixed
+	name     string // full name of records, enums and fixed
+	fields   []avroField
+	symbols  []string    // of enums
+	items    *avroType   // of arrays, and values of maps
+	branches []*avroType // of unions
+	size     int         // of fixed
+}
+
+type avroField struct {
+	name string
+	t    *avroType
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+// parseAvro parses the schema; named types it defines are added to names, where it also looks up named types it uses
+func parseAvro(schema string, names map[string]*avroType) (*avroType, error) {
+	var node interface{}
+	if err := json.Unmarshal([]byte(schema), &node); err != nil {
+		return nil, errors.Wrap(err, "avro schema is not JSON")
+	}
+	return parseAvroNode(node, "", names)
+}
+
+func parseAvroNode(node interface{}, namespace string, names map[string]*avroType) (*avroType, error) {
+	switch node := node.(type) {
+	case string:
+		if avroPrimitives[node] {
+			return &avroType{kind: node}, nil
+		}
+		if t := names[avroFullName(node, namespace)]; t != nil {
+			return t, nil
+		}
+		if t := names[node]; t != nil {
+			return t, nil
+		}
+		return nil, errors.Errorf("unknown avro type %q", node)
+
+	case []interface{}:
+		union := &avroType{kind: "union"}
+		for _, branch := range node {
+			t, err := parseAvroNode(branch, namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			union.branches = append(union.branches, t)
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		kind, ok := node["type"].(string)
+		if !ok {
+			// e.g. {"type": {"type": "array", ...}}
+			return parseAvroNode(node["type"], namespace, names)
+		}
+		t := &avroType{kind: kind}
+		switch kind {
+		case "record", "error", "enum", "fixed":
+			name, _ := node["name"].(string)
+			if name == "" {
+				return nil, errors.Errorf("avro %s has no name", kind)
+			}
+			if ns, ok := node["namespace"].(string); ok && !strings.Contains(name, ".") {
+				namespace = ns
+			}
+			t.name = avroFullName(name, namespace)
+			if i := strings.LastIndex(t.name, "."); i >= 0 {
+				namespace = t.name[:i]
+			}
+			// registered before fields are parsed, so that records may refer to themselves
+			names[t.name] = t
+		}
+
+		switch kind {
+		case "record", "error":
+			t.kind = "record"
+			fields, _ := node["fields"].([]interface{})
+			for _, field := range fields {
+				field, _ := field.(map[string]interface{})
+				name, _ := field["name"].(string)
+				if name == "" {
+					return nil, errors.Errorf("avro record %s has a field without name", t.name)
+				}
+				fieldType, err := parseAvroNode(field["type"], namespace, names)
+				if err != nil {
+					return nil, errors.Wrapf(err, "avro field %s.%s", t.name, name)
+				}
+				t.fields = append(t.fields, avroField{name: name, t: fieldType})
+			}
+		case "enum":
+			symbols, _ := node["symbols"].([]interface{})
+			for _, symbol := range symbols {
+				symbol, _ := symbol.(string)
+				t.symbols = append(t.symbols, symbol)
+			}
+		case "fixed":
+			size, _ := node["size"].(float64)
+			t.size = int(size)
+		case "array", "map":
+			itemsKey := "items"
+			if kind == "map" {
+				itemsKey = "values"
+			}
+			items, err := parseAvroNode(node[itemsKey], namespace, names)
+			if err != nil {
+				return nil, err
+			}
+			t.items = items
+		default:
+			// primitive types, possibly with logical types, which are decoded as the primitive ones
+			if !avroPrimitives[kind] {
+				return parseAvroNode(kind, namespace, names)
+			}
+		}
+		return t, nil
+	}
+	return nil, errors.Errorf("invalid avro schema %v", node)
+}
+
+func avroFullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// decodeAvro decodes avro binary encoding of a record into a document
+func decodeAvro(t *avroType, data []byte) (map[string]interface{}, error) {
+	if t.kind != "record" {
+		return nil, errors.Errorf("avro schema is %s, not a record", t.kind)
+	}
+	buffer := &avroBuffer{data: data, items: int64(len(data)) + maxAvroEmptyItems}
+	value, err := buffer.decode(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(buffer.data) > 0 {
+		return nil, errors.Errorf("%d bytes left after avro record", len(buffer.data))
+	}
+	return value.(map[string]interface{}), nil
+}
+
+type avroBuffer struct {
+	data  []byte
+	items int64 // number of items arrays and maps of the message may have yet
+}
+
+// Items of arrays and maps take a byte at least, except those of empty types (e.g. null, or a record of no fields):
+// a message has at most as many items as bytes, and that many of empty types besides, so that a crafted count
+// of items doesn't make decoding loop and allocate without end
+const maxAvroEmptyItems = 1 << 16
+
+var errAvroTruncated = errors.New("avro message is truncated")
+
+func (b *avroBuffer) decode(t *avroType) (interface{}, error) {
+	switch t.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		bytes, err := b.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return bytes[0] != 0, nil
+	case "int", "long":
+		value, err := b.long()
+		return integer(value), err
+	case "float":
+		bytes, err := b.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return float32Number(math.Float32frombits(binary.LittleEndian.Uint32(bytes)))
+	case "double":
+		bytes, err := b.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return float64Number(math.Float64frombits(binary.LittleEndian.Uint64(bytes)))
+	case "bytes":
+		return b.bytes()
+	case "string":
+		bytes, err := b.bytes()
+		return string(bytes), err
+	case "fixed":
+		return b.next(t.size)
+
+	case "enum":
+		index, err := b.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(t.symbols)) {
+			return nil, errors.Errorf("avro enum %s has no symbol %d", t.name, index)
+		}
+		return t.symbols[index], nil
+
+	case "union":
+		index, err := b.long()
+		if err != nil {
+			return nil, err
+		}
+		if index < 0 || index >= int64(len(t.branches)) {
+			return nil, errors.Errorf("avro union has no branch %d", index)
+		}
+		// the value as it is, without the branch name as in avro JSON encoding
+		return b.decode(t.branches[index])
+
+	case "record":
+		record := make(map[string]interface{}, len(t.fields))
+		for _, field := range t.fields {
+			value, err := b.decode(field.t)
+			if err != nil {
+				return nil, errors.Wrapf(err, "field %s", field.name)
+			}
+			record[field.name] = value
+		}
+		return record, nil
+
+	case "array":
+		array := []interface{}{}
+		err := b.blocks(func() error {
+			item, err := b.decode(t.items)
+			array = append(array, item)
+			return err
+		})
+		return array, err
+
+	case "map":
+		values := map[string]interface{}{}
+		err := b.blocks(func() error {
+			key, err := b.bytes()
+			if err != nil {
+				return err
+			}
+			values[string(key)], err = b.decode(t.items)
+			return err
+		})
+		return values, err
+	}
+	return nil, errors.Errorf("unknown avro type %s", t.kind)
+}
+
+// blocks reads items of arrays and maps, which come in blocks with counts, up to a block of 0 items
+func (b *avroBuffer) blocks(item func() error) error {
+	for {
+		count, err := b.long()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// followed by the size of the block in bytes
+			count = -count
+			if _, err := b.long(); err != nil {
+				return err
+			}
+		}
+		if count > b.items || count < 0 {
+			return errors.Errorf("avro block of %d items is too long for the message", count)
+		}
+		b.items -= count
+		for ; count > 0; count-- {
+			if err := item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// long is zig-zag encoded variable length integer, exactly as binary.Varint
+func (b *avroBuffer) long() (int64, error) {
+	value, n := binary.Varint(b.data)
+	if n <= 0 {
+		return 0, errAvroTruncated
+	}
+	b.data = b.data[n:]
+	return value, nil
+}
+
+func (b *avroBuffer) bytes() ([]byte, error) {
+	size, err := b.long()
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, errors.Errorf("negative avro length %d", size)
+	}
+	return b.next(int(size))
+}
+
+func (b *avroBuffer) next(n int) ([]byte, error) {
+	if n > len(b.data) {
+		return nil, errAvroTruncated
+	}
+	bytes := b.data[:n]
+	b.data = b.data[n:]
+	return bytes, nil
+}
@@ -0,0 +1,182 @@
+package kafka
+
+import (
+	"context"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Committer commits offsets of messages fetched by a reader once objects decoded from them are written.
+//
+// Objects are written out of order (there are several writers), while kafka stores a single offset per partition,
+// so a partition is committed only up to the first message that is not acknowledged yet.
+// Without consumer group kafka doesn't store offsets, and acknowledgements are only tracked.
+type Committer struct {
+	reader *kafka.Reader
+	logger *zap.Logger
+
+	mutex      sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+func NewCommitter(reader *kafka.Reader, logger *zap.Logger) *Committer {
+	return &Committer{
+		reader:     reader,
+		logger:     logger,
+		partitions: map[int]*partitionOffsets{},
+	}
+}
+
+// Track registers a fetched message and returns its offset, to be acknowledged when the message is written.
+func (c *Committer) Track(message kafka.Message) types.Offset {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	partition, ok := c.partitions[message.Partition]
+	if !ok {
+		partition = newPartitionOffsets()
+		c.partitions[message.Partition] = partition
+	}
+	partition.fetched(message.Offset)
+
+	return types.Offset{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset, Acker: c}
+}
+
+func (c *Committer) Ack(offset types.Offset) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if partition, ok := c.partitions[offset.Partition]; ok {
+		partition.acked(offset.Offset)
+	}
+}
+
+// Run commits acknowledged offsets every `interval`, until `stop` is closed - then it makes the final commit.
+func (c *Committer) Run(ctx context.Context, interval time.Duration, stop <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	tickChannel := ticker.C
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-stop:
+			return c.Commit(ctx)
+
+		case <-tickChannel:
+			if err := c.Commit(ctx); err != nil {
+				// The reader reconnects by itself; uncommitted offsets are committed with the next tick
+				c.logger.Warn("failed to commit offsets", zap.String("topic", c.reader.Config().Topic), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Commit commits offsets acknowledged since the previous commit.
+func (c *Committer) Commit(ctx context.Context) error {
+	if c.reader.Config().GroupID == "" {
+		return nil
+	}
+
+	var messages []kafka.Message
+	c.mutex.Lock()
+	for id, partition := range c.partitions {
+		if partition.committable > partition.committed {
+			messages = append(messages, kafka.Message{Topic: c.reader.Config().Topic, Partition: id, Offset: partition.committable})
+		}
+	}
+	c.mutex.Unlock()
+
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := c.reader.CommitMessages(ctx, messages...); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	for _, message := range messages {
+		if partition := c.partitions[message.Partition]; partition.committed < message.Offset {
+			partition.committed = message.Offset
+		}
+	}
+	c.mutex.Unlock()
+	return nil
+}
+
+// PartitionOffsets are offsets of a partition fetched by the reader, -1 if there are none yet
+type PartitionOffsets struct {
+	Topic        string `json:"topic"`
+	Partition    int    `json:"partition"`
+	Fetched      int64  `json:"fetched"`      // the last fetched offset
+	Acknowledged int64  `json:"acknowledged"` // the last offset written together with all offsets before it
+	Committed    int64  `json:"committed"`    // the last committed offset
+	Pending      int    `json:"pending"`      // number of fetched offsets not written yet
+}
+
+// Offsets returns offsets of partitions the reader has fetched from, ordered by partition
+func (c *Committer) Offsets() []PartitionOffsets {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var offsets []PartitionOffsets
+	for id, partition := range c.partitions {
+		fetched := partition.committable
+		if len(partition.pending) > 0 {
+			fetched = partition.pending[len(partition.pending)-1]
+		}
+		offsets = append(offsets, PartitionOffsets{
+			Topic:        c.reader.Config().Topic,
+			Partition:    id,
+			Fetched:      fetched,
+			Acknowledged: partition.committable,
+			Committed:    partition.committed,
+			Pending:      len(partition.pending),
+		})
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Partition < offsets[j].Partition })
+	return offsets
+}
+
+// partitionOffsets tracks offsets of a partition that are fetched but not yet acknowledged
+type partitionOffsets struct {
+	pending []int64        // fetched offsets, in the order of fetching (increasing)
+	acks    map[int64]bool // acknowledged pending offsets
+
+	committable int64 // the last offset that is acknowledged together with all offsets before it
+	committed   int64
+}
+
+func newPartitionOffsets() *partitionOffsets {
+	return &partitionOffsets{acks: map[int64]bool{}, committable: -1, committed: -1}
+}
+
+func (p *partitionOffsets) fetched(offset int64) {
+	if len(p.pending) > 0 && offset <= p.pending[len(p.pending)-1] {
+		// The reader went back (e.g. consumer group rebalance): messages are fetched again and will be acknowledged again
+		p.pending = nil
+		p.acks = map[int64]bool{}
+	}
+	if offset <= p.committable {
+		p.committable = offset - 1
+		p.committed = offset - 1
+	}
+	p.pending = append(p.pending, offset)
+}
+
+func (p *partitionOffsets) acked(offset int64) {
+	if len(p.pending) == 0 || offset < p.pending[0] {
+		return
+	}
+	p.acks[offset] = true
+	for len(p.pending) > 0 && p.acks[p.pending[0]] {
+		p.committable = p.pending[0]
+		delete(p.acks, p.pending[0])
+		p.pending = p.pending[1:]
+	}
+}
@@ -0,0 +1,73 @@
+package kafka
+
+import (
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"reflect"
+	"testing"
+)
+
+func TestPartitionOffsets(t *testing.T) {
+	p := newPartitionOffsets()
+	for offset := int64(10); offset < 15; offset++ {
+		p.fetched(offset)
+	}
+
+	// acknowledged out of order: nothing can be committed while offset 10 is not written
+	p.acked(12)
+	p.acked(11)
+	if p.committable != -1 {
+		t.Fatalf("unexpected committable offset; got %d, want -1", p.committable)
+	}
+
+	p.acked(10)
+	if p.committable != 12 {
+		t.Fatalf("unexpected committable offset; got %d, want 12", p.committable)
+	}
+
+	p.acked(14)
+	p.acked(13)
+	if p.committable != 14 || len(p.pending) != 0 || len(p.acks) != 0 {
+		t.Fatalf("unexpected state; committable %d, pending %v, acks %v", p.committable, p.pending, p.acks)
+	}
+}
+
+func TestPartitionOffsetsFetchedAgain(t *testing.T) {
+	p := newPartitionOffsets()
+	for offset := int64(10); offset < 15; offset++ {
+		p.fetched(offset)
+	}
+	p.acked(10)
+
+	// e.g. after rebalance messages since the last commit are fetched once more
+	for offset := int64(11); offset < 13; offset++ {
+		p.fetched(offset)
+	}
+	p.acked(10) // late acknowledgement of already forgotten offset
+	p.acked(11)
+	if p.committable != 11 || len(p.pending) != 1 {
+		t.Fatalf("unexpected state; committable %d, pending %v", p.committable, p.pending)
+	}
+}
+
+func TestCommitterOffsets(t *testing.T) {
+	reader := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{"localhost:9092"}, Topic: "tweets"})
+	defer reader.Close()
+	committer := NewCommitter(reader, zap.NewNop())
+
+	var offsets []types.Offset
+	for _, message := range []kafka.Message{{Partition: 1, Offset: 5}, {Partition: 0, Offset: 7}, {Partition: 1, Offset: 6}} {
+		offsets = append(offsets, committer.Track(message))
+	}
+	offsets[0].Ack()
+	offsets[1].Ack()
+
+	want := []PartitionOffsets{
+		{Topic: "tweets", Partition: 0, Fetched: 7, Acknowledged: 7, Committed: -1},
+		{Topic: "tweets", Partition: 1, Fetched: 6, Acknowledged: 5, Committed: -1, Pending: 1},
+	}
+	if got := committer.Offsets(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected offsets\ngot  %+v\nwant %+v", got, want)
+	}
+}
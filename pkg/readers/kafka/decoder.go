@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"kafka-to-elastic-pipeline/config"
+	"math"
+	"strconv"
+)
+
+// Decoder decodes value of a kafka message into a document; the context bounds fetching its schema, if any
+type Decoder func(ctx context.Context, value []byte) (map[string]interface{}, error)
+
+// Confluent wire format: magic byte, big-endian schema ID, and the message encoded by the schema
+const (
+	magicByte        = 0
+	wireHeaderLength = 5
+)
+
+// NewDecoder returns decoder of the route; avro, protobuf and auto decoders resolve schemas by the registry
+func NewDecoder(route config.Route, registry *SchemaRegistry) (Decoder, error) {
+	if route.Decoder != config.DecoderJSON && registry == nil {
+		return nil, errors.Errorf("decoder %s of route %s needs schema registry", route.Decoder, route.Name)
+	}
+
+	switch route.Decoder {
+	case config.DecoderJSON:
+		return jsonDecoder, nil
+	case config.DecoderAvro:
+		return registry.decoder(schemaTypeAvro), nil
+	case config.DecoderProtobuf:
+		return registry.decoder(schemaTypeProtobuf), nil
+	case config.DecoderAuto:
+		decodeWire := registry.decoder("")
+		return func(ctx context.Context, value []byte) (map[string]interface{}, error) {
+			// JSON never starts with a zero byte
+			if len(value) > 0 && value[0] == magicByte {
+				return decodeWire(ctx, value)
+			}
+			return decodeJSON(value)
+		}, nil
+	}
+	return nil, errors.Errorf("unknown decoder %q of route %s", route.Decoder, route.Name)
+}
+
+// decoder decodes messages in Confluent wire format by their schemas, which have to be of the schema type, if set
+func (r *SchemaRegistry) decoder(schemaType string) Decoder {
+	return func(ctx context.Context, value []byte) (map[string]interface{}, error) {
+		if len(value) < wireHeaderLength || value[0] != magicByte {
+			return nil, errors.New("message is not in schema registry wire format")
+		}
+		id := int32(binary.BigEndian.Uint32(value[1:wireHeaderLength]))
+		s, err := r.schema(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if schemaType != "" && s.schemaType != schemaType {
+			return nil, errors.Errorf("schema %d is %s, not %s", id, s.schemaType, schemaType)
+		}
+
+		payload := value[wireHeaderLength:]
+		switch s.schemaType {
+		case schemaTypeAvro:
+			return decodeAvro(s.avro, payload)
+		case schemaTypeProtobuf:
+			return decodeProtobuf(s.protobuf, payload)
+		}
+		return decodeJSON(payload)
+	}
+}
+
+// decodeProtobuf decodes a protobuf message preceded by indexes of its message type in the schema: their number and
+// the indexes, zig-zag encoded; the first message type is a single 0
+func decodeProtobuf(file *protoFile, payload []byte) (map[string]interface{}, error) {
+	count, n := binary.Varint(payload)
+	if n <= 0 {
+		return nil, errProtoTruncated
+	}
+	payload = payload[n:]
+	indexes := []int64{0}
+	if count > 0 {
+		indexes = indexes[:0]
+		for ; count > 0; count-- {
+			index, n := binary.Varint(payload)
+			if n <= 0 {
+				return nil, errProtoTruncated
+			}
+			payload = payload[n:]
+			indexes = append(indexes, index)
+		}
+	}
+
+	message, err := file.message(indexes)
+	if err != nil {
+		return nil, err
+	}
+	return message.decode(payload)
+}
+
+// Integers of avro and protobuf messages are json.Number, as numbers of JSON messages, so that documents of all
+// formats are the same to enrichers and writers
+func integer(value int64) json.Number {
+	return json.Number(strconv.FormatInt(value, 10))
+}
+
+// float32Number keeps the shortest representation of a float, which it would lose as float64
+func float32Number(value float32) (interface{}, error) {
+	if _, err := float64Number(float64(value)); err != nil {
+		return nil, err
+	}
+	return json.Number(strconv.FormatFloat(float64(value), 'g', -1, 32)), nil
+}
+
+// float64Number fails on NaN and infinities: JSON has no such numbers, so documents with them can't be written
+func float64Number(value float64) (interface{}, error) {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return nil, errors.Errorf("%v is not a valid number", value)
+	}
+	return value, nil
+}
+
+// jsonDecoder decodes JSON messages, which need no schema
+func jsonDecoder(ctx context.Context, value []byte) (map[string]interface{}, error) {
+	return decodeJSON(value)
+}
+
+func decodeJSON(value []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber() // numbers are written to elastic as they are, without float conversion
+
+	var doc map[string]interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.New("message is not a JSON object")
+	}
+	return doc, nil
+}
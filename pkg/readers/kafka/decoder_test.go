@@ -0,0 +1,373 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/test/test_data"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// avro and protobuf encodings of test messages, built by hand
+
+func avroLong(value int64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return buffer[:binary.PutVarint(buffer, value)]
+}
+
+func avroString(value string) []byte {
+	return append(avroLong(int64(len(value))), value...)
+}
+
+func protoVarint(value uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return buffer[:binary.PutUvarint(buffer, value)]
+}
+
+func protoEncoded(number, wireType uint64, value []byte) []byte {
+	key := protoVarint(number<<3 | wireType)
+	if wireType == wireBytes {
+		key = append(key, protoVarint(uint64(len(value)))...)
+	}
+	return append(key, value...)
+}
+
+func concat(parts ...[]byte) []byte {
+	var result []byte
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+func newRegistryDecoder(t *testing.T, decoder string, registry *test_data.SchemaRegistry) Decoder {
+	cfg := config.Default()
+	cfg.SchemaRegistry.URL = registry.URL
+	decode, err := NewDecoder(config.Route{Name: "test", Decoder: decoder}, NewSchemaRegistry(cfg.SchemaRegistry))
+	if err != nil {
+		t.Fatalf("failed to create decoder: %s", err)
+	}
+	return decode
+}
+
+func TestDecodeAvro(t *testing.T) {
+	registry := test_data.NewSchemaRegistry()
+	defer registry.Close()
+
+	// Location is defined by a referenced schema
+	registry.Register("location", "AVRO", `{"type": "record", "name": "Location", "namespace": "geo",
+		"fields": [{"name": "Lat", "type": "double"}, {"name": "Lon", "type": "double"}]}`)
+	id := registry.Register("tweets-value", "AVRO", `{
+		"type": "record", "name": "Tweet", "namespace": "twitter",
+		"fields": [
+			{"name": "Id", "type": "long"},
+			{"name": "Message", "type": "string"},
+			{"name": "RemoteAddress", "type": ["null", "string"]},
+			{"name": "Retweeted", "type": "boolean"},
+			{"name": "Score", "type": "float"},
+			{"name": "Kind", "type": {"type": "enum", "name": "Kind", "symbols": ["ORIGINAL", "REPLY"]}},
+			{"name": "Tags", "type": {"type": "array", "items": "string"}},
+			{"name": "Counters", "type": {"type": "map", "values": "int"}},
+			{"name": "Location", "type": ["null", "geo.Location"]},
+			{"name": "Created", "type": {"type": "long", "logicalType": "timestamp-millis"}}
+		]}`, test_data.SchemaReference{Name: "geo.Location", Subject: "location", Version: 1})
+
+	lat, lon := make([]byte, 8), make([]byte, 8)
+	binary.LittleEndian.PutUint64(lat, math.Float64bits(52.5))
+	binary.LittleEndian.PutUint64(lon, math.Float64bits(13.25))
+	score := make([]byte, 4)
+	binary.LittleEndian.PutUint32(score, math.Float32bits(0.1))
+	message := concat(
+		avroLong(42),
+		avroString("hello"),
+		avroLong(1), avroString("1.2.3.4"),
+		[]byte{1},
+		score,
+		avroLong(1),
+		avroLong(2), avroString("a"), avroString("b"), avroLong(0),
+		avroLong(-1), avroLong(6), avroString("likes"), avroLong(-3), avroLong(0), // a block with its size in bytes
+		avroLong(1), lat, lon,
+		avroLong(1550000000000),
+	)
+
+	decode := newRegistryDecoder(t, config.DecoderAvro, registry)
+	doc, err := decode(context.Background(), test_data.WireFormat(id, message))
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+	expected := map[string]interface{}{
+		"Id":            json.Number("42"),
+		"Message":       "hello",
+		"RemoteAddress": "1.2.3.4",
+		"Retweeted":     true,
+		"Score":         json.Number("0.1"),
+		"Kind":          "REPLY",
+		"Tags":          []interface{}{"a", "b"},
+		"Counters":      map[string]interface{}{"likes": json.Number("-3")},
+		"Location":      map[string]interface{}{"Lat": 52.5, "Lon": 13.25},
+		"Created":       json.Number("1550000000000"),
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("unexpected document\ngot  %#v\nwant %#v", doc, expected)
+	}
+
+	// the schema is cached
+	requests := registry.Requests()
+	if _, err := decode(context.Background(), test_data.WireFormat(id, message)); err != nil {
+		t.Fatalf("failed to decode again: %s", err)
+	}
+	if registry.Requests() != requests {
+		t.Fatalf("schema must be fetched once; got %d requests, then %d", requests, registry.Requests())
+	}
+
+	if _, err := decode(context.Background(), test_data.WireFormat(id, message[:len(message)-1])); err == nil {
+		t.Fatal("truncated message must fail to decode")
+	}
+
+	// JSON has no NaN, so such a document can't be written
+	nan := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nan, math.Float64bits(math.NaN()))
+	if _, err := decode(context.Background(), test_data.WireFormat(id, bytes.Replace(message, lat, nan, 1))); err == nil {
+		t.Fatal("message with NaN must fail to decode")
+	}
+}
+
+func TestDecodeAvroBlocks(t *testing.T) {
+	nulls := &avroType{kind: "record", fields: []avroField{{name: "Nulls", t: &avroType{kind: "array", items: &avroType{kind: "null"}}}}}
+	for _, test := range []struct {
+		name    string
+		message []byte
+		valid   bool
+	}{
+		{"few empty items", concat(avroLong(3), avroLong(0)), true},
+		{"many empty items", concat(avroLong(maxAvroEmptyItems*2), avroLong(0)), false},
+		{"many empty items in blocks", concat(avroLong(maxAvroEmptyItems), avroLong(maxAvroEmptyItems), avroLong(0)), false},
+		{"negative count of many empty items", concat(avroLong(-math.MaxInt64), avroLong(0), avroLong(0)), false},
+		{"negative count out of range", concat(avroLong(math.MinInt64), avroLong(0), avroLong(0)), false},
+	} {
+		doc, err := decodeAvro(nulls, test.message)
+		if test.valid && (err != nil || len(doc["Nulls"].([]interface{})) != 3) {
+			t.Fatalf("%s: unexpected document %v, error %v", test.name, doc, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("%s: message must fail to decode", test.name)
+		}
+	}
+}
+
+func TestDecodeProtobuf(t *testing.T) {
+	registry := test_data.NewSchemaRegistry()
+	defer registry.Close()
+
+	registry.Register("user", "PROTOBUF", `
+		syntax = "proto3";
+		package twitter;
+		message User { int64 Id = 1; string Name = 2; }`)
+	id := registry.Register("tweets-value", "PROTOBUF", `
+		syntax = "proto3";
+		package twitter;
+		import "user.proto";
+		import "google/protobuf/timestamp.proto";
+
+		// the first message, for index 0
+		message Ping {}
+
+		/* the second one */
+		message Tweet {
+			enum Kind { ORIGINAL = 0; REPLY = 1; }
+			message Location { double Lat = 1; double Lon = 2; }
+
+			string Message = 1;
+			repeated string Tags = 2;
+			repeated sint32 Scores = 3 [packed = true];
+			map<string, int32> Counters = 4;
+			Kind Kind = 5;
+			User User = 6;
+			oneof Place {
+				Location Location = 7;
+				string City = 8;
+			}
+			google.protobuf.Timestamp Created = 9;
+			reserved 10, 11;
+		}`, test_data.SchemaReference{Name: "user.proto", Subject: "user", Version: 1})
+
+	lat := make([]byte, 8)
+	binary.LittleEndian.PutUint64(lat, math.Float64bits(52.5))
+	message := concat(
+		protoEncoded(1, wireBytes, []byte("hello")),
+		protoEncoded(2, wireBytes, []byte("a")),
+		protoEncoded(2, wireBytes, []byte("b")),
+		protoEncoded(3, wireBytes, concat(protoVarint(3), protoVarint(4))), // sint32 -2 and 2
+		protoEncoded(4, wireBytes, concat(protoEncoded(1, wireBytes, []byte("likes")), protoEncoded(2, wireVarint, protoVarint(7)))),
+		protoEncoded(5, wireVarint, protoVarint(1)),
+		protoEncoded(6, wireBytes, concat(protoEncoded(1, wireVarint, protoVarint(7)), protoEncoded(2, wireBytes, []byte("joe")))),
+		protoEncoded(7, wireBytes, protoEncoded(1, wireFixed64, lat)),
+		protoEncoded(9, wireBytes, protoEncoded(1, wireVarint, protoVarint(1550000000))),
+		protoEncoded(15, wireVarint, protoVarint(1)), // unknown field
+	)
+	// message indexes: one index, 1 - the second top-level message
+	value := test_data.WireFormat(id, concat(avroLong(1), avroLong(1), message))
+
+	decode := newRegistryDecoder(t, config.DecoderProtobuf, registry)
+	doc, err := decode(context.Background(), value)
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+	expected := map[string]interface{}{
+		"Message":  "hello",
+		"Tags":     []interface{}{"a", "b"},
+		"Scores":   []interface{}{json.Number("-2"), json.Number("2")},
+		"Counters": map[string]interface{}{"likes": json.Number("7")},
+		"Kind":     "REPLY",
+		"User":     map[string]interface{}{"Id": json.Number("7"), "Name": "joe"},
+		"Location": map[string]interface{}{"Lat": 52.5},
+		"Created":  "2019-02-12T19:33:20Z",
+	}
+	if !reflect.DeepEqual(doc, expected) {
+		t.Fatalf("unexpected document\ngot  %#v\nwant %#v", doc, expected)
+	}
+
+	// a single 0 stands for the first message
+	if doc, err := decode(context.Background(), test_data.WireFormat(id, []byte{0})); err != nil || len(doc) != 0 {
+		t.Fatalf("unexpected first message %v, error %v", doc, err)
+	}
+
+	if _, err := newRegistryDecoder(t, config.DecoderAvro, registry)(context.Background(), value); err == nil {
+		t.Fatal("avro decoder must fail to decode protobuf message")
+	}
+
+	binary.LittleEndian.PutUint64(lat, math.Float64bits(math.Inf(1)))
+	if _, err := decode(context.Background(), test_data.WireFormat(id, concat(avroLong(1), avroLong(1), protoEncoded(7, wireBytes, protoEncoded(1, wireFixed64, lat))))); err == nil {
+		t.Fatal("message with infinity must fail to decode")
+	}
+}
+
+func TestDecodeAuto(t *testing.T) {
+	registry := test_data.NewSchemaRegistry()
+	id := registry.Register("users-value", "AVRO", `{"type": "record", "name": "User", "fields": [{"name": "Id", "type": "long"}]}`)
+
+	decode := newRegistryDecoder(t, config.DecoderAuto, registry)
+	doc, err := decode(context.Background(), []byte(`{"Id": 1}`))
+	if err != nil || doc["Id"] != json.Number("1") {
+		t.Fatalf("JSON message must be decoded as JSON; got %v, error %v", doc, err)
+	}
+	doc, err = decode(context.Background(), test_data.WireFormat(id, avroLong(2)))
+	if err != nil || doc["Id"] != json.Number("2") {
+		t.Fatalf("avro message must be decoded by its schema; got %v, error %v", doc, err)
+	}
+
+	// unknown schemas make messages poison, and are not asked for again; unavailable registry doesn't
+	for i := 0; i < 2; i++ {
+		_, err = decode(context.Background(), test_data.WireFormat(id+100, avroLong(2)))
+		if _, ok := errors.Cause(err).(*SchemaUnavailableError); err == nil || ok {
+			t.Fatalf("message of unknown schema must fail to decode; got %v", err)
+		}
+	}
+	if requests := registry.Requests(); requests != 2 {
+		t.Fatalf("unknown schema must be asked for once; got %d requests", requests)
+	}
+
+	other := registry.Register("users-value", "AVRO", `{"type": "record", "name": "User", "fields": [{"name": "Name", "type": "string"}]}`)
+	registry.SetUnavailable(true)
+	_, err = decode(context.Background(), test_data.WireFormat(other, avroString("joe")))
+	if _, ok := errors.Cause(err).(*SchemaUnavailableError); !ok {
+		t.Fatalf("schema registry must be unavailable; got %v", err)
+	}
+	registry.SetUnavailable(false)
+	doc, err = decode(context.Background(), test_data.WireFormat(other, avroString("joe")))
+	if err != nil || doc["Name"] != "joe" {
+		t.Fatalf("schema must be fetched once the registry is back; got %v, error %v", doc, err)
+	}
+	registry.Close()
+	_, err = decode(context.Background(), test_data.WireFormat(other+1, avroLong(2)))
+	if _, ok := errors.Cause(err).(*SchemaUnavailableError); !ok {
+		t.Fatalf("schema registry must be unavailable; got %v", err)
+	}
+}
+
+func TestSchemaRegistryFetchesConcurrently(t *testing.T) {
+	// The first schema is slow to fetch, as long as the channel is open
+	slow := make(chan struct{})
+	fast := test_data.NewSchemaRegistry()
+	defer fast.Close()
+	id := fast.Register("users-value", "AVRO", `{"type": "record", "name": "User", "fields": [{"name": "Id", "type": "long"}]}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/schemas/ids/999" {
+			<-slow
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fast.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	defer close(slow)
+
+	cfg := config.Default()
+	cfg.SchemaRegistry.URL = server.URL
+	registry := NewSchemaRegistry(cfg.SchemaRegistry)
+	go registry.schema(context.Background(), 999)
+
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := registry.schema(context.Background(), id)
+		fetched <- err
+	}()
+	select {
+	case err := <-fetched:
+		if err != nil {
+			t.Fatalf("failed to fetch schema: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow fetch of one schema must not hold fetches of others")
+	}
+}
+
+func TestSchemaRegistryErrors(t *testing.T) {
+	slow := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/schemas/ids/1":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/schemas/ids/2":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			select {
+			case <-slow:
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	defer close(slow)
+
+	cfg := config.Default()
+	cfg.SchemaRegistry.URL = server.URL
+	cfg.SchemaRegistry.Timeout = time.Minute
+	registry := NewSchemaRegistry(cfg.SchemaRegistry)
+
+	_, err := registry.schema(context.Background(), 1)
+	if _, unavailable := errors.Cause(err).(*SchemaUnavailableError); err == nil || unavailable {
+		t.Fatalf("registry refusing the request must fail for good; got %v", err)
+	}
+	_, err = registry.schema(context.Background(), 2)
+	if _, unavailable := errors.Cause(err).(*SchemaUnavailableError); !unavailable {
+		t.Fatalf("registry with too many requests must be unavailable; got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	started := time.Now()
+	_, err = registry.schema(ctx, 3)
+	if _, unavailable := errors.Cause(err).(*SchemaUnavailableError); !unavailable || time.Since(started) > time.Second*5 {
+		t.Fatalf("fetch must stop with the context, and be tried again; got %v after %s", err, time.Since(started))
+	}
+}
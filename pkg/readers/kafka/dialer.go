@@ -0,0 +1,157 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewDialer returns the dialer of all connections of the pipeline to kafka, with TLS and SASL as configured.
+// With a TLS client certificate it also returns the certificate, to be watched for changes; otherwise it is nil.
+func NewDialer(cfg config.Kafka, logger *zap.Logger) (*kafka.Dialer, *Certificate, error) {
+	dialer := &kafka.Dialer{Timeout: kafka.DefaultDialer.Timeout, DualStack: true}
+
+	var certificate *Certificate
+	if cfg.TLS.Enabled {
+		tlsConfig := &tls.Config{
+			ServerName:         cfg.TLS.ServerName,
+			InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+		}
+		if cfg.TLS.CAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.TLS.CAFile)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "failed to read kafka CA file")
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, nil, errors.Errorf("kafka CA file %s has no PEM certificates", cfg.TLS.CAFile)
+			}
+		}
+		if cfg.TLS.CertFile != "" {
+			var err error
+			if certificate, err = LoadCertificate(cfg.TLS.CertFile, cfg.TLS.KeyFile, logger); err != nil {
+				return nil, nil, err
+			}
+			tlsConfig.GetClientCertificate = certificate.get
+		}
+		dialer.TLS = tlsConfig
+	}
+
+	if cfg.SASL.Mechanism != "" {
+		mechanism, err := saslMechanism(cfg.SASL)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialer.SASLMechanism = mechanism
+	}
+	return dialer, certificate, nil
+}
+
+func saslMechanism(cfg config.KafkaSASL) (sasl.Mechanism, error) {
+	switch cfg.Mechanism {
+	case config.SASLMechanismPlain:
+		return plain.Mechanism{Username: cfg.Username, Password: cfg.Password}, nil
+	case config.SASLMechanismSCRAMSHA256:
+		return scram.Mechanism(scram.SHA256, cfg.Username, cfg.Password)
+	case config.SASLMechanismSCRAMSHA512:
+		return scram.Mechanism(scram.SHA512, cfg.Username, cfg.Password)
+	}
+	return nil, errors.Errorf("unknown sasl mechanism %q", cfg.Mechanism)
+}
+
+// Certificate is a TLS client certificate that can be replaced while in use: connections made after a reload
+// present the new certificate, established ones stay as they are.
+type Certificate struct {
+	certFile, keyFile string
+	logger            *zap.Logger
+
+	reloading sync.Mutex
+	state     string // of the files the certificate was loaded from, to tell when they change
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+}
+
+// LoadCertificate loads the certificate and its key from PEM files
+func LoadCertificate(certFile, keyFile string, logger *zap.Logger) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Certificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.certificate, nil
+}
+
+// Watch reloads the certificate when its files change, checking them every interval, until the context is cancelled.
+// Certificates that fail to load (e.g. the key doesn't match the certificate yet) are logged, and the current one
+// stays in use.
+func (c *Certificate) Watch(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			if err := c.Reload(); err != nil {
+				c.logger.Warn("failed to reload kafka client certificate", zap.String("file", c.certFile), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Reload loads the certificate, if its files have changed since the last reload
+func (c *Certificate) Reload() error {
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+
+	var state string
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return errors.Wrap(err, "failed to check kafka client certificate")
+		}
+		state += fmt.Sprintf("%s %d %d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	if state == c.state {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load kafka client certificate")
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to parse kafka client certificate")
+	}
+	certificate.Leaf = leaf
+
+	c.mutex.Lock()
+	c.certificate = &certificate
+	c.mutex.Unlock()
+	c.state = state
+
+	c.logger.Info("kafka client certificate loaded", zap.String("file", c.certFile),
+		zap.String("subject", leaf.Subject.String()), zap.Time("expires", leaf.NotAfter))
+	return nil
+}
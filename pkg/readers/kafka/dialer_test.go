@@ -0,0 +1,157 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate with the common name, and its key, as PEM files
+func writeCertificate(t *testing.T, commonName, certFile, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func TestDialerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dialer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	// The broker trusts the client certificates, and the client trusts the broker
+	brokerCert := writeCertificate(t, "broker.test", file("broker.pem"), file("broker.key"))
+	clientCert := writeCertificate(t, "client-1", file("client.pem"), file("client.key"))
+	brokerKeyPair, err := tls.LoadX509KeyPair(file("broker.pem"), file("broker.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	clients.AddCert(clientCert)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{brokerKeyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	presented := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err == nil {
+				presented <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			} else {
+				presented <- err.Error()
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg := config.Default().Kafka
+	cfg.TLS = config.KafkaTLS{
+		Enabled:    true,
+		CAFile:     file("broker.pem"),
+		CertFile:   file("client.pem"),
+		KeyFile:    file("client.key"),
+		ServerName: brokerCert.Subject.CommonName,
+	}
+	dialer, certificate, err := NewDialer(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create dialer: %s", err)
+	}
+
+	dial := func() string {
+		conn, err := dialer.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %s", err)
+		}
+		defer conn.Close()
+		return <-presented
+	}
+	if name := dial(); name != "client-1" {
+		t.Fatalf("client must present its certificate; broker got %s", name)
+	}
+
+	// A renewed client certificate is presented by new connections once it is reloaded
+	renewed := writeCertificate(t, "client-2", file("client.pem"), file("client.key"))
+	clients.AddCert(renewed)
+	future := time.Now().Add(time.Minute)
+	for _, name := range []string{"client.pem", "client.key"} {
+		if err := os.Chtimes(file(name), future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := certificate.Reload(); err != nil {
+		t.Fatalf("failed to reload certificate: %s", err)
+	}
+	if name := dial(); name != "client-2" {
+		t.Fatalf("client must present the renewed certificate; broker got %s", name)
+	}
+}
+
+func TestDialerSASL(t *testing.T) {
+	cfg := config.Default().Kafka
+	for _, mechanism := range []string{config.SASLMechanismPlain, config.SASLMechanismSCRAMSHA256, config.SASLMechanismSCRAMSHA512} {
+		cfg.SASL = config.KafkaSASL{Mechanism: mechanism, Username: "pipeline", Password: "secret"}
+		dialer, certificate, err := NewDialer(cfg, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to create dialer with %s: %s", mechanism, err)
+		}
+		if dialer.SASLMechanism == nil || dialer.TLS != nil || certificate != nil {
+			t.Fatalf("dialer with %s must have SASL only", mechanism)
+		}
+	}
+}
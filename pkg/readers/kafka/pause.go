@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+)
+
+// Pause holds reading of a topic back while it is paused, e.g. by the admin API.
+// Messages are not fetched meanwhile, and with consumer group the readers stay members of it.
+type Pause struct {
+	mutex   sync.Mutex
+	resumed chan struct{} // closed while not paused
+}
+
+func NewPause() *Pause {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &Pause{resumed: resumed}
+}
+
+// Pause pauses reading, and tells if it was running
+func (p *Pause) Pause() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.resumed:
+		p.resumed = make(chan struct{})
+		return true
+	default:
+		return false
+	}
+}
+
+// Resume resumes reading, and tells if it was paused
+func (p *Pause) Resume() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.resumed:
+		return false
+	default:
+		close(p.resumed)
+		return true
+	}
+}
+
+func (p *Pause) Paused() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+// Wait waits until reading is resumed, or the context is cancelled
+func (p *Pause) Wait(ctx context.Context) error {
+	p.mutex.Lock()
+	resumed := p.resumed
+	p.mutex.Unlock()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Gates hold reading back while any of them does
+type Gates []Gate
+
+func (g Gates) Wait(ctx context.Context) error {
+	for _, gate := range g {
+		if err := gate.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
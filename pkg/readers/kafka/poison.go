@@ -0,0 +1,118 @@
+package kafka
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Headers added to messages published to the dead-letter queue, besides headers of the original message
+const (
+	HeaderDLQError     = "dlq.error"
+	HeaderDLQTopic     = "dlq.topic"
+	HeaderDLQPartition = "dlq.partition"
+	HeaderDLQOffset    = "dlq.offset"
+)
+
+// PoisonHandler deals with messages that can't be decoded, so that a single malformed message doesn't stop the
+// pipeline. They are skipped or published to the dead-letter queue topic, until there are too many of them within
+// the window: then something is seriously wrong (e.g. a producer changed format) and the pipeline halts.
+// One handler is shared by all the readers.
+type PoisonHandler struct {
+	policy      string
+	maxMessages int64
+	window      time.Duration // zero if the count never starts over
+	dlq         *kafka.Writer
+	logger      *zap.Logger
+
+	count int64 // atomic
+
+	mutex         sync.Mutex
+	windowStarted time.Time
+	windowCount   int64
+}
+
+func NewPoisonHandler(cfg config.Kafka, dialer *kafka.Dialer, logger *zap.Logger) *PoisonHandler {
+	handler := &PoisonHandler{
+		policy:      cfg.PoisonPolicy,
+		maxMessages: int64(cfg.MaxPoisonMessages),
+		window:      cfg.PoisonWindow,
+		logger:      logger,
+	}
+	if cfg.PoisonPolicy == config.PoisonPolicyDLQ {
+		handler.dlq = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:   cfg.Brokers,
+			Dialer:    dialer,
+			Topic:     cfg.DLQTopic,
+			BatchSize: 1, // poison messages are rare, there is no point to wait for a batch
+		})
+	}
+	return handler
+}
+
+// Handle is called with a message that failed to decode. Once it returns no error, the message is dealt with,
+// and its offset can be committed.
+func (h *PoisonHandler) Handle(ctx context.Context, message kafka.Message, decodeErr error) error {
+	atomic.AddInt64(&h.count, 1)
+	count := h.countInWindow()
+	metrics.PoisonMessages.WithLabelValues(message.Topic).Inc()
+	h.logger.Warn(
+		"failed to decode message",
+		zap.String("topic", message.Topic),
+		zap.Int("partition", message.Partition),
+		zap.Int64("offset", message.Offset),
+		zap.String("policy", h.policy),
+		zap.Int64("count", count),
+		zap.Error(decodeErr),
+	)
+	if count > h.maxMessages {
+		return errors.Wrapf(decodeErr, "too many messages failed to decode (%d within %s)", count, h.window)
+	}
+
+	if h.dlq == nil {
+		return nil
+	}
+
+	headers := append([]kafka.Header{}, message.Headers...)
+	headers = append(
+		headers,
+		kafka.Header{Key: HeaderDLQError, Value: []byte(decodeErr.Error())},
+		kafka.Header{Key: HeaderDLQTopic, Value: []byte(message.Topic)},
+		kafka.Header{Key: HeaderDLQPartition, Value: []byte(strconv.Itoa(message.Partition))},
+		kafka.Header{Key: HeaderDLQOffset, Value: []byte(strconv.FormatInt(message.Offset, 10))},
+	)
+	err := h.dlq.WriteMessages(ctx, kafka.Message{Key: message.Key, Value: message.Value, Headers: headers, Time: message.Time})
+	return errors.Wrap(err, "failed to publish message to dead-letter queue")
+}
+
+// countInWindow counts another message failed to decode in the current window, starting a new one if it is over,
+// and returns the count of the window
+func (h *PoisonHandler) countInWindow() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if now := time.Now(); h.window > 0 && now.Sub(h.windowStarted) >= h.window {
+		h.windowStarted = now
+		h.windowCount = 0
+	}
+	h.windowCount++
+	return h.windowCount
+}
+
+// Count returns number of messages that failed to decode so far, in all windows
+func (h *PoisonHandler) Count() int64 {
+	return atomic.LoadInt64(&h.count)
+}
+
+func (h *PoisonHandler) Close() error {
+	if h.dlq == nil {
+		return nil
+	}
+	return h.dlq.Close()
+}
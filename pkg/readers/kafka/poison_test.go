@@ -0,0 +1,56 @@
+package kafka
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"testing"
+	"time"
+)
+
+func TestPoisonHandlerThreshold(t *testing.T) {
+	cfg := config.Default().Kafka
+	cfg.PoisonPolicy = config.PoisonPolicySkip
+	cfg.MaxPoisonMessages = 2
+
+	handler := NewPoisonHandler(cfg, kafka.DefaultDialer, zap.NewNop())
+	defer handler.Close()
+
+	message := kafka.Message{Topic: "tweets", Value: []byte("{not json")}
+	for i := 0; i < cfg.MaxPoisonMessages; i++ {
+		if err := handler.Handle(context.Background(), message, errors.New("bad json")); err != nil {
+			t.Fatalf("message %d must be skipped; got %s", i, err)
+		}
+	}
+	if err := handler.Handle(context.Background(), message, errors.New("bad json")); err == nil {
+		t.Fatal("handler must fail once there are too many poison messages")
+	}
+	if handler.Count() != 3 {
+		t.Fatalf("unexpected count; got %d, want 3", handler.Count())
+	}
+}
+
+func TestPoisonHandlerWindow(t *testing.T) {
+	cfg := config.Default().Kafka
+	cfg.PoisonPolicy = config.PoisonPolicySkip
+	cfg.MaxPoisonMessages = 2
+	cfg.PoisonWindow = time.Millisecond * 50
+
+	handler := NewPoisonHandler(cfg, kafka.DefaultDialer, zap.NewNop())
+	defer handler.Close()
+
+	message := kafka.Message{Topic: "tweets", Value: []byte("{not json")}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < cfg.MaxPoisonMessages; j++ {
+			if err := handler.Handle(context.Background(), message, errors.New("bad json")); err != nil {
+				t.Fatalf("message %d of window %d must be skipped; got %s", j, i, err)
+			}
+		}
+		time.Sleep(cfg.PoisonWindow)
+	}
+	if handler.Count() != 6 {
+		t.Fatalf("unexpected count; got %d, want 6", handler.Count())
+	}
+}
@@ -0,0 +1,668 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// protoFile is a parsed .proto schema: messages with their fields, enough to decode protobuf wire format without
+// generated code. Options, services and extensions are skipped, groups are not supported.
+type protoFile struct {
+	pkg      string
+	messages []*protoMessage // top-level ones, in order of declaration, as Confluent message indexes refer to them
+	enums    []*protoEnum
+}
+
+type protoMessage struct {
+	name     string // full name, e.g. pkg.Outer.Inner
+	fields   map[uint64]*protoField
+	messages []*protoMessage // nested ones, in order of declaration
+	enums    []*protoEnum
+}
+
+type protoField struct {
+	name     string
+	repeated bool
+	kind     string // scalar type, or the type name as written in the schema until it is resolved
+	message  *protoMessage
+	enum     *protoEnum
+	key      *protoField // of maps, which are repeated messages of key and value on the wire
+	value    *protoField
+}
+
+type protoEnum struct {
+	name   string
+	values map[int32]string
+}
+
+var protoScalars = map[string]bool{
+	"double": true, "float": true, "int32": true, "int64": true, "uint32": true, "uint64": true, "sint32": true,
+	"sint64": true, "fixed32": true, "fixed64": true, "sfixed32": true, "sfixed64": true, "bool": true,
+	"string": true, "bytes": true,
+}
+
+// Well-known types producers use without references to them in the registry. Timestamps are decoded as RFC 3339
+// time, wrappers as their values.
+const wellKnownProto = `
+syntax = "proto3";
+package google.protobuf;
+message Timestamp { int64 seconds = 1; int32 nanos = 2; }
+message Duration { int64 seconds = 1; int32 nanos = 2; }
+message Empty {}
+message DoubleValue { double value = 1; }
+message FloatValue { float value = 1; }
+message Int64Value { int64 value = 1; }
+message UInt64Value { uint64 value = 1; }
+message Int32Value { int32 value = 1; }
+message UInt32Value { uint32 value = 1; }
+message BoolValue { bool value = 1; }
+message StringValue { string value = 1; }
+message BytesValue { bytes value = 1; }
+`
+
+const protoTimestamp = "google.protobuf.Timestamp"
+
+func parseProto(source string) (*protoFile, error) {
+	parser := &protoParser{tokens: tokenizeProto(source)}
+	file, err := parser.file()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse protobuf schema at %q", parser.peek())
+	}
+	return file, nil
+}
+
+type protoParser struct {
+	tokens []string
+	pkg    string
+}
+
+func (p *protoParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *protoParser) next() string {
+	token := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return token
+}
+
+func (p *protoParser) expect(token string) error {
+	if got := p.next(); got != token {
+		return errors.Errorf("expected %q, got %q", token, got)
+	}
+	return nil
+}
+
+func (p *protoParser) file() (*protoFile, error) {
+	file := &protoFile{}
+	for len(p.tokens) > 0 {
+		switch token := p.next(); token {
+		case "package":
+			p.pkg = p.next()
+			file.pkg = p.pkg
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		case "message":
+			message, err := p.message(p.pkg)
+			if err != nil {
+				return nil, err
+			}
+			file.messages = append(file.messages, message)
+		case "enum":
+			enum, err := p.enum(p.pkg)
+			if err != nil {
+				return nil, err
+			}
+			file.enums = append(file.enums, enum)
+		case "syntax", "edition", "import", "option", "service", "extend":
+			p.skip()
+		case ";":
+		default:
+			return nil, errors.Errorf("unexpected %q", token)
+		}
+	}
+	return file, nil
+}
+
+// skip skips a statement up to its semicolon, or a block up to its closing brace
+func (p *protoParser) skip() {
+	depth := 0
+	for len(p.tokens) > 0 {
+		switch p.next() {
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth == 0 {
+				return
+			}
+		case ";":
+			if depth == 0 {
+				return
+			}
+		}
+	}
+}
+
+func (p *protoParser) message(scope string) (*protoMessage, error) {
+	message := &protoMessage{name: protoFullName(scope, p.next()), fields: map[uint64]*protoField{}}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		switch token := p.peek(); token {
+		case "}":
+			p.next()
+			return message, nil
+		case "":
+			return nil, errors.Errorf("message %s is not closed", message.name)
+		case ";":
+			p.next()
+		case "message":
+			p.next()
+			nested, err := p.message(message.name)
+			if err != nil {
+				return nil, err
+			}
+			message.messages = append(message.messages, nested)
+		case "enum":
+			p.next()
+			enum, err := p.enum(message.name)
+			if err != nil {
+				return nil, err
+			}
+			message.enums = append(message.enums, enum)
+		case "oneof":
+			// fields of a oneof are fields of the message, at most one of them is set
+			p.next()
+			p.next()
+			if err := p.expect("{"); err != nil {
+				return nil, err
+			}
+			for p.peek() != "}" && p.peek() != "" {
+				if p.peek() == "option" || p.peek() == ";" {
+					p.skip()
+					continue
+				}
+				if err := p.field(message); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+		case "option", "reserved", "extensions", "extend":
+			p.skip()
+		case "group":
+			return nil, errors.Errorf("groups are not supported, message %s", message.name)
+		default:
+			if err := p.field(message); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// field parses `[label] type name = number [options];` or `map<key, value> name = number [options];`
+func (p *protoParser) field(message *protoMessage) error {
+	field := &protoField{}
+	switch p.peek() {
+	case "repeated":
+		field.repeated = true
+		p.next()
+	case "optional", "required":
+		p.next()
+	}
+
+	if p.peek() == "map" && len(p.tokens) > 1 && p.tokens[1] == "<" {
+		p.next()
+		p.next()
+		field.key = &protoField{name: "key", kind: p.next()}
+		if err := p.expect(","); err != nil {
+			return err
+		}
+		field.value = &protoField{name: "value", kind: p.next()}
+		if err := p.expect(">"); err != nil {
+			return err
+		}
+		field.kind, field.repeated = "map", true
+	} else {
+		field.kind = p.next()
+	}
+
+	field.name = p.next()
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	number, err := strconv.ParseUint(p.next(), 0, 29)
+	if err != nil {
+		return errors.Errorf("invalid number of field %s.%s", message.name, field.name)
+	}
+	if p.peek() == "[" {
+		for p.peek() != "]" && p.peek() != "" {
+			p.next()
+		}
+		p.next()
+	}
+	message.fields[number] = field
+	return p.expect(";")
+}
+
+func (p *protoParser) enum(scope string) (*protoEnum, error) {
+	enum := &protoEnum{name: protoFullName(scope, p.next()), values: map[int32]string{}}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		switch token := p.next(); token {
+		case "}":
+			return enum, nil
+		case "":
+			return nil, errors.Errorf("enum %s is not closed", enum.name)
+		case ";":
+		case "option", "reserved":
+			p.skip()
+		default:
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			number := p.next()
+			if number == "-" {
+				number += p.next()
+			}
+			value, err := strconv.ParseInt(number, 0, 32)
+			if err != nil {
+				return nil, errors.Errorf("invalid value of %s.%s", enum.name, token)
+			}
+			// with allow_alias, the first name of a value wins
+			if _, ok := enum.values[int32(value)]; !ok {
+				enum.values[int32(value)] = token
+			}
+			if p.peek() == "[" {
+				for p.peek() != "]" && p.peek() != "" {
+					p.next()
+				}
+				p.next()
+			}
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func protoFullName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// tokenizeProto splits the source into identifiers (with dots), numbers, strings and symbols, without comments
+func tokenizeProto(source string) []string {
+	var tokens []string
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(source[i:], "/*"):
+			end := strings.Index(source[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(source) && rune(source[j]) != c {
+				if source[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(source) {
+				j = len(source) - 1
+			}
+			tokens = append(tokens, source[i:j+1])
+			i = j + 1
+		case c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i
+			for j < len(source) && (source[j] == '_' || source[j] == '.' || unicode.IsLetter(rune(source[j])) || unicode.IsDigit(rune(source[j]))) {
+				j++
+			}
+			tokens = append(tokens, source[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+// wellKnownTypes are parsed once, and resolved along with every schema
+var wellKnownTypes = func() *protoFile {
+	file, err := parseProto(wellKnownProto)
+	if err != nil {
+		panic(err)
+	}
+	return file
+}()
+
+// resolveProto resolves type names of fields into messages and enums of the files and of well-known types
+func resolveProto(files []*protoFile) error {
+	messages, enums := map[string]*protoMessage{}, map[string]*protoEnum{}
+	var collect func(nested []*protoMessage, nestedEnums []*protoEnum)
+	collect = func(nested []*protoMessage, nestedEnums []*protoEnum) {
+		for _, message := range nested {
+			messages[message.name] = message
+			collect(message.messages, message.enums)
+		}
+		for _, enum := range nestedEnums {
+			enums[enum.name] = enum
+		}
+	}
+	collect(wellKnownTypes.messages, wellKnownTypes.enums)
+	for _, file := range files {
+		collect(file.messages, file.enums)
+	}
+
+	// names are looked up from the innermost scope outwards, e.g. Inner in pkg.Outer is pkg.Outer.Inner, pkg.Inner
+	// or Inner; names starting with a dot are full names
+	resolve := func(field *protoField, scope string) error {
+		if protoScalars[field.kind] || field.kind == "map" {
+			return nil
+		}
+		name := field.kind
+		for {
+			candidate := protoFullName(scope, name)
+			if strings.HasPrefix(name, ".") {
+				candidate = name[1:]
+			}
+			if field.message = messages[candidate]; field.message != nil {
+				return nil
+			}
+			if field.enum = enums[candidate]; field.enum != nil {
+				return nil
+			}
+			if scope == "" || strings.HasPrefix(name, ".") {
+				return errors.Errorf("unknown protobuf type %s of field %s", name, field.name)
+			}
+			if i := strings.LastIndex(scope, "."); i >= 0 {
+				scope = scope[:i]
+			} else {
+				scope = ""
+			}
+		}
+	}
+
+	for _, message := range messages {
+		for _, field := range message.fields {
+			for _, f := range []*protoField{field, field.key, field.value} {
+				if f == nil {
+					continue
+				}
+				if err := resolve(f, message.name); err != nil {
+					return errors.Wrapf(err, "message %s", message.name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf message is truncated")
+
+// decode decodes protobuf wire format of the message into a document with fields named as in the schema.
+// Fields that are not set (or set to default values in proto3) are left out.
+func (m *protoMessage) decode(data []byte) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errProtoTruncated
+		}
+		data = data[n:]
+		number, wireType := key>>3, key&7
+
+		var raw uint64
+		var bytes []byte
+		switch wireType {
+		case wireVarint:
+			raw, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errProtoTruncated
+			}
+		case wireFixed64:
+			if n = 8; len(data) < n {
+				return nil, errProtoTruncated
+			}
+			raw = binary.LittleEndian.Uint64(data)
+		case wireFixed32:
+			if n = 4; len(data) < n {
+				return nil, errProtoTruncated
+			}
+			raw = uint64(binary.LittleEndian.Uint32(data))
+		case wireBytes:
+			size, k := binary.Uvarint(data)
+			if k <= 0 || uint64(len(data)-k) < size {
+				return nil, errProtoTruncated
+			}
+			bytes, n = data[k:k+int(size)], k+int(size)
+		default:
+			return nil, errors.Errorf("unsupported protobuf wire type %d of field %d", wireType, number)
+		}
+		data = data[n:]
+
+		field := m.fields[number]
+		if field == nil {
+			// unknown fields are skipped, as fields added to a newer schema
+			continue
+		}
+		if err := field.decode(doc, wireType, raw, bytes); err != nil {
+			return nil, errors.Wrapf(err, "field %s", field.name)
+		}
+	}
+	return doc, nil
+}
+
+// decode decodes a value of the field into the document; repeated scalars may come packed in one value
+func (f *protoField) decode(doc map[string]interface{}, wireType uint64, raw uint64, bytes []byte) error {
+	if f.kind == "map" {
+		entry := &protoMessage{fields: map[uint64]*protoField{1: f.key, 2: f.value}}
+		kv, err := entry.decode(bytes)
+		if err != nil {
+			return err
+		}
+		values, _ := doc[f.name].(map[string]interface{})
+		if values == nil {
+			values = map[string]interface{}{}
+			doc[f.name] = values
+		}
+		values[protoMapKey(f.key, kv["key"])] = kv["value"]
+		return nil
+	}
+
+	if wireType == wireBytes && f.repeated && f.packable() {
+		wireType = f.wireType()
+		for len(bytes) > 0 {
+			var n int
+			switch wireType {
+			case wireVarint:
+				raw, n = binary.Uvarint(bytes)
+				if n <= 0 {
+					return errProtoTruncated
+				}
+			case wireFixed64:
+				if n = 8; len(bytes) < n {
+					return errProtoTruncated
+				}
+				raw = binary.LittleEndian.Uint64(bytes)
+			case wireFixed32:
+				if n = 4; len(bytes) < n {
+					return errProtoTruncated
+				}
+				raw = uint64(binary.LittleEndian.Uint32(bytes))
+			}
+			bytes = bytes[n:]
+			value, err := f.decodeValue(wireType, raw, nil)
+			if err != nil {
+				return err
+			}
+			doc[f.name] = append(protoList(doc[f.name]), value)
+		}
+		return nil
+	}
+
+	value, err := f.decodeValue(wireType, raw, bytes)
+	if err != nil {
+		return err
+	}
+	if f.repeated {
+		doc[f.name] = append(protoList(doc[f.name]), value)
+	} else {
+		doc[f.name] = value
+	}
+	return nil
+}
+
+func (f *protoField) packable() bool {
+	return f.enum != nil || f.message == nil && f.kind != "string" && f.kind != "bytes"
+}
+
+// wireType of values of the field
+func (f *protoField) wireType() uint64 {
+	switch f.kind {
+	case "double", "fixed64", "sfixed64":
+		return wireFixed64
+	case "float", "fixed32", "sfixed32":
+		return wireFixed32
+	case "string", "bytes":
+		return wireBytes
+	}
+	if f.message != nil {
+		return wireBytes
+	}
+	return wireVarint
+}
+
+func (f *protoField) decodeValue(wireType uint64, raw uint64, bytes []byte) (interface{}, error) {
+	if expected := f.wireType(); wireType != expected {
+		return nil, errors.Errorf("wire type %d doesn't match type %s", wireType, f.kind)
+	}
+	if f.enum != nil {
+		if name, ok := f.enum.values[int32(raw)]; ok {
+			return name, nil
+		}
+		return integer(int64(int32(raw))), nil
+	}
+	if f.message != nil {
+		doc, err := f.message.decode(bytes)
+		if err != nil {
+			return nil, err
+		}
+		return wellKnownValue(f.message.name, doc), nil
+	}
+
+	switch f.kind {
+	case "double":
+		return float64Number(math.Float64frombits(raw))
+	case "float":
+		return float32Number(math.Float32frombits(uint32(raw)))
+	case "int32", "sfixed32":
+		return integer(int64(int32(raw))), nil
+	case "int64", "sfixed64":
+		return integer(int64(raw)), nil
+	case "uint32", "fixed32":
+		return integer(int64(uint32(raw))), nil
+	case "uint64", "fixed64":
+		return json.Number(strconv.FormatUint(raw, 10)), nil
+	case "sint32":
+		return integer(int64(int32(zigzag(raw)))), nil
+	case "sint64":
+		return integer(zigzag(raw)), nil
+	case "bool":
+		return raw != 0, nil
+	case "string":
+		return string(bytes), nil
+	case "bytes":
+		return bytes, nil
+	}
+	return nil, errors.Errorf("unknown protobuf type %s", f.kind)
+}
+
+func zigzag(raw uint64) int64 {
+	return int64(raw>>1) ^ -int64(raw&1)
+}
+
+// wellKnownValue turns well-known messages into what they stand for
+func wellKnownValue(name string, doc map[string]interface{}) interface{} {
+	if name == protoTimestamp {
+		// fields with default values, zero, are not on the wire
+		seconds, _ := doc["seconds"].(json.Number)
+		nanos, _ := doc["nanos"].(json.Number)
+		secondsValue, _ := seconds.Int64()
+		nanosValue, _ := nanos.Int64()
+		return time.Unix(secondsValue, nanosValue).UTC().Format(time.RFC3339Nano)
+	}
+	if strings.HasPrefix(name, "google.protobuf.") && strings.HasSuffix(name, "Value") {
+		return doc["value"]
+	}
+	return doc
+}
+
+func protoList(value interface{}) []interface{} {
+	list, _ := value.([]interface{})
+	return list
+}
+
+// protoMapKey makes a document field name of a map key, which may be of any integral type, bool or string;
+// keys with default values are not on the wire
+func protoMapKey(key *protoField, value interface{}) string {
+	switch {
+	case value != nil:
+		return fmt.Sprint(value)
+	case key.kind == "string":
+		return ""
+	case key.kind == "bool":
+		return "false"
+	}
+	return "0"
+}
+
+// message returns the message Confluent message indexes point to: indexes of a top-level message and then of
+// nested messages in it
+func (f *protoFile) message(indexes []int64) (*protoMessage, error) {
+	messages := f.messages
+	var message *protoMessage
+	for _, index := range indexes {
+		if index < 0 || index >= int64(len(messages)) {
+			return nil, errors.Errorf("protobuf schema has no message with indexes %v", indexes)
+		}
+		message = messages[index]
+		messages = message.messages
+	}
+	return message, nil
+}
@@ -2,47 +2,145 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"github.com/pkg/errors"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
 	"kafka-to-elastic-pipeline/pkg/types"
+	"strconv"
 )
 
-func ReadUsers(ctx context.Context, kafkaReader *kafka.Reader, sinkChannel chan types.User, logger *zap.Logger) error {
+// Read decodes kafka messages into records of the route.
+// Offsets of messages are not committed when reading, but once written records are acknowledged to the committer.
+// Messages that fail to decode are given to the poison handler, except those the schema of which is unavailable for
+// now: then the reader retries to decode the message, with backoff, until the registry is back, and reads nothing
+// else meanwhile. Tombstones (messages with null or empty value) become records without document.
+// While the gate (if any) is closed, messages are not fetched, so they wait in kafka.
+// Reading stops, with no error, when the context is cancelled.
+func Read(ctx context.Context, kafkaReader *kafka.Reader, committer *Committer, poison *PoisonHandler, gate Gate, route string, decode Decoder, registry *SchemaRegistry, sinkChannel chan *types.Record, logger *zap.Logger) error {
 	for {
-		message, err := kafkaReader.ReadMessage(ctx)
+		if gate != nil {
+			if err := gate.Wait(ctx); err != nil {
+				// reading is stopped
+				return nil
+			}
+		}
+		message, err := kafkaReader.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			// reading is stopped
+			return nil
+		}
 		if err != nil {
 			logger.Error("failed to read", zap.Error(err))
 			// the reader is closed
 			return err
 		}
+		metrics.MessagesRead.WithLabelValues(message.Topic, strconv.Itoa(message.Partition)).Inc()
 
-		var user types.User
-		err = json.Unmarshal(message.Value, &user)
+		var doc map[string]interface{}
+		for attempt := 1; len(message.Value) > 0; attempt++ {
+			doc, err = decode(ctx, message.Value)
+			if _, ok := errors.Cause(err).(*SchemaUnavailableError); !ok {
+				break
+			}
+			if ctx.Err() != nil {
+				// reading is stopped while fetching the schema
+				return nil
+			}
+			logger.Warn("failed to decode, retrying", zap.String("topic", message.Topic), zap.Int("partition", message.Partition),
+				zap.Int64("offset", message.Offset), zap.Int("attempt", attempt), zap.Error(err))
+			if err := registry.backoff(ctx, attempt); err != nil {
+				// the message is not tracked, so it is read again after restart
+				return nil
+			}
+		}
 		if err != nil {
-			logger.Error("failed to decode message", zap.Error(err))
-			return err
+			if err := poison.Handle(ctx, message, err); err != nil {
+				if ctx.Err() != nil {
+					// reading is stopped while publishing to the dead-letter queue; the message is not tracked, so
+					// it is read again after restart
+					return nil
+				}
+				return err
+			}
+			committer.Track(message).Ack()
+			continue
 		}
 
-		sinkChannel <- user
+		record := &types.Record{Route: route, Doc: doc, Key: string(message.Key), Time: message.Time, Offset: committer.Track(message)}
+		select {
+		case sinkChannel <- record:
+		case <-ctx.Done():
+			// the message is not acknowledged, so it is read again after restart
+			return nil
+		}
 	}
 }
 
-func ReadTweets(ctx context.Context, kafkaReader *kafka.Reader, sinkChannel chan types.Tweet, logger *zap.Logger) error {
-	for {
-		message, err := kafkaReader.ReadMessage(ctx)
-		if err != nil {
-			// the reader is closed
-			return err
+// Gate holds reading back while the pipeline can't go on, e.g. elasticsearch is unavailable
+type Gate interface {
+	// Wait waits until reading can go on, or the context is cancelled
+	Wait(ctx context.Context) error
+}
+
+// NewReaders creates readers of a topic.
+// With a consumer group configured there are `members` readers, and the group assigns topic partitions to them
+// (as well as to readers of other pipeline instances); otherwise there is a reader per partition of the topic.
+func NewReaders(ctx context.Context, cfg config.Kafka, dialer *kafka.Dialer, topic string, members int) ([]*kafka.Reader, error) {
+	readerConfig := kafka.ReaderConfig{
+		Brokers:  cfg.Brokers,
+		Dialer:   dialer,
+		GroupID:  cfg.GroupID,
+		Topic:    topic,
+		MinBytes: cfg.MinBytes,
+		MaxBytes: cfg.MaxBytes,
+	}
+
+	var readers []*kafka.Reader
+	if cfg.GroupID != "" {
+		for i := 0; i < members; i++ {
+			readers = append(readers, kafka.NewReader(readerConfig))
 		}
+		return readers, nil
+	}
 
-		var tweet types.Tweet
-		err = json.Unmarshal(message.Value, &tweet)
-		if err != nil {
-			logger.Error("failed to decode message", zap.Error(err))
-			return err
+	partitions, err := lookupPartitions(ctx, dialer, cfg.Brokers, topic)
+	if err != nil {
+		return nil, err
+	}
+	for _, partition := range partitions {
+		readerConfig.Partition = partition.ID
+		readers = append(readers, kafka.NewReader(readerConfig))
+	}
+	return readers, nil
+}
+
+// Asks brokers one by one for partitions of the topic, until one of them answers
+func lookupPartitions(ctx context.Context, dialer *kafka.Dialer, brokers []string, topic string) (partitions []kafka.Partition, err error) {
+	for _, broker := range brokers {
+		partitions, err = dialer.LookupPartitions(ctx, "tcp", broker, topic)
+		if err == nil {
+			return partitions, nil
 		}
+	}
+	return nil, errors.Wrapf(err, "failed to lookup partitions of topic %s", topic)
+}
 
-		sinkChannel <- tweet
+// EndOffset asks brokers one by one for the offset the next message of the partition will get, until one of them
+// answers
+func EndOffset(ctx context.Context, dialer *kafka.Dialer, brokers []string, topic string, partition int) (offset int64, err error) {
+	for _, broker := range brokers {
+		var conn *kafka.Conn
+		conn, err = dialer.DialLeader(ctx, "tcp", broker, topic, partition)
+		if err != nil {
+			continue
+		}
+		offset, err = conn.ReadLastOffset()
+		conn.Close()
+		if err == nil {
+			return offset, nil
+		}
 	}
+	return 0, errors.Wrapf(err, "failed to read end offset of partition %d of topic %s", partition, topic)
 }
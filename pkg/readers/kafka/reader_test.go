@@ -2,6 +2,7 @@ package kafka
 
 import (
 	"context"
+	"encoding/json"
 	kafkaGo "github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
 	"kafka-to-elastic-pipeline/config"
@@ -13,16 +14,23 @@ import (
 )
 
 func TestReadTweets(t *testing.T) {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+	dialer := testDialer(t, cfg.Kafka)
+
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
-	tweetChan := make(chan types.Tweet)
+	tweetChan := make(chan *types.Record)
 
 	tweetsReader := kafkaGo.NewReader(kafkaGo.ReaderConfig{
-		Brokers:   config.KafkaBrokers,
+		Brokers:   cfg.Kafka.Brokers,
+		Dialer:    dialer,
 		Partition: 0,
-		Topic:     config.KafkaTweetsTopic,
+		Topic:     cfg.Route("tweets").Topic,
 		MinBytes:  1,
 		MaxBytes:  10e6,
 	})
@@ -34,15 +42,15 @@ func TestReadTweets(t *testing.T) {
 
 	// Create as many tweets in kafka as there are partitions.
 	// Round-robin will put one tweet into partition 0
-	if err := test_data.CreateTweetsInKafka(config.NumPartitionsKafkaTweetsTopic); err != nil {
+	if err := test_data.CreateTweetsInKafka(cfg.Kafka, dialer, cfg.Route("tweets").Topic, test_data.TweetsPartitions); err != nil {
 		log.Fatalf("failed to create tweets in kafka: %s", err)
 	}
 
-	go ReadTweets(ctx, tweetsReader, tweetChan, logger)
+	go Read(ctx, tweetsReader, NewCommitter(tweetsReader, logger), NewPoisonHandler(cfg.Kafka, dialer, logger), nil, "tweets", jsonDecoder, nil, tweetChan, logger)
 
 	select {
 	case tweet := <-tweetChan:
-		if tweet.RemoteAddress == "" || tweet.Tags == nil || tweet.User == nil || tweet.Message == "" {
+		if tweet.Doc["RemoteAddress"] == nil || tweet.Doc["Tags"] == nil || tweet.Doc["User"] == nil || tweet.Doc["Message"] == nil {
 			t.Fatal("some tweet fields are not set")
 		}
 	case <-ctx.Done():
@@ -51,16 +59,23 @@ func TestReadTweets(t *testing.T) {
 }
 
 func TestReadUsers(t *testing.T) {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+	dialer := testDialer(t, cfg.Kafka)
+
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
-	userChan := make(chan types.User)
+	userChan := make(chan *types.Record)
 
 	usersReader := kafkaGo.NewReader(kafkaGo.ReaderConfig{
-		Brokers:   config.KafkaBrokers,
+		Brokers:   cfg.Kafka.Brokers,
+		Dialer:    dialer,
 		Partition: 0,
-		Topic:     config.KafkaUsersTopic,
+		Topic:     cfg.Route("users").Topic,
 		MinBytes:  1,
 		MaxBytes:  10e6,
 	})
@@ -70,15 +85,15 @@ func TestReadUsers(t *testing.T) {
 		t.Fatalf("Failed to initilaize logger: %s", err)
 	}
 
-	if err := test_data.CreateUsersInKafka(config.NumPartitionsKafkaUsersTopic); err != nil {
+	if err := test_data.CreateUsersInKafka(cfg.Kafka, dialer, cfg.Route("users").Topic, test_data.UsersPartitions); err != nil {
 		log.Fatalf("failed to create users in kafka: %s", err)
 	}
 
-	go ReadUsers(ctx, usersReader, userChan, logger)
+	go Read(ctx, usersReader, NewCommitter(usersReader, logger), NewPoisonHandler(cfg.Kafka, dialer, logger), nil, "users", jsonDecoder, nil, userChan, logger)
 
 	select {
 	case user := <-userChan:
-		if user.Id == "" || user.Name == "" {
+		if user.Doc["Id"] == nil || user.Doc["Name"] == nil {
 			t.Fatal("some user fields are not set")
 		}
 	case <-ctx.Done():
@@ -86,9 +101,31 @@ func TestReadUsers(t *testing.T) {
 	}
 }
 
+func TestDecode(t *testing.T) {
+	doc, err := decodeJSON([]byte(`{"Message":"hello","Likes":12345678901234567890}`))
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+	if doc["Message"] != "hello" || doc["Likes"].(json.Number).String() != "12345678901234567890" {
+		t.Fatalf("unexpected document %v", doc)
+	}
+
+	for _, value := range []string{`{not json`, `null`, `[1, 2]`} {
+		if _, err := decodeJSON([]byte(value)); err == nil {
+			t.Fatalf("%s must fail to decode", value)
+		}
+	}
+}
+
 // Benchmark tweets reader. Users reader should perform more or less the same.
 func BenchmarkReader(b *testing.B) {
-	if err := test_data.CreateTweetsInKafka(int32(b.N * config.NumPartitionsKafkaTweetsTopic)); err != nil {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		b.Fatalf("Failed to load config: %s", err)
+	}
+	dialer := testDialer(b, cfg.Kafka)
+
+	if err := test_data.CreateTweetsInKafka(cfg.Kafka, dialer, cfg.Route("tweets").Topic, int32(b.N*test_data.TweetsPartitions)); err != nil {
 		log.Fatalf("failed to create tweets in kafka: %s", err)
 	}
 
@@ -96,12 +133,13 @@ func BenchmarkReader(b *testing.B) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
 	defer cancel()
 
-	tweetChan := make(chan types.Tweet)
+	tweetChan := make(chan *types.Record)
 
 	tweetsReader := kafkaGo.NewReader(kafkaGo.ReaderConfig{
-		Brokers:   config.KafkaBrokers,
+		Brokers:   cfg.Kafka.Brokers,
+		Dialer:    dialer,
 		Partition: 0,
-		Topic:     config.KafkaTweetsTopic,
+		Topic:     cfg.Route("tweets").Topic,
 		MinBytes:  1,
 		MaxBytes:  10e6,
 	})
@@ -111,7 +149,7 @@ func BenchmarkReader(b *testing.B) {
 		b.Fatalf("Failed to initilaize logger: %s", err)
 	}
 
-	go ReadTweets(ctx, tweetsReader, tweetChan, logger)
+	go Read(ctx, tweetsReader, NewCommitter(tweetsReader, logger), NewPoisonHandler(cfg.Kafka, dialer, logger), nil, "tweets", jsonDecoder, nil, tweetChan, logger)
 
 	for i := 0; i < b.N; i++ {
 		select {
@@ -121,3 +159,12 @@ func BenchmarkReader(b *testing.B) {
 		}
 	}
 }
+
+// testDialer connects to kafka of the configuration, secured or not
+func testDialer(t testing.TB, cfg config.Kafka) *kafkaGo.Dialer {
+	dialer, _, err := NewDialer(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create kafka dialer: %s", err)
+	}
+	return dialer
+}
@@ -0,0 +1,236 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"kafka-to-elastic-pipeline/config"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schema types of the registry; avro schemas come without a type
+const (
+	schemaTypeAvro     = "AVRO"
+	schemaTypeProtobuf = "PROTOBUF"
+	schemaTypeJSON     = "JSON"
+)
+
+// SchemaRegistry fetches schemas of messages in Confluent wire format by their IDs, and caches them parsed
+type SchemaRegistry struct {
+	url    string
+	client *http.Client
+	cfg    config.SchemaRegistry
+
+	mutex   sync.Mutex
+	schemas map[int32]*schemaFetch
+}
+
+// schemaFetch is the result of fetching a schema, once done: the schema, or the error if it is not found or invalid.
+// Fetches failed because the registry is unavailable are not kept, so the schema is fetched again next time.
+type schemaFetch struct {
+	done   chan struct{}
+	schema *schema
+	err    error
+}
+
+// schema is a parsed schema of the registry; protobuf messages are chosen by message indexes of every message
+type schema struct {
+	schemaType string
+	avro       *avroType
+	protobuf   *protoFile
+}
+
+// SchemaUnavailableError means that the schema of a message can't be fetched for now (the registry is down);
+// the message itself may be fine, so unlike messages that fail to decode, it is not poison
+type SchemaUnavailableError struct {
+	err error
+}
+
+func (e *SchemaUnavailableError) Error() string {
+	return "schema registry is unavailable: " + e.err.Error()
+}
+
+func NewSchemaRegistry(cfg config.SchemaRegistry) *SchemaRegistry {
+	return &SchemaRegistry{
+		url:     strings.TrimSuffix(cfg.URL, "/"),
+		client:  &http.Client{Timeout: cfg.Timeout},
+		cfg:     cfg,
+		schemas: map[int32]*schemaFetch{},
+	}
+}
+
+// registrySchema is a schema as the registry returns it
+type registrySchema struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType"`
+	References []struct {
+		Name    string `json:"name"`
+		Subject string `json:"subject"`
+		Version int    `json:"version"`
+	} `json:"references"`
+}
+
+// schema returns the schema with the ID, fetching it from the registry the first time.
+// A schema is fetched once at a time: decoders wanting it meanwhile wait for the fetch, while others go on.
+// A fetch cancelled with the context counts as the registry unavailable, so the schema is fetched again next time.
+func (r *SchemaRegistry) schema(ctx context.Context, id int32) (*schema, error) {
+	r.mutex.Lock()
+	fetch, ok := r.schemas[id]
+	if !ok {
+		fetch = &schemaFetch{done: make(chan struct{})}
+		r.schemas[id] = fetch
+	}
+	r.mutex.Unlock()
+
+	if !ok {
+		fetch.schema, fetch.err = r.fetch(ctx, id)
+		if _, unavailable := errors.Cause(fetch.err).(*SchemaUnavailableError); unavailable {
+			r.mutex.Lock()
+			delete(r.schemas, id)
+			r.mutex.Unlock()
+		}
+		close(fetch.done)
+	}
+	select {
+	case <-fetch.done:
+		return fetch.schema, fetch.err
+	case <-ctx.Done():
+		return nil, &SchemaUnavailableError{ctx.Err()}
+	}
+}
+
+// backoff waits before the next attempt to fetch a schema while the registry is unavailable, exponentially longer
+// with every attempt; it returns the error of the context if it is cancelled meanwhile
+func (r *SchemaRegistry) backoff(ctx context.Context, attempt int) error {
+	d := r.cfg.RetryBackoff << uint(attempt-1)
+	if d > r.cfg.MaxRetryBackoff || d <= 0 {
+		d = r.cfg.MaxRetryBackoff
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetch fetches the schema with the ID, and schemas it references, and parses it
+func (r *SchemaRegistry) fetch(ctx context.Context, id int32) (*schema, error) {
+	var main registrySchema
+	if err := r.get(ctx, fmt.Sprintf("/schemas/ids/%d", id), &main); err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch schema %d", id)
+	}
+
+	// Referenced schemas (imported protobuf files, or avro named types) go before the schema that uses them
+	var sources []registrySchema
+	if err := r.references(ctx, main, &sources, map[string]bool{}); err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch references of schema %d", id)
+	}
+	sources = append(sources, main)
+
+	s, err := parseSchema(sources)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse schema %d", id)
+	}
+	return s, nil
+}
+
+// references appends schemas the schema refers to, and schemas they refer to, in order of dependencies
+func (r *SchemaRegistry) references(ctx context.Context, s registrySchema, sources *[]registrySchema, seen map[string]bool) error {
+	for _, reference := range s.References {
+		path := fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(reference.Subject), reference.Version)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		var referenced registrySchema
+		if err := r.get(ctx, path, &referenced); err != nil {
+			return err
+		}
+		if err := r.references(ctx, referenced, sources, seen); err != nil {
+			return err
+		}
+		*sources = append(*sources, referenced)
+	}
+	return nil
+}
+
+// get decodes the response of the registry. Errors of the client (4xx, e.g. not found or not authorized) won't go
+// away with another request, except for timeouts and too many requests; those and all other errors are
+// SchemaUnavailableError.
+func (r *SchemaRegistry) get(ctx context.Context, path string, result interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, r.url+path, nil)
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return &SchemaUnavailableError{err}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return errors.Errorf("%s is not found in schema registry", path)
+	case response.StatusCode == http.StatusRequestTimeout, response.StatusCode == http.StatusTooManyRequests:
+		return &SchemaUnavailableError{errors.Errorf("%s: %s", path, response.Status)}
+	case response.StatusCode >= 400 && response.StatusCode < 500:
+		return errors.Errorf("schema registry refused %s: %s", path, response.Status)
+	case response.StatusCode != http.StatusOK:
+		return &SchemaUnavailableError{errors.Errorf("%s: %s", path, response.Status)}
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return &SchemaUnavailableError{errors.Wrapf(err, "failed to decode %s", path)}
+	}
+	return nil
+}
+
+// parseSchema parses the last of the sources, which may use types of the others
+func parseSchema(sources []registrySchema) (*schema, error) {
+	main := sources[len(sources)-1]
+	s := &schema{schemaType: main.SchemaType}
+	if s.schemaType == "" {
+		s.schemaType = schemaTypeAvro
+	}
+
+	switch s.schemaType {
+	case schemaTypeAvro:
+		names := map[string]*avroType{}
+		for _, source := range sources {
+			t, err := parseAvro(source.Schema, names)
+			if err != nil {
+				return nil, err
+			}
+			s.avro = t
+		}
+	case schemaTypeProtobuf:
+		var files []*protoFile
+		for _, source := range sources {
+			file, err := parseProto(source.Schema)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+		if err := resolveProto(files); err != nil {
+			return nil, err
+		}
+		s.protobuf = files[len(files)-1]
+	case schemaTypeJSON:
+		// messages are JSON as they are, the schema is not needed to decode them
+	default:
+		return nil, errors.Errorf("unknown schema type %q", s.schemaType)
+	}
+	return s, nil
+}
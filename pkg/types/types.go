@@ -1,23 +1,54 @@
 package types
 
-type Tweet struct {
-	Message       string
-	User          *User
-	Tags          []string
-	RemoteAddress string
-}
+import "time"
+
+// Tweet and User are messages of the default topics; the pipeline itself handles them as records.
 
-type EnrichedTweet struct {
+type Tweet struct {
 	Message       string
 	User          *User
 	Tags          []string
 	RemoteAddress string
-
-	City    map[string]string
-	Country map[string]string
 }
 
 type User struct {
 	Name string
 	Id   string
 }
+
+// Record is an object on its way from kafka to elastic: a decoded message, that enrichers add data to.
+type Record struct {
+	Route  string                 // name of the route the record goes by
+	Doc    map[string]interface{} // nil for tombstones
+	Key    string                 // key of the kafka message
+	Time   time.Time              // time of the kafka message
+	Offset Offset
+}
+
+// Tombstone tells if the record is read from a message with null value, which means that the object with the key
+// is deleted
+func (r *Record) Tombstone() bool {
+	return r.Doc == nil
+}
+
+// Offset is position of the kafka message a record was read from.
+// Records carry it through the pipeline, so that the message is committed only after the record is written.
+type Offset struct {
+	Topic     string
+	Partition int
+	Offset    int64
+
+	Acker Acker
+}
+
+// Acker is notified when records are durably written
+type Acker interface {
+	Ack(offset Offset)
+}
+
+// Ack reports that the record read from this offset is durably written
+func (o Offset) Ack() {
+	if o.Acker != nil {
+		o.Acker.Ack(o)
+	}
+}
@@ -0,0 +1,360 @@
+package workers
+
+import (
+	"golang.org/x/sync/errgroup"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"sync"
+)
+
+// Pool runs workers of a stage, between `min` and `max` of them; their number is changed at runtime by the controller.
+// A worker gets a channel that is closed when the pool shrinks: then it finishes what it is doing and returns nil.
+// Once a worker returns by itself (its input is closed, or it failed), the pool doesn't change anymore.
+//
+// Workers of a partitioned pool get their own input channels instead, see NewPartitionedPool.
+type Pool struct {
+	name     string
+	min, max int
+	group    *errgroup.Group
+	work     func(quit <-chan struct{}) error
+
+	// of partitioned pools
+	in         <-chan *types.Record
+	laneWork   func(lane chan *types.Record) error
+	laneBuffer int
+	resized    chan struct{}            // tells the dispatcher the size is changed
+	acked      chan struct{}            // tells the dispatcher records of a partition are all acknowledged
+	inFlight   map[partition]int        // records sent to lanes and not acknowledged yet, by partitions
+	trackers   map[types.Acker]*tracker // by ackers of records, used by the dispatcher only
+
+	mutex   sync.Mutex
+	quits   []chan struct{} // of running workers
+	size    int             // of partitioned pools
+	stopped bool
+	running sync.WaitGroup
+}
+
+// NewPool starts `min` workers in the group
+func NewPool(name string, group *errgroup.Group, min, max int, work func(quit <-chan struct{}) error) *Pool {
+	if max < min {
+		max = min
+	}
+	pool := &Pool{name: name, min: min, max: max, group: group, work: work}
+	pool.Resize(min)
+	return pool
+}
+
+// NewPartitionedPool starts `min` workers in the group, and a dispatcher that sends records of `in` to them by kafka
+// partition, each worker having its own input channel (lane), so that records of a partition are handled by one
+// worker in order of offsets. Workers return once their lanes are closed.
+// Resizing adds or removes lanes only, other workers go on. Partitions are spread over lanes evenly, so some of them
+// move to added lanes, and partitions of removed lanes move to the rest. Records of a moving partition wait until
+// the ones sent to its previous lane are done with: acknowledged, or its worker has returned; meanwhile the
+// dispatcher doesn't send further. Once `in` is closed, all lanes are closed and the pool doesn't change anymore.
+func NewPartitionedPool(name string, group *errgroup.Group, min, max, laneBuffer int, in <-chan *types.Record, work func(lane chan *types.Record) error) *Pool {
+	if max < min {
+		max = min
+	}
+	pool := &Pool{name: name, min: min, max: max, group: group, in: in, laneWork: work, laneBuffer: laneBuffer,
+		resized: make(chan struct{}, 1), acked: make(chan struct{}, 1), inFlight: map[partition]int{},
+		trackers: map[types.Acker]*tracker{}, size: min}
+	pool.Resize(min)
+	pool.running.Add(1)
+	group.Go(pool.dispatch)
+	return pool
+}
+
+func (p *Pool) Name() string {
+	return p.name
+}
+
+func (p *Pool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.currentSize()
+}
+
+func (p *Pool) currentSize() int {
+	if p.laneWork != nil {
+		return p.size
+	}
+	return len(p.quits)
+}
+
+// Bounds returns min and max number of workers
+func (p *Pool) Bounds() (int, int) {
+	return p.min, p.max
+}
+
+// Resize starts or stops workers to have `size` of them, within bounds of the pool, and returns their new number.
+// Partitioned pools add or remove lanes once the dispatcher gets to it.
+func (p *Pool) Resize(size int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.stopped {
+		return p.currentSize()
+	}
+	if size < p.min {
+		size = p.min
+	}
+	if size > p.max {
+		size = p.max
+	}
+
+	if p.laneWork != nil {
+		if size != p.size {
+			p.size = size
+			select {
+			case p.resized <- struct{}{}:
+			default:
+			}
+		}
+		metrics.Workers.WithLabelValues(p.name).Set(float64(size))
+		return size
+	}
+
+	for len(p.quits) < size {
+		quit := make(chan struct{})
+		p.quits = append(p.quits, quit)
+		p.running.Add(1)
+		p.group.Go(func() error {
+			defer p.running.Done()
+			err := p.work(quit)
+			select {
+			case <-quit:
+			default:
+				p.mutex.Lock()
+				p.stopped = true
+				p.mutex.Unlock()
+			}
+			return err
+		})
+	}
+	for len(p.quits) > size {
+		last := len(p.quits) - 1
+		close(p.quits[last])
+		p.quits = p.quits[:last]
+	}
+
+	metrics.Workers.WithLabelValues(p.name).Set(float64(size))
+	return size
+}
+
+// partition is a kafka partition of a topic
+type partition struct {
+	topic     string
+	partition int
+}
+
+// lane is the input channel of a worker of a partitioned pool
+type lane struct {
+	records    chan *types.Record
+	partitions int           // assigned to the lane, including ones moving to it
+	done       chan struct{} // closed once the worker returns
+}
+
+// assignment is the lane of a partition; while the partition moves from another lane, `from` is that one
+type assignment struct {
+	lane, from *lane
+}
+
+// dispatch sends records of `in` to lanes of their partitions, and adds or removes lanes on resize, until `in` is
+// closed or a worker fails
+func (p *Pool) dispatch() error {
+	defer p.running.Done()
+
+	failed := make(chan struct{}) // closed once a worker fails; the failure is returned to the group by the worker
+	var fail sync.Once
+	var workers sync.WaitGroup
+	var lanes []*lane
+	assignments := map[partition]*assignment{}
+	defer func() {
+		for _, l := range lanes {
+			close(l.records)
+		}
+		workers.Wait()
+		p.mutex.Lock()
+		p.stopped = true
+		p.mutex.Unlock()
+	}()
+
+	// reassign moves the partition to another lane, unless it is there already
+	reassign := func(a *assignment, to *lane) {
+		if a.lane == to {
+			return
+		}
+		// while the partition moves already, no record is sent to a.lane yet: records still wait for the lane the
+		// partition moves from, unless it moves back there
+		if a.from == nil {
+			a.from = a.lane
+		} else if a.from == to {
+			a.from = nil
+		}
+		a.lane.partitions--
+		a.lane = to
+		to.partitions++
+	}
+	resize := func() {
+		p.mutex.Lock()
+		size := p.size
+		p.mutex.Unlock()
+
+		for len(lanes) < size {
+			l := &lane{records: make(chan *types.Record, p.laneBuffer), done: make(chan struct{})}
+			lanes = append(lanes, l)
+			workers.Add(1)
+			p.group.Go(func() error {
+				defer workers.Done()
+				defer close(l.done)
+				err := p.laneWork(l.records)
+				if err != nil {
+					fail.Do(func() { close(failed) })
+				}
+				return err
+			})
+		}
+		for len(lanes) > size {
+			removed := lanes[len(lanes)-1]
+			lanes = lanes[:len(lanes)-1]
+			close(removed.records)
+			for _, a := range assignments {
+				if a.lane == removed {
+					reassign(a, leastLoaded(lanes))
+				}
+			}
+		}
+		// partitions are moved one by one from the most loaded lane to the least loaded one, until they are even
+		for {
+			most, least := mostLoaded(lanes), leastLoaded(lanes)
+			if most.partitions-least.partitions <= 1 {
+				break
+			}
+			for _, a := range assignments {
+				if a.lane == most {
+					reassign(a, least)
+					break
+				}
+			}
+		}
+	}
+	resize()
+
+	for {
+		select {
+		case <-p.resized:
+			resize()
+		case <-failed:
+			return nil
+		case record, ok := <-p.in:
+			if !ok {
+				return nil
+			}
+			key := partition{record.Offset.Topic, record.Offset.Partition}
+			a, ok := assignments[key]
+			if !ok {
+				a = &assignment{lane: leastLoaded(lanes)}
+				a.lane.partitions++
+				assignments[key] = a
+			}
+			if a.from != nil {
+				if !p.drained(key, a.from, failed) {
+					return nil
+				}
+				a.from = nil
+			}
+			p.track(record, key)
+			select {
+			case a.lane.records <- record:
+			case <-failed:
+				return nil
+			}
+		}
+	}
+}
+
+// leastLoaded returns the lane with the fewest partitions
+func leastLoaded(lanes []*lane) *lane {
+	least := lanes[0]
+	for _, l := range lanes[1:] {
+		if l.partitions < least.partitions {
+			least = l
+		}
+	}
+	return least
+}
+
+// mostLoaded returns the lane with the most partitions
+func mostLoaded(lanes []*lane) *lane {
+	most := lanes[0]
+	for _, l := range lanes[1:] {
+		if l.partitions > most.partitions {
+			most = l
+		}
+	}
+	return most
+}
+
+// drained waits until records of the partition sent to lane `from` are done with: all of them are acknowledged, or
+// the worker of the lane has returned. It returns false if a worker fails meanwhile.
+func (p *Pool) drained(key partition, from *lane, failed <-chan struct{}) bool {
+	for {
+		p.mutex.Lock()
+		inFlight := p.inFlight[key]
+		p.mutex.Unlock()
+		if inFlight == 0 {
+			return true
+		}
+		select {
+		case <-p.acked:
+		case <-from.done:
+			return true
+		case <-failed:
+			return false
+		}
+	}
+}
+
+// track counts the record as in flight until it is acknowledged
+func (p *Pool) track(record *types.Record, key partition) {
+	t, ok := p.trackers[record.Offset.Acker]
+	if !ok {
+		t = &tracker{pool: p, next: record.Offset.Acker}
+		p.trackers[record.Offset.Acker] = t
+	}
+	record.Offset.Acker = t
+
+	p.mutex.Lock()
+	p.inFlight[key]++
+	p.mutex.Unlock()
+}
+
+// tracker is the acker of records sent to lanes: it counts them off and passes acknowledgements on to their own acker
+type tracker struct {
+	pool *Pool
+	next types.Acker
+}
+
+func (t *tracker) Ack(offset types.Offset) {
+	p := t.pool
+	key := partition{offset.Topic, offset.Partition}
+	p.mutex.Lock()
+	if p.inFlight[key] > 1 {
+		p.inFlight[key]--
+	} else {
+		delete(p.inFlight, key)
+		select {
+		case p.acked <- struct{}{}:
+		default:
+		}
+	}
+	p.mutex.Unlock()
+
+	offset.Acker = t.next
+	offset.Ack()
+}
+
+// Wait waits until all workers have returned by themselves
+func (p *Pool) Wait() {
+	p.running.Wait()
+}
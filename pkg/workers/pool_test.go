@@ -0,0 +1,199 @@
+package workers
+
+import (
+	"golang.org/x/sync/errgroup"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	var group errgroup.Group
+	var running int32
+	input := make(chan struct{})
+	pool := NewPool("test", &group, 2, 4, func(quit <-chan struct{}) error {
+		atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		select {
+		case <-quit:
+		case <-input:
+		}
+		return nil
+	})
+
+	waitRunning := func(want int32) {
+		for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&running) != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d workers running, want %d", atomic.LoadInt32(&running), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitRunning(2)
+
+	if size := pool.Resize(10); size != 4 {
+		t.Fatalf("pool must grow up to max; got %d workers", size)
+	}
+	waitRunning(4)
+	if size := pool.Resize(0); size != 2 {
+		t.Fatalf("pool must shrink down to min; got %d workers", size)
+	}
+	waitRunning(2)
+
+	// Once input is closed, workers return by themselves, and the pool doesn't grow anymore
+	close(input)
+	pool.Wait()
+	if size := pool.Resize(4); size != 2 {
+		t.Fatalf("pool must not change once workers are done; got %d workers", size)
+	}
+	if err := group.Wait(); err != nil {
+		t.Fatalf("pool failed: %s", err)
+	}
+	if n := atomic.LoadInt32(&running); n != 0 {
+		t.Fatalf("got %d workers running after the pool is done", n)
+	}
+}
+
+func TestPartitionedPool(t *testing.T) {
+	var group errgroup.Group
+	in := make(chan *types.Record)
+	var mutex sync.Mutex
+	handled := map[int][]int64{}
+	var started, returned int32
+	pool := NewPartitionedPool("test", &group, 2, 4, 10, in, func(lane chan *types.Record) error {
+		atomic.AddInt32(&started, 1)
+		defer atomic.AddInt32(&returned, 1)
+		for record := range lane {
+			time.Sleep(time.Duration(record.Offset.Offset%3) * time.Millisecond)
+			mutex.Lock()
+			handled[record.Offset.Partition] = append(handled[record.Offset.Partition], record.Offset.Offset)
+			mutex.Unlock()
+			record.Offset.Ack()
+		}
+		return nil
+	})
+
+	const partitions, offsets = 8, 60
+	for offset := int64(0); offset < offsets; offset++ {
+		switch offset {
+		case offsets / 3:
+			if size := pool.Resize(3); size != 3 {
+				t.Fatalf("pool must grow; got %d workers", size)
+			}
+		case offsets * 2 / 3:
+			if size := pool.Resize(2); size != 2 {
+				t.Fatalf("pool must shrink; got %d workers", size)
+			}
+		}
+		for partition := 0; partition < partitions; partition++ {
+			in <- &types.Record{Offset: types.Offset{Topic: "test", Partition: partition, Offset: offset}}
+		}
+	}
+	// only the removed worker returns, others go on
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&returned) != 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d workers returned, want the removed one", atomic.LoadInt32(&returned))
+		}
+	}
+	close(in)
+	pool.Wait()
+	if err := group.Wait(); err != nil {
+		t.Fatalf("pool failed: %s", err)
+	}
+
+	if started != 2+1 || returned != 3 {
+		t.Fatalf("got %d workers started and %d returned, want 2 and then one more", started, returned)
+	}
+	for partition := 0; partition < partitions; partition++ {
+		if len(handled[partition]) != offsets {
+			t.Fatalf("partition %d: got %d records handled, want %d", partition, len(handled[partition]), offsets)
+		}
+		for i, offset := range handled[partition] {
+			if offset != int64(i) {
+				t.Fatalf("partition %d: records handled out of order: %v", partition, handled[partition])
+			}
+		}
+	}
+	if size := pool.Resize(4); size != 2 {
+		t.Fatalf("pool must not change once workers are done; got %d workers", size)
+	}
+}
+
+// acks is the acker of records, counting acknowledgements
+type acks int32
+
+func (a *acks) Ack(offset types.Offset) {
+	atomic.AddInt32((*int32)(a), 1)
+}
+
+func TestPartitionedPoolMovesPartitionOnceAcknowledged(t *testing.T) {
+	var group errgroup.Group
+	in := make(chan *types.Record)
+	var mutex sync.Mutex
+	var lanes []chan *types.Record // records handled and not acknowledged yet, by lanes
+	pool := NewPartitionedPool("test", &group, 1, 2, 10, in, func(lane chan *types.Record) error {
+		held := make(chan *types.Record, 100)
+		mutex.Lock()
+		lanes = append(lanes, held)
+		mutex.Unlock()
+		for record := range lane {
+			held <- record
+		}
+		return nil
+	})
+	lane := func(i int) chan *types.Record {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for deadline := time.Now().Add(time.Second); len(lanes) <= i; {
+			if time.Now().After(deadline) {
+				t.Fatalf("lane %d is not started", i)
+			}
+			mutex.Unlock()
+			time.Sleep(time.Millisecond)
+			mutex.Lock()
+		}
+		return lanes[i]
+	}
+
+	var acker acks
+	send := func(offset int64) {
+		for partition := 0; partition < 2; partition++ {
+			in <- &types.Record{Offset: types.Offset{Topic: "test", Partition: partition, Offset: offset, Acker: &acker}}
+		}
+	}
+	send(0)
+	first := lane(0)
+	for len(first) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// one of partitions moves to the added lane, but its records wait for the first lane
+	pool.Resize(2)
+	go send(1)
+	time.Sleep(time.Millisecond * 50)
+	second := lane(1)
+	if len(second) != 0 {
+		t.Fatal("records of the moving partition must wait until the previous lane is done with them")
+	}
+
+	want := int32(1)
+	for ; len(first) > 0; want++ {
+		(<-first).Offset.Ack()
+	}
+	record := <-second
+	if record.Offset.Offset != 1 {
+		t.Fatalf("got offset %d in the added lane, want 1", record.Offset.Offset)
+	}
+	record.Offset.Ack()
+	if n := atomic.LoadInt32((*int32)(&acker)); n != want {
+		t.Fatalf("acknowledgements must be passed on to ackers of records; got %d, want %d", n, want)
+	}
+
+	close(in)
+	pool.Wait()
+	if err := group.Wait(); err != nil {
+		t.Fatalf("pool failed: %s", err)
+	}
+}
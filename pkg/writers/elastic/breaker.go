@@ -0,0 +1,126 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"sync"
+	"time"
+)
+
+// Breaker is the circuit breaker of ES, shared by all writers. Writers open it when ES is unavailable, and then wait
+// with the objects they have until it is closed; so do kafka readers, to keep messages in kafka rather than in memory.
+// While it is open, cluster health is probed, and once the cluster responds, the breaker is closed.
+type Breaker struct {
+	es            *elasticsearch.Client
+	probeInterval time.Duration
+	logger        *zap.Logger
+
+	mutex  sync.Mutex
+	closed chan struct{} // closed while the breaker is closed
+	opened chan struct{} // tells the prober the breaker is opened
+}
+
+func NewBreaker(es *elasticsearch.Client, probeInterval time.Duration, logger *zap.Logger) *Breaker {
+	closed := make(chan struct{})
+	close(closed)
+	return &Breaker{es: es, probeInterval: probeInterval, logger: logger, closed: closed, opened: make(chan struct{}, 1)}
+}
+
+// Open opens the breaker, unless it is open already, because of the error
+func (b *Breaker) Open(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		return
+	}
+	b.closed = make(chan struct{})
+	b.opened <- struct{}{}
+	metrics.BreakerOpen.Set(1)
+	b.logger.Error("elastic is unavailable, writing and reading are held back until it is back", zap.Error(err))
+}
+
+func (b *Breaker) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	close(b.closed)
+	metrics.BreakerOpen.Set(0)
+	b.logger.Info("elastic is back, writing and reading go on")
+}
+
+func (b *Breaker) isOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	select {
+	case <-b.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// Wait waits until the breaker is closed, or the context is cancelled
+func (b *Breaker) Wait(ctx context.Context) error {
+	b.mutex.Lock()
+	closed := b.closed
+	b.mutex.Unlock()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run probes cluster health every probe interval while the breaker is open, and closes it once a probe succeeds,
+// until the context is cancelled
+func (b *Breaker) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-b.opened:
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(b.probeInterval):
+			}
+			if err := b.probe(ctx); err != nil {
+				b.logger.Warn("elastic is still unavailable", zap.Error(err))
+				continue
+			}
+			b.close()
+			break
+		}
+	}
+}
+
+// probe asks for the cluster health. Any status will do: a red cluster still indexes into indices that are not red,
+// and objects of red ones are retried by writers.
+func (b *Breaker) probe(ctx context.Context) error {
+	res, err := b.es.Cluster.Health(b.es.Cluster.Health.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to get cluster health")
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return errors.Errorf("failed to get cluster health: %s", res.Status())
+	}
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return errors.Wrap(err, "failed to decode cluster health")
+	}
+	b.logger.Info("elastic cluster health", zap.String("status", health.Status))
+	return nil
+}
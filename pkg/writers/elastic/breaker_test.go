@@ -0,0 +1,90 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerHoldsObjectsWhileElasticIsDown(t *testing.T) {
+	var down int32 = 1
+	es, server := fakeBulk(t, func(doc string) int { return http.StatusCreated })
+	defer server.Close()
+	bulkHandler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case atomic.LoadInt32(&down) == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/_cluster/health":
+			fmt.Fprint(w, `{"status":"green"}`)
+		default:
+			bulkHandler.ServeHTTP(w, r)
+		}
+	})
+
+	cfg := config.Default().Elastic
+	cfg.MaxRetries = 0 // objects held by the breaker are not retried, and so never run out of retries
+	logger := zap.NewNop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	breaker := NewBreaker(es, time.Millisecond*10, logger)
+	go breaker.Run(ctx)
+
+	acker := &ackCounter{acks: map[int64]int{}}
+	var buffer []bufferEntity
+	for i := 0; i < 3; i++ {
+		buffer = append(buffer, bufferEntity{esIndex: "breaker", action: config.ActionIndex, data: []byte(`{"Message":"hello"}`),
+			offset: types.Offset{Offset: int64(i), Acker: acker}})
+	}
+	sink := &memorySink{}
+	done := make(chan struct{})
+	go func() {
+		_, _ = flush(ctx, cfg, buffer, &bytes.Buffer{}, es, breaker, nil, sink, logger)
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(time.Second); testutil.ToFloat64(metrics.BreakerOpen) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("breaker must open while elastic is down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case <-done:
+		t.Fatal("objects must be held while elastic is down")
+	default:
+	}
+	waitCtx, stopWaiting := context.WithTimeout(ctx, time.Millisecond*20)
+	defer stopWaiting()
+	if err := breaker.Wait(waitCtx); err == nil {
+		t.Fatal("readers must wait while elastic is down")
+	}
+
+	atomic.StoreInt32(&down, 0)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("objects must be written once elastic is back")
+	}
+	if err := breaker.Wait(ctx); err != nil || testutil.ToFloat64(metrics.BreakerOpen) != 0 {
+		t.Fatal("breaker must close once elastic is back")
+	}
+	if len(sink.objects) != 0 {
+		t.Fatalf("no object must fail; got %+v", sink.objects)
+	}
+	for offset := int64(0); offset < 3; offset++ {
+		if acker.acks[offset] != 1 {
+			t.Fatalf("offset %d is acknowledged %d times", offset, acker.acks[offset])
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Writes buffer to ES, building bulk requests in `body`, and returns the emptied buffer to be reused.
+// Objects ES is temporarily unable to index are retried with exponential backoff, objects that can't be indexed
+// are handed to the failure sink. Both written and handed objects are acknowledged.
+// When ES is unavailable, the breaker is opened, and the request is sent again, however many times, once it is closed.
+// With a spill (nil if none), objects are spilled instead while ES is unavailable or earlier objects are in the spill,
+// and so are objects still retryable after the last retry; spilled objects are acknowledged too.
+// If an object can't be handed to the failure sink either, the error is returned right away: the object is not
+// acknowledged, and committing offsets of its partition can't go on past it.
+func flush(ctx context.Context, cfg config.Elastic, buffer []bufferEntity, body *bytes.Buffer, es *elasticsearch.Client, breaker *Breaker, spill *Spill, sink FailureSink, logger *zap.Logger) ([]bufferEntity, error) {
+	if len(buffer) == 0 {
+		return buffer, nil
+	}
+	logger.Info(fmt.Sprintf("writing %d objects to ES", len(buffer)))
+
+	var stats struct{ succeeded, retried, spilled, failed int }
+	// toSpill spills the objects, if the spill has room for them
+	toSpill := func(objects []bufferEntity) bool {
+		if spill == nil || len(objects) == 0 {
+			return false
+		}
+		if err := spill.Append(objects); err != nil {
+			if err != errSpillFull {
+				logger.Error("failed to spill objects", zap.Error(err))
+			}
+			return false
+		}
+		stats.spilled += len(objects)
+		for _, el := range objects {
+			metrics.Documents.WithLabelValues(el.esIndex, "spilled").Inc()
+			el.offset.Ack()
+		}
+		return true
+	}
+	fail := func(el bufferEntity, result bulkItemResult) error {
+		stats.failed++
+		metrics.Documents.WithLabelValues(el.esIndex, "failed").Inc()
+		if err := sink.Failed(ctx, el.failure(result)); err != nil {
+			logger.Error("failed to hand object to failure sink", zap.String("index", el.esIndex), zap.Error(err))
+			return errors.Wrapf(err, "failed to hand object of %s to failure sink", el.esIndex)
+		}
+		el.offset.Ack()
+		return nil
+	}
+
+	pending := buffer
+attempts:
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			stats.retried += len(pending)
+			select {
+			case <-ctx.Done():
+				// Objects are not acknowledged, so their offsets are not committed and they are read again after restart
+				return buffer[:0], nil
+			case <-time.After(backoff(cfg, attempt)):
+			}
+		}
+
+		if spill != nil && spill.spilling() && toSpill(pending) {
+			break
+		}
+		if err := breaker.Wait(ctx); err != nil {
+			return buffer[:0], nil
+		}
+		results, err := bulk(ctx, pending, body, es, logger)
+		for err != nil {
+			if ctx.Err() != nil {
+				return buffer[:0], nil
+			}
+			breaker.Open(err)
+			if toSpill(pending) {
+				break attempts
+			}
+			if err := breaker.Wait(ctx); err != nil {
+				return buffer[:0], nil
+			}
+			results, err = bulk(ctx, pending, body, es, logger)
+		}
+
+		var retry, exhausted []bufferEntity
+		var exhaustedResults []bulkItemResult
+		// With ordering by partition, objects that follow a retried (or, once retries are over, spilled) object of
+		// their partition go along with it, even if they are written already; otherwise it would overwrite them
+		heldBack := map[partition]bool{}
+		for i, result := range results {
+			held := heldBack[partition{pending[i].offset.Topic, pending[i].offset.Partition}]
+			switch {
+			case held && attempt < cfg.MaxRetries:
+				metrics.Documents.WithLabelValues(pending[i].esIndex, "retried").Inc()
+				retry = append(retry, pending[i])
+
+			case held:
+				exhausted = append(exhausted, pending[i])
+				exhaustedResults = append(exhaustedResults, result)
+
+			case pending[i].succeeded(result):
+				stats.succeeded++
+				metrics.Documents.WithLabelValues(pending[i].esIndex, "succeeded").Inc()
+				pending[i].offset.Ack()
+
+			case result.retryable() && attempt < cfg.MaxRetries:
+				metrics.Documents.WithLabelValues(pending[i].esIndex, "retried").Inc()
+				retry = append(retry, pending[i])
+				heldBack[partition{pending[i].offset.Topic, pending[i].offset.Partition}] = cfg.Ordering == config.OrderingPartition
+
+			case result.retryable() && spill != nil:
+				exhausted = append(exhausted, pending[i])
+				exhaustedResults = append(exhaustedResults, result)
+				heldBack[partition{pending[i].offset.Topic, pending[i].offset.Partition}] = cfg.Ordering == config.OrderingPartition
+
+			default:
+				if err := fail(pending[i], result); err != nil {
+					return buffer[:0], err
+				}
+			}
+		}
+		if !toSpill(exhausted) {
+			for i, el := range exhausted {
+				if el.succeeded(exhaustedResults[i]) {
+					// held back, but written already, and not to be overwritten by the failed object before it
+					stats.succeeded++
+					metrics.Documents.WithLabelValues(el.esIndex, "succeeded").Inc()
+					el.offset.Ack()
+					continue
+				}
+				if err := fail(el, exhaustedResults[i]); err != nil {
+					return buffer[:0], err
+				}
+			}
+		}
+		pending = retry
+	}
+
+	logger.Info("objects written to ES", zap.Int("succeeded", stats.succeeded), zap.Int("retried", stats.retried), zap.Int("spilled", stats.spilled), zap.Int("failed", stats.failed))
+	return buffer[:0], nil
+}
+
+// Makes a single bulk request and returns results of all the objects, in the same order.
+// If the request as a whole fails, all the objects get the same result, or, if ES is unavailable, an error is returned.
+func bulk(ctx context.Context, buffer []bufferEntity, body *bytes.Buffer, es *elasticsearch.Client, logger *zap.Logger) ([]bulkItemResult, error) {
+	body.Reset()
+	for _, el := range buffer {
+		writeAction(body, el)
+	}
+
+	metrics.BulkSize.Observe(float64(body.Len()))
+
+	// Refresh makes objects immediately searchable; convenient for dev, can be slow for prod.
+	// The request is made as is rather than by esapi, so that it has GetBody: the transport sends the body again on
+	// retries, reading it from the buffer without copies.
+	req, err := http.NewRequest(http.MethodPost, "/_bulk?refresh=true", bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make bulk request")
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	started := time.Now()
+	res, err := es.Perform(req.WithContext(ctx))
+	metrics.BulkDuration.Observe(time.Since(started).Seconds())
+	if err != nil {
+		logger.Error("error making bulk request", zap.Error(err))
+		return nil, errors.Wrap(err, "error making bulk request")
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			logger.Error("failed to close response body", zap.Error(err))
+		}
+	}()
+
+	if res.StatusCode > 299 {
+		logger.Error("error making bulk request", zap.String("status", res.Status))
+		switch res.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return nil, errors.Errorf("error making bulk request: %s", res.Status)
+		}
+		return sameResults(len(buffer), bulkItemResult{Status: res.StatusCode, Error: errorJSON(res.Status)}), nil
+	}
+
+	var bulkRes bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&bulkRes); err != nil {
+		logger.Error("failed to decode bulk response", zap.Error(err))
+		return sameResults(len(buffer), bulkItemResult{Status: http.StatusBadGateway, Error: errorJSON(err.Error())}), nil
+	}
+	if len(bulkRes.Items) != len(buffer) {
+		logger.Error("unexpected number of items in bulk response", zap.Int("items", len(bulkRes.Items)), zap.Int("objects", len(buffer)))
+		return sameResults(len(buffer), bulkItemResult{Status: http.StatusBadGateway, Error: errorJSON("unexpected number of items in bulk response")}), nil
+	}
+
+	results := make([]bulkItemResult, len(buffer))
+	for i, item := range bulkRes.Items {
+		for _, result := range item {
+			results[i] = result
+		}
+	}
+	return results, nil
+}
+
+// Writes action line of the object and, unless it is deleted, source line
+func writeAction(body *bytes.Buffer, el bufferEntity) {
+	action := el.action
+	if action == config.ActionScript {
+		action = config.ActionUpdate
+	}
+	body.WriteString(`{"`)
+	body.WriteString(action)
+	body.WriteString(`" : { "_index" : `)
+	writeString(body, el.esIndex)
+	body.WriteString(`, "_type" : "_doc"`)
+	if el.id != "" {
+		body.WriteString(`, "_id" : `)
+		writeString(body, el.id)
+	}
+	body.WriteString(" }}\n")
+
+	switch el.action {
+	case actionDelete:
+		return
+	case config.ActionUpdate:
+		body.WriteString(`{"doc" : `)
+		body.Write(el.data)
+		body.WriteString(`, "doc_as_upsert" : true}`)
+	case config.ActionScript:
+		body.WriteString(`{"script" : {"source" : `)
+		writeString(body, el.script)
+		body.WriteString(`, "lang" : "painless", "params" : {"doc" : `)
+		body.Write(el.data)
+		body.WriteString(`}}, "upsert" : `)
+		body.Write(el.data)
+		body.WriteString(`}`)
+	default:
+		body.Write(el.data)
+	}
+	body.WriteString("\n")
+}
+
+// writeString writes s as JSON string; most strings (index names, IDs) need no escaping, and so no allocation
+func writeString(body *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == '"' || c == '\\' {
+			quoted, _ := json.Marshal(s)
+			body.Write(quoted)
+			return
+		}
+	}
+	body.WriteByte('"')
+	body.WriteString(s)
+	body.WriteByte('"')
+}
+
+// size is approximate size of the object in a bulk request
+func (e bufferEntity) size() int {
+	size := len(e.esIndex) + len(e.id) + len(e.data) + 64 // action line
+	if e.action == config.ActionScript {
+		size += len(e.script) + len(e.data)
+	}
+	return size
+}
+
+// Deleting a document that doesn't exist, or creating one that already does (e.g. when a message is read again),
+// leaves the index as it should be
+func (e bufferEntity) succeeded(result bulkItemResult) bool {
+	return result.succeeded() ||
+		e.action == actionDelete && result.Status == http.StatusNotFound ||
+		e.action == config.ActionCreate && result.Status == http.StatusConflict
+}
+
+// Bulk response is only decoded as far as needed to find out which objects are written
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"` // every item is a map from action name to its result
+}
+
+type bulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (r bulkItemResult) succeeded() bool {
+	return r.Status >= 200 && r.Status < 300
+}
+
+// Too many requests (e.g. es_rejected_execution_exception) and unavailability of the cluster are temporary;
+// other errors (mapping errors, version conflicts, etc.) won't go away with another attempt.
+func (r bulkItemResult) retryable() bool {
+	switch r.Status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func sameResults(n int, result bulkItemResult) []bulkItemResult {
+	results := make([]bulkItemResult, n)
+	for i := range results {
+		results[i] = result
+	}
+	return results
+}
+
+func errorJSON(reason string) json.RawMessage {
+	data, _ := json.Marshal(map[string]string{"reason": reason})
+	return data
+}
+
+// Exponential backoff with jitter, so that writers don't retry all at the same moment
+func backoff(cfg config.Elastic, attempt int) time.Duration {
+	d := cfg.RetryBackoff << uint(attempt-1)
+	if d > cfg.MaxRetryBackoff || d <= 0 {
+		d = cfg.MaxRetryBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,258 @@
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBulk answers bulk requests with item statuses returned by `status` for every document
+// (or action line, for deletes)
+func fakeBulk(t *testing.T, status func(doc string) int) (*elasticsearch.Client, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var items []map[string]bulkItemResult
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]json.RawMessage
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				t.Errorf("malformed action line %s", scanner.Text())
+				return
+			}
+			doc := scanner.Text()
+			if _, ok := action[actionDelete]; !ok {
+				if !scanner.Scan() {
+					break
+				}
+				doc = scanner.Text()
+			}
+			result := bulkItemResult{Status: status(doc)}
+			if !result.succeeded() {
+				result.Error = errorJSON("fake error")
+			}
+			for name := range action {
+				items = append(items, map[string]bulkItemResult{name: result})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(bulkResponse{Errors: true, Items: items})
+	}))
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+	return es, server
+}
+
+type ackCounter struct {
+	sync.Mutex
+	acks map[int64]int
+}
+
+func (a *ackCounter) Ack(offset types.Offset) {
+	a.Lock()
+	defer a.Unlock()
+	a.acks[offset.Offset]++
+}
+
+type memorySink struct {
+	objects []FailedObject
+}
+
+func (s *memorySink) Failed(ctx context.Context, object FailedObject) error {
+	s.objects = append(s.objects, object)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestFlushRetriesAndFailures(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[string]int{}
+	es, server := fakeBulk(t, func(doc string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[doc]++
+		switch {
+		case strings.Contains(doc, "overloaded") && attempts[doc] < 3:
+			return http.StatusTooManyRequests
+		case strings.Contains(doc, "unavailable"):
+			return http.StatusServiceUnavailable
+		case strings.Contains(doc, "malformed"):
+			return http.StatusBadRequest
+		}
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	cfg := config.Default().Elastic
+	cfg.MaxRetries = 3
+	cfg.RetryBackoff = time.Millisecond
+	cfg.MaxRetryBackoff = time.Millisecond * 5
+
+	acker := &ackCounter{acks: map[int64]int{}}
+	var buffer []bufferEntity
+	for i, doc := range []string{"ok", "overloaded", "unavailable", "malformed"} {
+		buffer = append(buffer, bufferEntity{
+			esIndex: "test",
+			action:  config.ActionIndex,
+			data:    []byte(fmt.Sprintf(`{"Message":"%s"}`, doc)),
+			offset:  types.Offset{Partition: i, Offset: int64(i), Acker: acker},
+		})
+	}
+
+	sink := &memorySink{}
+	logger := zap.NewNop()
+	buffer, err := flush(context.Background(), cfg, buffer, &bytes.Buffer{}, es, NewBreaker(es, time.Second, logger), nil, sink, logger)
+	if err != nil {
+		t.Fatalf("flush failed: %s", err)
+	}
+
+	if len(buffer) != 0 {
+		t.Fatalf("buffer is not emptied; got %d objects", len(buffer))
+	}
+	if attempts[`{"Message":"overloaded"}`] != 3 {
+		t.Fatalf("overloaded object must succeed on the 3rd attempt; got %d attempts", attempts[`{"Message":"overloaded"}`])
+	}
+	if attempts[`{"Message":"unavailable"}`] != cfg.MaxRetries+1 {
+		t.Fatalf("unavailable object must be retried %d times; got %d attempts", cfg.MaxRetries, attempts[`{"Message":"unavailable"}`])
+	}
+	if attempts[`{"Message":"malformed"}`] != 1 {
+		t.Fatalf("malformed object must not be retried; got %d attempts", attempts[`{"Message":"malformed"}`])
+	}
+
+	if len(sink.objects) != 2 || sink.objects[0].Status != http.StatusBadRequest || sink.objects[1].Status != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected failed objects %+v", sink.objects)
+	}
+	if n := testutil.ToFloat64(metrics.Documents.WithLabelValues("test", "succeeded")); n != 2 {
+		t.Fatalf("unexpected number of succeeded documents in metrics; got %f, want 2", n)
+	}
+
+	for offset := int64(0); offset < 4; offset++ {
+		if acker.acks[offset] != 1 {
+			t.Fatalf("offset %d is acknowledged %d times", offset, acker.acks[offset])
+		}
+	}
+}
+
+func TestFlushRetriesInOrderOfPartition(t *testing.T) {
+	for _, ordering := range []string{config.OrderingPartition, config.OrderingNone} {
+		var mutex sync.Mutex
+		var written []string
+		attempts := map[string]int{}
+		es, server := fakeBulk(t, func(doc string) int {
+			mutex.Lock()
+			defer mutex.Unlock()
+			attempts[doc]++
+			if strings.Contains(doc, `{"N":1}`) && attempts[doc] == 1 {
+				return http.StatusTooManyRequests
+			}
+			written = append(written, doc)
+			return http.StatusOK
+		})
+
+		cfg := config.Default().Elastic
+		cfg.Ordering = ordering
+		cfg.RetryBackoff = time.Millisecond
+		cfg.MaxRetryBackoff = time.Millisecond
+		acker := &ackCounter{acks: map[int64]int{}}
+		// 0, 1 and 3 are of the same partition, 2 of another one
+		var buffer []bufferEntity
+		for i, p := range []int{0, 0, 1, 0} {
+			buffer = append(buffer, bufferEntity{esIndex: "test", action: config.ActionUpdate, id: "user", data: []byte(fmt.Sprintf(`{"N":%d}`, i)),
+				offset: types.Offset{Partition: p, Offset: int64(i), Acker: acker}})
+		}
+		logger := zap.NewNop()
+		if _, err := flush(context.Background(), cfg, buffer, &bytes.Buffer{}, es, NewBreaker(es, time.Second, logger), nil, &memorySink{}, logger); err != nil {
+			t.Fatalf("flush failed: %s", err)
+		}
+		server.Close()
+
+		want := []string{`{"N":0}`, `{"N":2}`, `{"N":3}`, `{"N":1}`}
+		if ordering == config.OrderingPartition {
+			// 3 is written again after 1, so the last update of the partition wins
+			want = []string{`{"N":0}`, `{"N":2}`, `{"N":3}`, `{"N":1}`, `{"N":3}`}
+		}
+		for i := range want {
+			want[i] = `{"doc" : ` + want[i] + `, "doc_as_upsert" : true}`
+		}
+		if !reflect.DeepEqual(written, want) {
+			t.Fatalf("unexpected writes with ordering %s; got %v, want %v", ordering, written, want)
+		}
+		for offset := int64(0); offset < 4; offset++ {
+			if acker.acks[offset] != 1 {
+				t.Fatalf("offset %d is acknowledged %d times with ordering %s", offset, acker.acks[offset], ordering)
+			}
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := config.Default().Elastic
+	cfg.RetryBackoff = time.Millisecond * 100
+	cfg.MaxRetryBackoff = time.Second
+
+	for attempt, max := range []time.Duration{0, 100, 200, 400, 800, 1000, 1000} {
+		if attempt == 0 {
+			continue
+		}
+		max *= time.Millisecond
+		if d := backoff(cfg, attempt); d < max/2 || d > max {
+			t.Fatalf("backoff of attempt %d is %s, want between %s and %s", attempt, d, max/2, max)
+		}
+	}
+	if d := backoff(cfg, 100); d < cfg.MaxRetryBackoff/2 || d > cfg.MaxRetryBackoff {
+		t.Fatalf("backoff must not overflow; got %s", d)
+	}
+}
+
+func TestWriteAction(t *testing.T) {
+	data := []byte(`{"Id":"1"}`)
+	for _, test := range []struct {
+		entity bufferEntity
+		want   string
+	}{
+		{
+			bufferEntity{esIndex: "users", action: config.ActionIndex, data: data},
+			`{"index" : { "_index" : "users", "_type" : "_doc" }}` + "\n" + `{"Id":"1"}` + "\n",
+		},
+		{
+			bufferEntity{esIndex: "users", action: config.ActionCreate, id: "1", data: data},
+			`{"create" : { "_index" : "users", "_type" : "_doc", "_id" : "1" }}` + "\n" + `{"Id":"1"}` + "\n",
+		},
+		{
+			bufferEntity{esIndex: "users", action: config.ActionUpdate, id: "1", data: data},
+			`{"update" : { "_index" : "users", "_type" : "_doc", "_id" : "1" }}` + "\n" + `{"doc" : {"Id":"1"}, "doc_as_upsert" : true}` + "\n",
+		},
+		{
+			bufferEntity{esIndex: "users", action: config.ActionScript, script: `ctx._source.putAll(params.doc)`, id: "1", data: data},
+			`{"update" : { "_index" : "users", "_type" : "_doc", "_id" : "1" }}` + "\n" +
+				`{"script" : {"source" : "ctx._source.putAll(params.doc)", "lang" : "painless", "params" : {"doc" : {"Id":"1"}}}, "upsert" : {"Id":"1"}}` + "\n",
+		},
+		{
+			bufferEntity{esIndex: "users", action: actionDelete, id: `"quoted"`},
+			`{"delete" : { "_index" : "users", "_type" : "_doc", "_id" : "\"quoted\"" }}` + "\n",
+		},
+	} {
+		var body bytes.Buffer
+		writeAction(&body, test.entity)
+		if body.String() != test.want {
+			t.Fatalf("unexpected %s action; got %s, want %s", test.entity.action, body.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package elastic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A node that fails to respond is skipped for deadTimeout, doubled with every next failure up to maxDeadTimeout
+const (
+	deadTimeout    = time.Second
+	maxDeadTimeout = time.Minute
+
+	// writers keep several bulk requests in flight, so connections to every node are kept for all of them
+	maxIdleConnsPerHost = 64
+)
+
+// NewClient creates elasticsearch client with the transport of the configuration
+func NewClient(cfg config.Elastic, logger *zap.Logger) (*elasticsearch.Client, *Transport, error) {
+	transport, err := NewTransport(cfg, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &elasticsearch.Client{Transport: transport, API: esapi.New(transport)}, transport, nil
+}
+
+// Transport performs requests of the elasticsearch client: it spreads them round-robin over nodes, retries a request
+// on the next node when a node fails to respond (and skips that node for a while), authenticates requests, and
+// compresses bodies of bulk requests. Nodes are the configured addresses, or, with sniffing, nodes of the cluster.
+type Transport struct {
+	cfg           config.Elastic
+	roundTripper  http.RoundTripper
+	authorization string // header value
+	logger        *zap.Logger
+
+	mutex sync.Mutex
+	nodes []*node
+	next  int // index of the node the next request goes to
+}
+
+type node struct {
+	url       *url.URL
+	failures  int // in a row
+	deadUntil time.Time
+}
+
+func NewTransport(cfg config.Elastic, logger *zap.Logger) (*Transport, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transport{
+		cfg: cfg,
+		roundTripper: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		logger: logger,
+	}
+
+	switch {
+	case cfg.Username != "":
+		t.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.Username+":"+cfg.Password))
+	case cfg.APIKey != "":
+		t.authorization = "ApiKey " + cfg.APIKey
+	case cfg.BearerToken != "":
+		t.authorization = "Bearer " + cfg.BearerToken
+	}
+
+	for _, address := range cfg.Addresses {
+		u, err := url.Parse(strings.TrimRight(address, "/"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid elastic address %s", address)
+		}
+		t.nodes = append(t.nodes, &node{url: u})
+	}
+	if len(t.nodes) == 0 {
+		return nil, errors.New("elastic addresses are not set")
+	}
+	return t, nil
+}
+
+func newTLSConfig(cfg config.ElasticTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read elastic CA file")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("elastic CA file %s has no PEM certificates", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load elastic client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// Perform sends the request to the next live node, and to the next ones while nodes fail to respond.
+// Every attempt gets the body from GetBody of the request, so bulk requests (which have it) are sent again without
+// copies; bodies of other requests are small, and are read into memory for that.
+func (t *Transport) Perform(req *http.Request) (*http.Response, error) {
+	getBody, contentLength := req.GetBody, req.ContentLength
+	if req.Body != nil {
+		if getBody == nil {
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read request body")
+			}
+			getBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+			contentLength = int64(len(body))
+		}
+		req.Body.Close()
+	}
+	header := req.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	if t.cfg.Compression && getBody != nil && strings.HasSuffix(req.URL.Path, "/_bulk") {
+		compressed, err := gzipBody(getBody)
+		if err != nil {
+			return nil, err
+		}
+		defer compressed.release()
+		getBody, contentLength = compressed.reader, int64(compressed.buffer.Len())
+		header.Set("Content-Encoding", "gzip")
+	}
+	if t.authorization != "" {
+		header.Set("Authorization", t.authorization)
+	}
+
+	var err error
+	for attempt := 0; attempt < t.attempts(); attempt++ {
+		n := t.pick()
+
+		ctx, cancel := context.WithTimeout(req.Context(), t.cfg.RequestTimeout)
+		r := req.WithContext(ctx)
+		r.Header = header
+		r.URL = nodeURL(n.url, req.URL)
+		r.Host = ""
+		if n.url.User != nil && t.authorization == "" {
+			password, _ := n.url.User.Password()
+			r.SetBasicAuth(n.url.User.Username(), password)
+		}
+		if getBody != nil {
+			if r.Body, err = getBody(); err != nil {
+				cancel()
+				return nil, errors.Wrap(err, "failed to get request body")
+			}
+			r.GetBody, r.ContentLength = getBody, contentLength
+		}
+
+		var res *http.Response
+		res, err = t.roundTripper.RoundTrip(r)
+		if err == nil {
+			t.succeeded(n)
+			// the timeout applies to reading the response too
+			res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+			return res, nil
+		}
+		cancel()
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+		t.failed(n, err)
+	}
+	return nil, err
+}
+
+// attempts of a request: once on every node
+func (t *Transport) attempts() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.nodes)
+}
+
+// pick returns the next live node, or, if all of them are dead, the one that will be alive first
+func (t *Transport) pick() *node {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	var first *node
+	for i := range t.nodes {
+		n := t.nodes[(t.next+i)%len(t.nodes)]
+		if !n.deadUntil.After(now) {
+			t.next = (t.next + i + 1) % len(t.nodes)
+			return n
+		}
+		if first == nil || n.deadUntil.Before(first.deadUntil) {
+			first = n
+		}
+	}
+	return first
+}
+
+func (t *Transport) succeeded(n *node) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if n.failures > 0 {
+		t.logger.Info("elastic node is back", zap.String("node", n.url.Host))
+	}
+	n.failures, n.deadUntil = 0, time.Time{}
+}
+
+func (t *Transport) failed(n *node, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	timeout := deadTimeout << uint(n.failures)
+	if timeout > maxDeadTimeout || timeout <= 0 {
+		timeout = maxDeadTimeout
+	}
+	n.failures++
+	n.deadUntil = time.Now().Add(timeout)
+	t.logger.Warn("elastic node failed to respond", zap.String("node", n.url.Host), zap.Duration("skipped for", timeout), zap.Error(err))
+}
+
+// nodeURL is the URL of the request path on the node, which may have a path prefix (e.g. behind a proxy)
+func nodeURL(nodeURL, requestURL *url.URL) *url.URL {
+	u := *requestURL
+	u.Scheme, u.Host, u.User = nodeURL.Scheme, nodeURL.Host, nil
+	u.Path = nodeURL.Path + requestURL.Path
+	return &u
+}
+
+// Compressed bodies of bulk requests are up to MaxBulkBytes, so buffers and writers are reused
+var (
+	gzipBuffers = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+)
+
+// compressedBody is a compressed request body, read by every attempt of the request; its buffer goes back to the pool
+// once the request is done and all readers are closed (the round tripper may close them after it returns)
+type compressedBody struct {
+	buffer *bytes.Buffer
+	refs   int32 // request and open readers
+}
+
+func gzipBody(getBody func() (io.ReadCloser, error)) (*compressedBody, error) {
+	body, err := getBody()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get request body")
+	}
+	defer body.Close()
+
+	compressed := &compressedBody{buffer: gzipBuffers.Get().(*bytes.Buffer), refs: 1}
+	writer := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(writer)
+	writer.Reset(compressed.buffer)
+	if _, err := io.Copy(writer, body); err != nil {
+		compressed.release()
+		return nil, errors.Wrap(err, "failed to compress request body")
+	}
+	if err := writer.Close(); err != nil {
+		compressed.release()
+		return nil, errors.Wrap(err, "failed to compress request body")
+	}
+	return compressed, nil
+}
+
+func (b *compressedBody) reader() (io.ReadCloser, error) {
+	atomic.AddInt32(&b.refs, 1)
+	return &compressedReader{Reader: bytes.NewReader(b.buffer.Bytes()), body: b}, nil
+}
+
+func (b *compressedBody) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		b.buffer.Reset()
+		gzipBuffers.Put(b.buffer)
+	}
+}
+
+type compressedReader struct {
+	*bytes.Reader
+	body  *compressedBody
+	close sync.Once
+}
+
+func (r *compressedReader) Close() error {
+	r.close.Do(r.body.release)
+	return nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// SniffNodes discovers nodes of the cluster every interval, until the context is cancelled.
+// Failures are logged, and the known nodes stay in use.
+func (t *Transport) SniffNodes(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			if err := t.Sniff(ctx); err != nil {
+				t.logger.Warn("failed to sniff elastic nodes", zap.Error(err))
+			}
+		}
+	}
+}
+
+// nodesInfo is the response of nodes info API, decoded as far as needed to find HTTP addresses of nodes
+type nodesInfo struct {
+	Nodes map[string]struct {
+		Roles []string `json:"roles"`
+		HTTP  struct {
+			PublishAddress string `json:"publish_address"`
+		} `json:"http"`
+	} `json:"nodes"`
+}
+
+// Sniff replaces the nodes by nodes of the cluster with HTTP enabled, except dedicated master nodes, at addresses
+// they publish, with the scheme of the configured addresses
+func (t *Transport) Sniff(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, "/_nodes/http", nil)
+	if err != nil {
+		return err
+	}
+	res, err := t.Perform(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to get nodes info")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to get nodes info: %s", res.Status)
+	}
+	var info nodesInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return errors.Wrap(err, "failed to decode nodes info")
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	scheme := t.nodes[0].url.Scheme
+	known := map[string]*node{}
+	for _, n := range t.nodes {
+		known[n.url.Host] = n
+	}
+
+	var nodes []*node
+	var hosts []string
+	changed := false
+	for _, info := range info.Nodes {
+		if len(info.Roles) == 1 && info.Roles[0] == "master" || info.HTTP.PublishAddress == "" {
+			continue
+		}
+		// e.g. 10.0.0.1:9200, or es-1.example.com/10.0.0.1:9200 with the host name
+		host := info.HTTP.PublishAddress
+		if i := strings.Index(host, "/"); i >= 0 {
+			name, address := host[:i], host[i+1:]
+			if _, port, err := net.SplitHostPort(address); err == nil && name != "" {
+				address = net.JoinHostPort(name, port)
+			}
+			host = address
+		}
+		n := known[host]
+		if n == nil {
+			n = &node{url: &url.URL{Scheme: scheme, Host: host}}
+			changed = true
+		}
+		nodes = append(nodes, n)
+		hosts = append(hosts, host)
+	}
+	if len(nodes) == 0 {
+		return errors.New("cluster has no nodes with HTTP")
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].url.Host < nodes[j].url.Host })
+	if changed || len(nodes) != len(t.nodes) {
+		sort.Strings(hosts)
+		t.logger.Info("elastic nodes sniffed", zap.Strings("nodes", hosts))
+	}
+	t.nodes, t.next = nodes, 0
+	return nil
+}
@@ -0,0 +1,295 @@
+package elastic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransportFailover(t *testing.T) {
+	var requests int32
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	cfg := config.Default().Elastic
+	cfg.Addresses = []string{dead.URL, live.URL}
+	es, transport, err := NewClient(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		res, err := es.Info()
+		if err != nil {
+			t.Fatalf("request %d must be retried on the live node; got %s", i, err)
+		}
+		res.Body.Close()
+	}
+	if requests != 3 {
+		t.Fatalf("live node must get all requests; got %d", requests)
+	}
+	// the dead node is tried once, and then skipped
+	if failures := transport.nodes[0].failures; failures != 1 {
+		t.Fatalf("dead node must fail once; got %d failures", failures)
+	}
+}
+
+func TestTransportRequests(t *testing.T) {
+	body := strings.Repeat(`{"index":{}}`+"\n"+`{"Message":"hello"}`+"\n", 10)
+	var gotPath, gotAuthorization, gotEncoding, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuthorization, gotEncoding = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get("Content-Encoding")
+		reader := r.Body
+		if gotEncoding == "gzip" {
+			var err error
+			if reader, err = gzip.NewReader(r.Body); err != nil {
+				t.Errorf("failed to decompress body: %s", err)
+				return
+			}
+		}
+		data, _ := ioutil.ReadAll(reader)
+		gotBody = string(data)
+		fmt.Fprint(w, `{"errors":false,"items":[]}`)
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		name          string
+		cfg           func(cfg *config.Elastic)
+		authorization string
+	}{
+		{"basic", func(cfg *config.Elastic) { cfg.Username, cfg.Password = "pipeline", "secret" }, "Basic cGlwZWxpbmU6c2VjcmV0"},
+		{"api key", func(cfg *config.Elastic) { cfg.APIKey = "aWQ6a2V5" }, "ApiKey aWQ6a2V5"},
+		{"bearer token", func(cfg *config.Elastic) { cfg.BearerToken = "token" }, "Bearer token"},
+		{"credentials in address", func(cfg *config.Elastic) {
+			u, _ := url.Parse(cfg.Addresses[0])
+			u.User = url.UserPassword("pipeline", "secret")
+			cfg.Addresses[0] = u.String()
+		}, "Basic cGlwZWxpbmU6c2VjcmV0"},
+	} {
+		cfg := config.Default().Elastic
+		cfg.Addresses = []string{server.URL + "/proxy/"}
+		cfg.Compression = true
+		test.cfg(&cfg)
+		es, _, err := NewClient(cfg, zap.NewNop())
+		if err != nil {
+			t.Fatalf("%s: failed to create client: %s", test.name, err)
+		}
+
+		res, err := es.Bulk(bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("%s: bulk failed: %s", test.name, err)
+		}
+		res.Body.Close()
+		if gotPath != "/proxy/_bulk" || gotAuthorization != test.authorization || gotEncoding != "gzip" || gotBody != body {
+			t.Fatalf("%s: unexpected request to %s, authorization %q, encoding %q, body %q", test.name, gotPath, gotAuthorization, gotEncoding, gotBody)
+		}
+	}
+
+	// other requests are not compressed
+	es, _, err := NewClient(config.Elastic{Addresses: []string{server.URL}, Compression: true, RequestTimeout: time.Second}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	res, err := es.Index("tweets", strings.NewReader(`{"Message":"hello"}`))
+	if err != nil {
+		t.Fatalf("index failed: %s", err)
+	}
+	res.Body.Close()
+	if gotEncoding != "" || gotBody != `{"Message":"hello"}` {
+		t.Fatalf("unexpected encoding %q, body %q", gotEncoding, gotBody)
+	}
+}
+
+// unreadable is a request body the transport must not read: it gets the body by GetBody instead
+type unreadable struct{}
+
+func (unreadable) Read([]byte) (int, error) {
+	return 0, errors.New("body must be read by GetBody")
+}
+
+func (unreadable) Close() error {
+	return nil
+}
+
+func TestTransportResendsBody(t *testing.T) {
+	body := strings.Repeat(`{"index":{}}`+"\n"+`{"Message":"hello"}`+"\n", 10)
+	var gotBody string
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader := r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			var err error
+			if reader, err = gzip.NewReader(r.Body); err != nil {
+				t.Errorf("failed to decompress body: %s", err)
+				return
+			}
+		}
+		data, _ := ioutil.ReadAll(reader)
+		gotBody = string(data)
+	}))
+	defer live.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	for _, compression := range []bool{false, true} {
+		cfg := config.Default().Elastic
+		cfg.Addresses = []string{dead.URL, live.URL}
+		cfg.Compression = compression
+		transport, err := NewTransport(cfg, zap.NewNop())
+		if err != nil {
+			t.Fatalf("failed to create transport: %s", err)
+		}
+
+		gotBody = ""
+		req, _ := http.NewRequest(http.MethodPost, "/_bulk", bytes.NewReader([]byte(body)))
+		req.Body = unreadable{}
+		res, err := transport.Perform(req)
+		if err != nil {
+			t.Fatalf("compression %t: request must be sent again to the live node; got %s", compression, err)
+		}
+		res.Body.Close()
+		if gotBody != body {
+			t.Fatalf("compression %t: unexpected body %q", compression, gotBody)
+		}
+	}
+}
+
+func BenchmarkTransportCompression(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	cfg := config.Default().Elastic
+	cfg.Addresses = []string{server.URL}
+	cfg.Compression = true
+	transport, err := NewTransport(cfg, zap.NewNop())
+	if err != nil {
+		b.Fatalf("failed to create transport: %s", err)
+	}
+	body := []byte(strings.Repeat(`{"index":{}}`+"\n"+`{"Message":"hello"}`+"\n", 10000))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "/_bulk", bytes.NewReader(body))
+		res, err := transport.Perform(req)
+		if err != nil {
+			b.Fatalf("request failed: %s", err)
+		}
+		res.Body.Close()
+	}
+}
+
+func TestTransportTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 200)
+	}))
+	defer server.Close()
+
+	cfg := config.Default().Elastic
+	cfg.Addresses = []string{server.URL}
+	cfg.RequestTimeout = time.Millisecond * 20
+	es, _, err := NewClient(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	started := time.Now()
+	if _, err := es.Info(); err == nil {
+		t.Fatal("request must time out")
+	}
+	if elapsed := time.Since(started); elapsed > time.Millisecond*150 {
+		t.Fatalf("request took %s despite timeout", elapsed)
+	}
+}
+
+func TestTransportSniff(t *testing.T) {
+	var host string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_nodes/http" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		fmt.Fprintf(w, `{"nodes": {
+			"a": {"roles": ["master", "data", "ingest"], "http": {"publish_address": %q}},
+			"b": {"roles": ["data"], "http": {"publish_address": "localhost/127.0.0.1:9201"}},
+			"c": {"roles": ["master"], "http": {"publish_address": "10.0.0.3:9200"}},
+			"d": {"roles": ["data"]}
+		}}`, host)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host = u.Host
+
+	cfg := config.Default().Elastic
+	cfg.Addresses = []string{server.URL}
+	_, transport, err := NewClient(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	if err := transport.Sniff(context.Background()); err != nil {
+		t.Fatalf("failed to sniff: %s", err)
+	}
+
+	var nodes []string
+	for _, n := range transport.nodes {
+		nodes = append(nodes, n.url.String())
+	}
+	if expected := []string{"http://" + host, "http://localhost:9201"}; fmt.Sprint(nodes) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected nodes %v, want %v", nodes, expected)
+	}
+}
+
+func TestTransportTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "elastic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default().Elastic
+	cfg.Addresses = []string{server.URL}
+	es, _, err := NewClient(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	if _, err := es.Info(); err == nil {
+		t.Fatal("node with unknown certificate must not be trusted")
+	}
+
+	cfg.TLS.CAFile = caFile
+	es, _, err = NewClient(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	res, err := es.Info()
+	if err != nil {
+		t.Fatalf("node must be trusted by the CA: %s", err)
+	}
+	res.Body.Close()
+}
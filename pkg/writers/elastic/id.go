@@ -0,0 +1,81 @@
+package elastic
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"strings"
+)
+
+// documentID returns ID of the document by the strategy, or an empty string to let ES generate it.
+// With the same ID, a document read again (after restart, retry or rebalance) replaces itself instead of
+// being duplicated.
+// Tombstones have no document to take a field of, so with field strategy their ID is the message key: producers of
+// compacted topics key messages by the ID of the object they carry.
+func documentID(strategy string, record *types.Record, data []byte) (string, error) {
+	switch {
+	case strategy == config.IDStrategyAuto:
+		return "", nil
+
+	case strategy == config.IDStrategyHash:
+		if record.Tombstone() {
+			return "", errors.New("failed to get id: tombstone has no document to hash")
+		}
+		// encoding/json sorts map keys, so equal documents are marshaled to equal bytes
+		sum := sha1.Sum(data)
+		return hex.EncodeToString(sum[:]), nil
+
+	case strategy == config.IDStrategyOffset:
+		return fmt.Sprintf("%s-%d-%d", record.Offset.Topic, record.Offset.Partition, record.Offset.Offset), nil
+
+	case strategy == config.IDStrategyKey:
+		if record.Key == "" {
+			return "", errors.New("failed to get id: message has no key")
+		}
+		return record.Key, nil
+
+	case strings.HasPrefix(strategy, config.IDStrategyField):
+		if record.Tombstone() {
+			return documentID(config.IDStrategyKey, record, data)
+		}
+		return fieldID(record.Doc, strings.TrimPrefix(strategy, config.IDStrategyField))
+	}
+	return "", errors.Errorf("unknown id strategy %q", strategy)
+}
+
+// fieldID returns value of the field given by a dot-separated path, e.g. User.Id
+func fieldID(doc map[string]interface{}, path string) (string, error) {
+	value, ok := field(doc, path)
+	if !ok {
+		return "", errors.Errorf("failed to get id: %s is not in the document", path)
+	}
+
+	switch value := value.(type) {
+	case string:
+		if value != "" {
+			return value, nil
+		}
+	case json.Number:
+		return value.String(), nil
+	case float64, bool:
+		return fmt.Sprint(value), nil
+	}
+	return "", errors.Errorf("failed to get id: %s is empty or not a string or number", path)
+}
+
+// field returns value of the document field given by a dot-separated path
+func field(doc map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value = object[name]
+	}
+	return value, true
+}
@@ -0,0 +1,53 @@
+package elastic
+
+import (
+	"encoding/json"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"testing"
+)
+
+func TestDocumentID(t *testing.T) {
+	record := &types.Record{
+		Doc: map[string]interface{}{
+			"Id":   "user-1",
+			"User": map[string]interface{}{"Id": json.Number("42"), "Name": ""},
+		},
+		Offset: types.Offset{Topic: "tweets", Partition: 3, Offset: 1001},
+	}
+	data, _ := json.Marshal(record.Doc)
+
+	for strategy, want := range map[string]string{
+		"auto":          "",
+		"offset":        "tweets-3-1001",
+		"field:Id":      "user-1",
+		"field:User.Id": "42",
+		"hash":          "",
+	} {
+		id, err := documentID(strategy, record, data)
+		if err != nil {
+			t.Fatalf("%s: failed to get id: %s", strategy, err)
+		}
+		if strategy == "hash" {
+			if len(id) != 40 {
+				t.Fatalf("hash must be hex of sha1; got %s", id)
+			}
+			continue
+		}
+		if id != want {
+			t.Fatalf("%s: unexpected id; got %q, want %q", strategy, id, want)
+		}
+	}
+
+	for _, strategy := range []string{"field:Name", "field:User.Name", "field:Id.Value", "uuid"} {
+		if id, err := documentID(strategy, record, data); err == nil {
+			t.Fatalf("%s: expected error, got id %q", strategy, id)
+		}
+	}
+	tombstone := &types.Record{Key: "user-1"}
+	if id, err := documentID("field:Id", tombstone, nil); err != nil || id != "user-1" {
+		t.Fatalf("tombstone must get id of its key; got %q, error %v", id, err)
+	}
+	if id, err := documentID("field:Id", &types.Record{}, nil); err == nil {
+		t.Fatalf("tombstone without key must get no id; got %q", id)
+	}
+}
@@ -0,0 +1,154 @@
+package elastic
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"strings"
+	"time"
+)
+
+// Date patterns of index name templates and their time.Format layouts
+var datePatterns = []struct{ pattern, layout string }{
+	{"yyyy", "2006"},
+	{"yy", "06"},
+	{"MM", "01"},
+	{"dd", "02"},
+	{"HH", "15"},
+}
+
+// indexName resolves names of indices documents are written to from a template with date patterns in braces,
+// e.g. tweets-{yyyy.MM.dd}, by timestamps of documents, in UTC.
+// Names are cached per period (e.g. a day), so most documents don't cost an allocation.
+// It is not safe for concurrent use: every writer has its own.
+type indexName struct {
+	template  string
+	static    bool // template without date patterns
+	parts     []indexPart
+	period    func(t time.Time) time.Time // start of the shortest period the template distinguishes
+	timestamp string                      // one of config.Timestamp*
+	names     map[int64]string            // by start of period
+}
+
+// Literal part of the template, or a date pattern
+type indexPart struct {
+	literal string
+	layout  string
+}
+
+// Not to grow forever, the cache is reset once it has that many names (documents are mostly of recent periods)
+const maxCachedNames = 64
+
+func newIndexName(template, timestamp string) (*indexName, error) {
+	index := &indexName{template: template, timestamp: timestamp, names: map[int64]string{}}
+	granularity := 0 // 1 - year, 2 - month, 3 - day, 4 - hour
+
+	rest := template
+	for rest != "" {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			index.parts = append(index.parts, indexPart{literal: rest})
+			break
+		}
+		closing := strings.Index(rest, "}")
+		if closing < open {
+			return nil, errors.Errorf("index template %q has unbalanced braces", template)
+		}
+		if open > 0 {
+			index.parts = append(index.parts, indexPart{literal: rest[:open]})
+		}
+
+		pattern := rest[open+1 : closing]
+		layout := pattern
+		for _, datePattern := range datePatterns {
+			layout = strings.Replace(layout, datePattern.pattern, datePattern.layout, -1)
+		}
+		if strings.Trim(layout, "0123456789.-_") != "" || layout == pattern {
+			return nil, errors.Errorf("index template %q has unknown date pattern %q; known are yyyy, yy, MM, dd and HH", template, pattern)
+		}
+		for i, unit := range []string{"y", "M", "d", "H"} {
+			if strings.Contains(pattern, unit) && granularity < i+1 {
+				granularity = i + 1
+			}
+		}
+		index.parts = append(index.parts, indexPart{layout: layout})
+		rest = rest[closing+1:]
+	}
+	if strings.Contains(rest, "}") {
+		return nil, errors.Errorf("index template %q has unbalanced braces", template)
+	}
+	index.static = granularity == 0
+
+	index.period = func(t time.Time) time.Time {
+		switch granularity {
+		case 1:
+			return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+		case 2:
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		case 3:
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		return t.Truncate(time.Hour)
+	}
+	return index, nil
+}
+
+// resolve returns name of the index the record is written to
+func (i *indexName) resolve(record *types.Record) (string, error) {
+	if i.static {
+		return i.template, nil
+	}
+
+	t, err := i.time(record)
+	if err != nil {
+		return "", err
+	}
+	start := i.period(t.UTC())
+	if name, ok := i.names[start.Unix()]; ok {
+		return name, nil
+	}
+
+	var name strings.Builder
+	for _, part := range i.parts {
+		if part.layout != "" {
+			name.WriteString(start.Format(part.layout))
+		} else {
+			name.WriteString(part.literal)
+		}
+	}
+	if len(i.names) >= maxCachedNames {
+		i.names = map[int64]string{}
+	}
+	i.names[start.Unix()] = name.String()
+	return name.String(), nil
+}
+
+// time returns timestamp of the record: time of the kafka message (or now, if it has no time), or a document field
+// with RFC 3339 time or milliseconds since epoch
+func (i *indexName) time(record *types.Record) (time.Time, error) {
+	if i.timestamp == config.TimestampKafka {
+		if record.Time.IsZero() {
+			return time.Now(), nil // messages of kafka before 0.10 have no time
+		}
+		return record.Time, nil
+	}
+
+	path := strings.TrimPrefix(i.timestamp, config.TimestampField)
+	value, ok := field(record.Doc, path)
+	if !ok {
+		return time.Time{}, errors.Errorf("failed to get timestamp: %s is not in the document", path)
+	}
+
+	switch value := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, value)
+		return t, errors.Wrapf(err, "failed to get timestamp from %s", path)
+	case json.Number:
+		millis, err := value.Int64()
+		return time.Unix(0, millis*int64(time.Millisecond)), errors.Wrapf(err, "failed to get timestamp from %s", path)
+	case float64:
+		return time.Unix(0, int64(value)*int64(time.Millisecond)), nil
+	}
+	return time.Time{}, errors.Errorf("failed to get timestamp: %s is not a string or number", path)
+}
@@ -0,0 +1,65 @@
+package elastic
+
+import (
+	"encoding/json"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"testing"
+	"time"
+)
+
+func TestIndexName(t *testing.T) {
+	at := time.Date(2019, 3, 12, 23, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	record := &types.Record{
+		Doc:  map[string]interface{}{"Created": "2019-04-01T10:00:00Z", "Millis": json.Number("1554112800000")},
+		Time: at,
+	}
+
+	for _, test := range []struct{ template, timestamp, want string }{
+		{"tweets", "kafka", "tweets"},
+		{"tweets-{yyyy.MM.dd}", "kafka", "tweets-2019.03.12"},
+		{"tweets-{yyyy.MM.dd.HH}", "kafka", "tweets-2019.03.12.21"},
+		{"{yy}-tweets-{MM}", "kafka", "19-tweets-03"},
+		{"tweets-{yyyy.MM.dd}", "field:Created", "tweets-2019.04.01"},
+		{"tweets-{yyyy.MM.dd}", "field:Millis", "tweets-2019.04.01"},
+	} {
+		index, err := newIndexName(test.template, test.timestamp)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", test.template, err)
+		}
+		for i := 0; i < 2; i++ { // the second time the name is cached
+			name, err := index.resolve(record)
+			if err != nil {
+				t.Fatalf("failed to resolve %s by %s: %s", test.template, test.timestamp, err)
+			}
+			if name != test.want {
+				t.Fatalf("unexpected name of %s by %s; got %s, want %s", test.template, test.timestamp, name, test.want)
+			}
+		}
+	}
+
+	index, _ := newIndexName("tweets-{yyyy.MM.dd}", "field:Missing")
+	if _, err := index.resolve(record); err == nil {
+		t.Fatal("expected error for missing timestamp field")
+	}
+
+	for _, template := range []string{"tweets-{yyyy", "tweets-}yyyy{", "tweets-{}", "tweets-{week}"} {
+		if _, err := newIndexName(template, "kafka"); err == nil {
+			t.Fatalf("expected error for template %s", template)
+		}
+	}
+}
+
+func BenchmarkIndexName(b *testing.B) {
+	index, err := newIndexName("tweets-{yyyy.MM.dd}", "kafka")
+	if err != nil {
+		b.Fatal(err)
+	}
+	record := &types.Record{Time: time.Now()}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := index.resolve(record); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
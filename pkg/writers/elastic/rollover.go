@@ -0,0 +1,60 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+)
+
+// BootstrapRollover makes sure there is a write alias rolled over by the ILM policy: if the alias doesn't exist,
+// its first index, <alias>-000001, is created. Rollover itself is done by elastic, as the policy says.
+func BootstrapRollover(ctx context.Context, es *elasticsearch.Client, alias, policy string, logger *zap.Logger) error {
+	res, err := esapi.IndicesExistsAliasRequest{Name: []string{alias}}.Do(ctx, es)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check alias %s", alias)
+	}
+	_ = res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return errors.Errorf("failed to check alias %s: %s", alias, res.Status())
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"settings": map[string]string{
+			"index.lifecycle.name":           policy,
+			"index.lifecycle.rollover_alias": alias,
+		},
+		"aliases": map[string]interface{}{
+			alias: map[string]bool{"is_write_index": true},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	index := alias + "-000001"
+	res, err = esapi.IndicesCreateRequest{Index: index, Body: bytes.NewReader(body)}.Do(ctx, es)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create index %s", index)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		reason, _ := ioutil.ReadAll(res.Body)
+		if bytes.Contains(reason, []byte("resource_already_exists_exception")) {
+			return nil // created by another pipeline instance
+		}
+		return errors.Errorf("failed to create index %s: %s %s", index, res.Status(), reason)
+	}
+
+	logger.Info("created first index of rollover alias", zap.String("alias", alias), zap.String("index", index), zap.String("policy", policy))
+	return nil
+}
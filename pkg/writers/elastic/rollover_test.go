@@ -0,0 +1,50 @@
+package elastic
+
+import (
+	"context"
+	"github.com/elastic/go-elasticsearch"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBootstrapRollover(t *testing.T) {
+	aliasExists := false
+	var created []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead && r.URL.Path == "/_alias/tweets":
+			if !aliasExists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodPut && r.URL.Path == "/tweets-000001":
+			body, _ := ioutil.ReadAll(r.Body)
+			created = append(created, string(body))
+			aliasExists = true
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := BootstrapRollover(context.Background(), es, "tweets", "tweets-policy", zap.NewNop()); err != nil {
+			t.Fatalf("failed to bootstrap rollover: %s", err)
+		}
+	}
+	if len(created) != 1 {
+		t.Fatalf("first index must be created once; got %d times", len(created))
+	}
+	for _, want := range []string{`"index.lifecycle.name":"tweets-policy"`, `"index.lifecycle.rollover_alias":"tweets"`, `"tweets":{"is_write_index":true}`} {
+		if !strings.Contains(created[0], want) {
+			t.Fatalf("index settings %s don't contain %s", created[0], want)
+		}
+	}
+}
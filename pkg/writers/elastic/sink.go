@@ -0,0 +1,94 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"kafka-to-elastic-pipeline/config"
+	"os"
+	"sync"
+)
+
+// FailedObject is an object ES refused to index
+type FailedObject struct {
+	Index  string          `json:"index"`
+	Object json.RawMessage `json:"object"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+func (e bufferEntity) failure(result bulkItemResult) FailedObject {
+	return FailedObject{
+		Index:     e.esIndex,
+		Object:    e.data,
+		Status:    result.Status,
+		Error:     result.Error,
+		Topic:     e.offset.Topic,
+		Partition: e.offset.Partition,
+		Offset:    e.offset.Offset,
+	}
+}
+
+// FailureSink keeps objects ES refused to index, for them not to be lost.
+// Objects are acknowledged (and so their kafka offsets are committed) once the sink returns no error.
+type FailureSink interface {
+	Failed(ctx context.Context, object FailedObject) error
+	Close() error
+}
+
+// NewFailureSink creates the sink chosen by configuration; it is shared by all the writers.
+func NewFailureSink(cfg config.Elastic, logger *zap.Logger) (FailureSink, error) {
+	switch cfg.FailureSink {
+	case "log":
+		return &logSink{logger: logger}, nil
+	case "file":
+		file, err := os.OpenFile(cfg.FailureFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open failure file")
+		}
+		return &fileSink{file: file, encoder: json.NewEncoder(file)}, nil
+	}
+	return nil, errors.Errorf("unknown failure sink %q", cfg.FailureSink)
+}
+
+// logSink only logs failed objects
+type logSink struct {
+	logger *zap.Logger
+}
+
+func (s *logSink) Failed(ctx context.Context, object FailedObject) error {
+	s.logger.Error(
+		"failed to index object",
+		zap.String("index", object.Index),
+		zap.Int("status", object.Status),
+		zap.ByteString("error", object.Error),
+		zap.ByteString("object", object.Object),
+	)
+	return nil
+}
+
+func (s *logSink) Close() error {
+	return nil
+}
+
+// fileSink appends failed objects to a file, one JSON per line
+type fileSink struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func (s *fileSink) Failed(ctx context.Context, object FailedObject) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.encoder.Encode(object)
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
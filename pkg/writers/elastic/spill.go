@@ -0,0 +1,308 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const spillSuffix = ".spill"
+
+// Every batch of spilled objects is a record of a segment file: its length and checksum, followed by the batch
+const spillHeaderSize = 8
+
+var spillChecksum = crc32.MakeTable(crc32.Castagnoli)
+
+var errSpillFull = errors.New("spill is full")
+
+// Spill is a write-ahead directory of objects ES can't index for now. Objects are appended to segment files,
+// synced and acknowledged, so that their kafka offsets are committed without waiting for ES. Spilled objects are
+// written to ES in order by the replayer once the breaker is closed, and every segment file is removed once all of
+// its objects are written or handed to the failure sink. Segments left by a previous run are replayed too.
+type Spill struct {
+	cfg     config.Elastic
+	es      *elasticsearch.Client
+	breaker *Breaker
+	sink    FailureSink
+	logger  *zap.Logger
+
+	mutex    sync.Mutex
+	segments []*segment // oldest first; the last one is appended to, if the file is open
+	file     *os.File   // of the last segment
+	bytes    int        // of all segments
+	next     int64      // number of the next segment file
+
+	appended chan struct{} // tells the replayer there is something to replay
+}
+
+type segment struct {
+	path string
+	size int
+}
+
+// OpenSpill opens the spill directory of the configuration, creating it if needed
+func OpenSpill(cfg config.Elastic, es *elasticsearch.Client, breaker *Breaker, sink FailureSink, logger *zap.Logger) (*Spill, error) {
+	if err := os.MkdirAll(cfg.Spill.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create spill directory")
+	}
+	files, err := ioutil.ReadDir(cfg.Spill.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read spill directory")
+	}
+
+	s := &Spill{cfg: cfg, es: es, breaker: breaker, sink: sink, logger: logger, appended: make(chan struct{}, 1)}
+	for _, file := range files {
+		number, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), spillSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(file.Name(), spillSuffix) || file.IsDir() {
+			continue
+		}
+		s.segments = append(s.segments, &segment{path: filepath.Join(cfg.Spill.Dir, file.Name()), size: int(file.Size())})
+		s.bytes += int(file.Size())
+		if number >= s.next {
+			s.next = number + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].path < s.segments[j].path })
+	metrics.SpilledBytes.Set(float64(s.bytes))
+	if len(s.segments) > 0 {
+		logger.Info("spill has objects to replay", zap.Int("segments", len(s.segments)), zap.Int("bytes", s.bytes))
+		s.appended <- struct{}{}
+	}
+	return s, nil
+}
+
+// Objects are spilled without their ackers: they are acknowledged when spilled
+type spilledObject struct {
+	Index  string          `json:"index"`
+	Action string          `json:"action"`
+	Script string          `json:"script,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Append appends the batch of objects to the last segment, rolling it if it is too large, and syncs it.
+// It returns errSpillFull if the spill has no room for the batch.
+func (s *Spill) Append(batch []bufferEntity) error {
+	objects := make([]spilledObject, len(batch))
+	for i, el := range batch {
+		objects[i] = spilledObject{Index: el.esIndex, Action: el.action, Script: el.script, ID: el.id, Data: el.data,
+			Topic: el.offset.Topic, Partition: el.offset.Partition, Offset: el.offset.Offset}
+	}
+	payload, err := json.Marshal(objects)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode spilled objects")
+	}
+	record := make([]byte, spillHeaderSize, spillHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, spillChecksum))
+	record = append(record, payload...)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.bytes+len(record) > s.cfg.Spill.MaxBytes {
+		return errSpillFull
+	}
+	if s.file == nil || s.segments[len(s.segments)-1].size+len(record) > s.cfg.Spill.SegmentBytes {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if _, err := s.file.Write(record); err != nil {
+		// a partly written record would make the rest of the segment unreadable
+		_ = s.file.Truncate(int64(last.size))
+		return errors.Wrap(err, "failed to write spill segment")
+	}
+	if err := s.file.Sync(); err != nil {
+		_ = s.file.Truncate(int64(last.size))
+		return errors.Wrap(err, "failed to sync spill segment")
+	}
+	last.size += len(record)
+	s.bytes += len(record)
+	metrics.SpilledBytes.Set(float64(s.bytes))
+
+	select {
+	case s.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// roll closes the last segment, if it is open, and starts a new one
+func (s *Spill) roll() error {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			s.logger.Warn("failed to close spill segment", zap.Error(err))
+		}
+		s.file = nil
+	}
+	path := filepath.Join(s.cfg.Spill.Dir, fmt.Sprintf("%020d%s", s.next, spillSuffix))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create spill segment")
+	}
+	s.next++
+	s.file = file
+	s.segments = append(s.segments, &segment{path: path})
+	return nil
+}
+
+// spilling tells if objects have to be spilled rather than sent: ES is unavailable, or earlier objects are in the
+// spill, and newer ones must not overtake them
+func (s *Spill) spilling() bool {
+	if s.breaker.isOpen() {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.segments) > 0
+}
+
+// Wait holds reading back while ES is unavailable and the spill has no room for another bulk request
+func (s *Spill) Wait(ctx context.Context) error {
+	s.mutex.Lock()
+	full := s.bytes+s.cfg.MaxBulkBytes > s.cfg.Spill.MaxBytes
+	s.mutex.Unlock()
+	if !full {
+		return nil
+	}
+	return s.breaker.Wait(ctx)
+}
+
+// Close closes the segment appended to; spilled objects stay in the directory until replayed
+func (s *Spill) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Run replays segments one by one, oldest first, while the breaker is closed, until the context is cancelled.
+// A segment partly replayed when the context is cancelled is replayed again from the start after restart.
+// Spilled objects are acknowledged already, so if one of them can't be written nor handed to the failure sink, the
+// replay stops with the error and the segment is kept.
+func (s *Spill) Run(ctx context.Context) error {
+	var body bytes.Buffer
+	for {
+		oldest := s.oldest()
+		if oldest == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-s.appended:
+				continue
+			}
+		}
+
+		if err := s.breaker.Wait(ctx); err != nil {
+			return nil
+		}
+		batches, err := readSegment(oldest.path, s.logger)
+		if err != nil {
+			return err
+		}
+		for _, batch := range batches {
+			if _, err := flush(ctx, s.cfg, batch, &body, s.es, s.breaker, nil, s.sink, s.logger); err != nil {
+				return errors.Wrapf(err, "failed to replay spill segment %s", oldest.path)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+		}
+		if err := s.remove(oldest); err != nil {
+			return err
+		}
+	}
+}
+
+// oldest returns the oldest segment, rolling it first if it is appended to; nil if the spill is empty
+func (s *Spill) oldest() *segment {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.segments) == 0 {
+		return nil
+	}
+	if len(s.segments) == 1 && s.file != nil {
+		if err := s.file.Close(); err != nil {
+			s.logger.Warn("failed to close spill segment", zap.Error(err))
+		}
+		s.file = nil
+	}
+	return s.segments[0]
+}
+
+func (s *Spill) remove(replayed *segment) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.Remove(replayed.path); err != nil {
+		return errors.Wrap(err, "failed to remove replayed spill segment")
+	}
+	s.segments = s.segments[1:]
+	s.bytes -= replayed.size
+	metrics.SpilledBytes.Set(float64(s.bytes))
+	s.logger.Info("spill segment replayed", zap.String("segment", replayed.path), zap.Int("bytes left", s.bytes))
+	return nil
+}
+
+// readSegment reads batches of objects of the segment file. A record that is cut short or doesn't match its
+// checksum (e.g. the pipeline crashed while writing it) ends the segment: it is logged, and the rest is skipped.
+func readSegment(path string, logger *zap.Logger) ([][]bufferEntity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read spill segment")
+	}
+
+	var batches [][]bufferEntity
+	for position := 0; position < len(data); {
+		var payload []byte
+		if len(data)-position >= spillHeaderSize {
+			size := int(binary.BigEndian.Uint32(data[position:]))
+			if end := position + spillHeaderSize + size; end <= len(data) {
+				payload = data[position+spillHeaderSize : end]
+				if crc32.Checksum(payload, spillChecksum) != binary.BigEndian.Uint32(data[position+4:]) {
+					payload = nil
+				}
+			}
+		}
+		var objects []spilledObject
+		if payload == nil || json.Unmarshal(payload, &objects) != nil {
+			logger.Error("spill segment is corrupted, the rest of it is skipped", zap.String("segment", path),
+				zap.Int("position", position), zap.Int("bytes skipped", len(data)-position))
+			break
+		}
+		position += spillHeaderSize + len(payload)
+
+		batch := make([]bufferEntity, len(objects))
+		for i, object := range objects {
+			batch[i] = bufferEntity{esIndex: object.Index, action: object.Action, script: object.Script, id: object.ID,
+				data: object.Data, offset: types.Offset{Topic: object.Topic, Partition: object.Partition, Offset: object.Offset}}
+		}
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
@@ -0,0 +1,213 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
+	"kafka-to-elastic-pipeline/pkg/types"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func spillEntities(acker types.Acker, from, to int) []bufferEntity {
+	var entities []bufferEntity
+	for i := from; i < to; i++ {
+		entities = append(entities, bufferEntity{esIndex: "spill", action: config.ActionIndex, id: fmt.Sprint(i),
+			data: []byte(fmt.Sprintf(`{"N":%d}`, i)), offset: types.Offset{Topic: "users", Offset: int64(i), Acker: acker}})
+	}
+	return entities
+}
+
+func TestSpillReplaysWhenElasticIsBack(t *testing.T) {
+	var down int32 = 1
+	var mutex sync.Mutex
+	var written []string
+	es, server := fakeBulk(t, func(doc string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		written = append(written, doc)
+		return http.StatusCreated
+	})
+	defer server.Close()
+	bulkHandler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case atomic.LoadInt32(&down) == 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/_cluster/health":
+			fmt.Fprint(w, `{"status":"green"}`)
+		default:
+			bulkHandler.ServeHTTP(w, r)
+		}
+	})
+
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.Default().Elastic
+	cfg.Spill.Dir = dir
+	logger := zap.NewNop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	breaker := NewBreaker(es, time.Millisecond*10, logger)
+	sink := &memorySink{}
+	spill, err := OpenSpill(cfg, es, breaker, sink, logger)
+	if err != nil {
+		t.Fatalf("failed to open spill: %s", err)
+	}
+	defer spill.Close()
+
+	// While elastic is down, objects are spilled and acknowledged right away, and reading goes on
+	acker := &ackCounter{acks: map[int64]int{}}
+	for _, entities := range [][]bufferEntity{spillEntities(acker, 0, 3), spillEntities(acker, 3, 5)} {
+		if _, err := flush(ctx, cfg, entities, &bytes.Buffer{}, es, breaker, spill, sink, logger); err != nil {
+			t.Fatalf("flush failed: %s", err)
+		}
+	}
+	for offset := int64(0); offset < 5; offset++ {
+		if acker.acks[offset] != 1 {
+			t.Fatalf("spilled offset %d is acknowledged %d times", offset, acker.acks[offset])
+		}
+	}
+	if testutil.ToFloat64(metrics.SpilledBytes) == 0 {
+		t.Fatal("spilled bytes must be reported")
+	}
+	if err := spill.Wait(ctx); err != nil {
+		t.Fatalf("reading must go on while the spill has room: %s", err)
+	}
+
+	go breaker.Run(ctx)
+	go spill.Run(ctx)
+	atomic.StoreInt32(&down, 0)
+	for deadline := time.Now().Add(time.Second * 5); testutil.ToFloat64(metrics.SpilledBytes) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("spill must be replayed once elastic is back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want := []string{`{"N":0}`, `{"N":1}`, `{"N":2}`, `{"N":3}`, `{"N":4}`}; !reflect.DeepEqual(written, want) {
+		t.Fatalf("spilled objects must be written in order; got %v, want %v", written, want)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spillSuffix)); len(files) != 0 {
+		t.Fatalf("replayed segments must be removed; got %v", files)
+	}
+	if len(sink.objects) != 0 {
+		t.Fatalf("no object must fail; got %+v", sink.objects)
+	}
+}
+
+func TestSpillKeepsSegmentNotReplayed(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		if doc == `{"N":1}` {
+			return http.StatusBadRequest
+		}
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.Default().Elastic
+	cfg.Spill.Dir = dir
+	logger := zap.NewNop()
+	spill, err := OpenSpill(cfg, es, NewBreaker(es, time.Second, logger), brokenSink{}, logger)
+	if err != nil {
+		t.Fatalf("failed to open spill: %s", err)
+	}
+	defer spill.Close()
+	if err := spill.Append(spillEntities(nil, 0, 3)); err != nil {
+		t.Fatalf("failed to spill: %s", err)
+	}
+
+	err = spill.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "disk is full") {
+		t.Fatalf("replay must stop when the failure sink fails; got %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+spillSuffix)); len(files) != 1 || len(spill.segments) != 1 {
+		t.Fatalf("segment not replayed must be kept; got %v", files)
+	}
+}
+
+func TestSpillSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.Default().Elastic
+	cfg.Spill = config.ElasticSpill{Dir: dir, MaxBytes: 1000, SegmentBytes: 300}
+	logger := zap.NewNop()
+	breaker := NewBreaker(nil, time.Second, logger)
+
+	spill, err := OpenSpill(cfg, nil, breaker, &memorySink{}, logger)
+	if err != nil {
+		t.Fatalf("failed to open spill: %s", err)
+	}
+	// every batch is about 200 bytes, so every segment gets one, and the spill has room for 4
+	var batches [][]bufferEntity
+	for i := 0; i < 5; i++ {
+		batch := spillEntities(nil, i*2, i*2+2)
+		err := spill.Append(batch)
+		if i == 4 {
+			if err != errSpillFull {
+				t.Fatalf("spill must be full; got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to spill: %s", err)
+		}
+		batches = append(batches, batch)
+	}
+	if err := spill.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spillSuffix))
+	if len(files) != 4 {
+		t.Fatalf("segments must be rolled; got %v", files)
+	}
+
+	// A record cut short at the end of a segment is skipped
+	last, err := os.OpenFile(files[3], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := last.Write([]byte{0, 0, 1, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	last.Close()
+	read, err := readSegment(files[3], logger)
+	if err != nil || !reflect.DeepEqual(read, batches[3:]) {
+		t.Fatalf("unexpected batches of segment %v, error %v", read, err)
+	}
+
+	// Segments are kept after restart, and new ones go after them
+	spill, err = OpenSpill(cfg, nil, breaker, &memorySink{}, logger)
+	if err != nil {
+		t.Fatalf("failed to reopen spill: %s", err)
+	}
+	defer spill.Close()
+	if len(spill.segments) != 4 || spill.next != 4 {
+		t.Fatalf("spill must find its segments; got %d, next %d", len(spill.segments), spill.next)
+	}
+}
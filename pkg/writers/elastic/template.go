@@ -0,0 +1,305 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/go-elasticsearch"
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Index templates are named by this prefix and the route they are for
+const templatePrefix = "kafka-to-elastic-pipeline-"
+
+// Built-in templates by their names
+var builtinTemplates = map[string]string{
+	config.TemplateUsers:  usersTemplate,
+	config.TemplateTweets: tweetsTemplate,
+}
+
+// BootstrapTemplates installs templates of indices of the routes, unless newer versions of them are installed,
+// and checks mappings of existing indices against them. Conflicts are logged, or, if so configured, returned
+// as error.
+func BootstrapTemplates(ctx context.Context, es *elasticsearch.Client, cfg config.Elastic, routes []config.Route, logger *zap.Logger) error {
+	version, err := majorVersion(ctx, es)
+	if err != nil {
+		return err
+	}
+
+	var conflicts []string
+	for _, route := range routes {
+		if route.Template == "" {
+			continue
+		}
+		template, err := loadTemplate(route.Template)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load %s template", route.Name)
+		}
+
+		pattern := indexPattern(route.Index, route.ILMPolicy)
+		body, templateVersion, err := templateBody(template, pattern, route.Index, route.ILMPolicy, version >= 7)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s template", route.Name)
+		}
+		scope := newTemplateScope(pattern, route.ILMPolicy, route.Index)
+		if err := putTemplate(ctx, es, templatePrefix+route.Name, templateVersion, scope, body, logger); err != nil {
+			return err
+		}
+
+		found, err := mappingConflicts(ctx, es, pattern, template)
+		if err != nil {
+			return err
+		}
+		conflicts = append(conflicts, found...)
+	}
+
+	if len(conflicts) > 0 && cfg.TemplateConflicts == config.TemplateConflictsFail {
+		return errors.Errorf("mappings of existing indices conflict with templates: %s", strings.Join(conflicts, "; "))
+	}
+	for _, conflict := range conflicts {
+		logger.Warn("mapping of existing index conflicts with template", zap.String("conflict", conflict))
+	}
+	return nil
+}
+
+// loadTemplate returns the built-in template with the name, or reads one from the file
+func loadTemplate(template string) (string, error) {
+	if builtin, ok := builtinTemplates[template]; ok {
+		return builtin, nil
+	}
+	data, err := ioutil.ReadFile(template)
+	return string(data), err
+}
+
+// Date patterns of index name templates
+var datePatternsInBraces = regexp.MustCompile(`\{[^{}]*\}`)
+
+// indexPattern matches all indices the configured index may resolve to
+func indexPattern(index, ilmPolicy string) string {
+	if ilmPolicy != "" {
+		return index + "-*"
+	}
+	return datePatternsInBraces.ReplaceAllString(index, "*")
+}
+
+// majorVersion returns the major version of elastic
+func majorVersion(ctx context.Context, es *elasticsearch.Client) (int, error) {
+	res, err := es.Info(es.Info.WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get elastic version")
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, errors.Errorf("failed to get elastic version: %s", res.Status())
+	}
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return 0, errors.Wrap(err, "failed to decode elastic version")
+	}
+	major, err := strconv.Atoi(strings.SplitN(info.Version.Number, ".", 2)[0])
+	if err != nil {
+		return 0, errors.Errorf("unexpected elastic version %q", info.Version.Number)
+	}
+	return major, nil
+}
+
+// templateBody sets index patterns (and, for rollover, ILM settings, along with settings of the template) of the
+// template, and returns it with its version. Mappings are made typeless for elastic 7 and later, which rejects types
+// in legacy templates, and get the `_doc` type for elastic 6, which requires one.
+func templateBody(template, pattern, alias, ilmPolicy string, typeless bool) ([]byte, int, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(template), &body); err != nil {
+		return nil, 0, err
+	}
+	body["index_patterns"] = []string{pattern}
+	if ilmPolicy != "" {
+		settings, _ := body["settings"].(map[string]interface{})
+		if settings == nil {
+			settings = map[string]interface{}{}
+		}
+		settings["index.lifecycle.name"] = ilmPolicy
+		settings["index.lifecycle.rollover_alias"] = alias
+		body["settings"] = settings
+	}
+	if mappings, ok := body["mappings"].(map[string]interface{}); ok {
+		body["mappings"] = typedMappings(mappings, typeless)
+	}
+
+	version, _ := body["version"].(float64)
+	data, err := json.Marshal(body)
+	return data, int(version), err
+}
+
+// templateScope is what a template depends on besides its version: index patterns and ILM settings of the route,
+// as elastic returns them
+type templateScope struct {
+	IndexPatterns []string `json:"index_patterns"`
+	Settings      struct {
+		Index struct {
+			Lifecycle struct {
+				Name          string `json:"name"`
+				RolloverAlias string `json:"rollover_alias"`
+			} `json:"lifecycle"`
+		} `json:"index"`
+	} `json:"settings"`
+}
+
+func newTemplateScope(pattern, ilmPolicy, alias string) templateScope {
+	var scope templateScope
+	scope.IndexPatterns = []string{pattern}
+	if ilmPolicy != "" {
+		scope.Settings.Index.Lifecycle.Name = ilmPolicy
+		scope.Settings.Index.Lifecycle.RolloverAlias = alias
+	}
+	return scope
+}
+
+// putTemplate installs the template, unless a newer version of it is installed, or the same version for the same
+// scope: a template of the same version installed for other index patterns or ILM settings is replaced
+func putTemplate(ctx context.Context, es *elasticsearch.Client, name string, version int, scope templateScope, body []byte, logger *zap.Logger) error {
+	res, err := esapi.IndicesGetTemplateRequest{Name: []string{name}}.Do(ctx, es)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get template %s", name)
+	}
+	var installed map[string]struct {
+		Version int `json:"version"`
+		templateScope
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(res.Body).Decode(&installed)
+	case http.StatusNotFound:
+	default:
+		err = errors.Errorf("status %s", res.Status())
+	}
+	_ = res.Body.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get template %s", name)
+	}
+	if template, ok := installed[name]; ok && template.Version > version {
+		logger.Info("newer index template is installed", zap.String("template", name), zap.Int("version", template.Version))
+		return nil
+	} else if ok && template.Version == version && reflect.DeepEqual(template.templateScope, scope) {
+		logger.Info("index template is up to date", zap.String("template", name), zap.Int("version", template.Version))
+		return nil
+	}
+
+	res, err = esapi.IndicesPutTemplateRequest{Name: name, Body: bytes.NewReader(body)}.Do(ctx, es)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put template %s", name)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		reason, _ := ioutil.ReadAll(res.Body)
+		return errors.Errorf("failed to put template %s: %s %s", name, res.Status(), reason)
+	}
+	logger.Info("index template installed", zap.String("template", name), zap.Int("version", version))
+	return nil
+}
+
+// mappingConflicts compares types of fields in mappings of existing indices matching the pattern with the template
+func mappingConflicts(ctx context.Context, es *elasticsearch.Client, pattern string, template string) ([]string, error) {
+	var parsed struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(template), &parsed); err != nil {
+		return nil, err
+	}
+	want := fieldTypes(parsed.Mappings)
+
+	res, err := esapi.IndicesGetMappingRequest{Index: []string{pattern}}.Do(ctx, es)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get mappings of %s", pattern)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, errors.Errorf("failed to get mappings of %s: %s", pattern, res.Status())
+	}
+	var indices map[string]struct {
+		Mappings map[string]interface{} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode mappings of %s", pattern)
+	}
+
+	var conflicts []string
+	for index, mapping := range indices {
+		existing := fieldTypes(mapping.Mappings)
+		for field, fieldType := range want {
+			if existingType, ok := existing[field]; ok && existingType != fieldType {
+				conflicts = append(conflicts, fmt.Sprintf("%s in %s is %s, template says %s", field, index, existingType, fieldType))
+			}
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts, nil
+}
+
+// typedMappings returns the mappings without their type, or with the `_doc` type
+func typedMappings(mappings map[string]interface{}, typeless bool) map[string]interface{} {
+	_, isTypeless := mappings["properties"]
+	switch {
+	case typeless && !isTypeless && len(mappings) == 1:
+		for _, mapping := range mappings {
+			if mapping, ok := mapping.(map[string]interface{}); ok {
+				return mapping
+			}
+		}
+	case !typeless && isTypeless:
+		return map[string]interface{}{"_doc": mappings}
+	}
+	return mappings
+}
+
+// fieldTypes returns types of fields by their dot-separated paths. Mappings are either of elastic 7 (with properties)
+// or of elastic 6 (with a type, having properties).
+func fieldTypes(mappings map[string]interface{}) map[string]string {
+	types := map[string]string{}
+	if properties, ok := mappings["properties"].(map[string]interface{}); ok {
+		addFieldTypes(types, "", properties)
+		return types
+	}
+	for _, mapping := range mappings {
+		if mapping, ok := mapping.(map[string]interface{}); ok {
+			if properties, ok := mapping["properties"].(map[string]interface{}); ok {
+				addFieldTypes(types, "", properties)
+			}
+		}
+	}
+	return types
+}
+
+func addFieldTypes(types map[string]string, prefix string, properties map[string]interface{}) {
+	for name, property := range properties {
+		property, ok := property.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fieldType, _ := property["type"].(string)
+		if fieldType == "" {
+			fieldType = "object"
+		}
+		types[prefix+name] = fieldType
+		if nested, ok := property["properties"].(map[string]interface{}); ok {
+			addFieldTypes(types, prefix+name+".", nested)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package elastic
+
+import (
+	"context"
+	"github.com/elastic/go-elasticsearch"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"kafka-to-elastic-pipeline/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBootstrapTemplates(t *testing.T) {
+	var mutex sync.Mutex
+	installed := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/":
+			_, _ = w.Write([]byte(`{"version": {"number": "6.6.1"}}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/_template/"+templatePrefix+"users":
+			// newer version is installed
+			_, _ = w.Write([]byte(`{"` + templatePrefix + `users": {"version": 100}}`))
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/_template/"):
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_template/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			installed[strings.TrimPrefix(r.URL.Path, "/_template/")] = string(body)
+		case r.Method == http.MethodGet && r.URL.Path == "/tweets-*/_mapping":
+			// index created with dynamic mapping
+			_, _ = w.Write([]byte(`{"tweets-2019.03.12": {"mappings": {"_doc": {"properties": {
+				"Message": {"type": "text"},
+				"RemoteAddress": {"type": "text", "fields": {"keyword": {"type": "keyword"}}},
+				"User": {"properties": {"Id": {"type": "keyword"}}}
+			}}}}}`))
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/_mapping"):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+
+	defaults := config.Default()
+	cfg, routes := defaults.Elastic, defaults.Routes
+	defaults.Route("tweets").Index = "tweets-{yyyy.MM.dd}"
+	if err := BootstrapTemplates(context.Background(), es, cfg, routes, zap.NewNop()); err != nil {
+		t.Fatalf("conflicts must only be logged by default: %s", err)
+	}
+	if _, ok := installed[templatePrefix+"users"]; ok {
+		t.Fatal("newer users template must not be overwritten")
+	}
+	tweets := installed[templatePrefix+"tweets"]
+	if !strings.Contains(tweets, `"index_patterns":["tweets-*"]`) || !strings.Contains(tweets, `"_doc":{"properties":`) ||
+		!strings.Contains(tweets, `"RemoteAddress":{"ignore_malformed":true,"type":"ip"}`) {
+		t.Fatalf("unexpected tweets template %s", tweets)
+	}
+
+	cfg.TemplateConflicts = config.TemplateConflictsFail
+	err = BootstrapTemplates(context.Background(), es, cfg, routes, zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "RemoteAddress in tweets-2019.03.12 is text, template says ip") {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "Message") || strings.Contains(err.Error(), "User") {
+		t.Fatalf("matching fields must not conflict: %s", err)
+	}
+}
+
+func TestPutTemplate(t *testing.T) {
+	const name = templatePrefix + "tweets"
+	var installed string
+	puts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			_, _ = w.Write([]byte(`{"` + name + `": ` + installed + `}`))
+		case http.MethodPut:
+			puts++
+		}
+	}))
+	defer server.Close()
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+
+	scope := newTemplateScope("tweets-*", "tweets-policy", "tweets")
+	for _, test := range []struct {
+		installed string
+		put       bool
+	}{
+		{`{"version": 2, "index_patterns": ["tweets-*"], "settings": {"index": {"lifecycle": {"name": "tweets-policy", "rollover_alias": "tweets"}}}}`, false},
+		{`{"version": 3, "index_patterns": ["tweets"]}`, false},
+		{`{"version": 1, "index_patterns": ["tweets-*"], "settings": {"index": {"lifecycle": {"name": "tweets-policy", "rollover_alias": "tweets"}}}}`, true},
+		{`{"version": 2, "index_patterns": ["tweets"]}`, true},
+		{`{"version": 2, "index_patterns": ["tweets-*"], "settings": {"index": {"lifecycle": {"name": "old-policy", "rollover_alias": "tweets"}}}}`, true},
+	} {
+		installed, puts = test.installed, 0
+		if err := putTemplate(context.Background(), es, name, 2, scope, []byte(`{}`), zap.NewNop()); err != nil {
+			t.Fatal(err)
+		}
+		if put := puts == 1; put != test.put {
+			t.Fatalf("template of version 2 with installed %s: got put %t, want %t", test.installed, put, test.put)
+		}
+	}
+}
+
+func TestTemplateBody(t *testing.T) {
+	const typed = `{"version": 3, "settings": {"number_of_shards": 2}, "mappings": {"_doc": {"properties": {"Id": {"type": "keyword"}}}}}`
+	const typeless = `{"version": 3, "mappings": {"properties": {"Id": {"type": "keyword"}}}}`
+	for _, test := range []struct {
+		template, ilmPolicy string
+		typeless            bool
+		want                string
+	}{
+		{typed, "", false, `{"index_patterns":["users"],"mappings":{"_doc":{"properties":{"Id":{"type":"keyword"}}}},"settings":{"number_of_shards":2},"version":3}`},
+		{typed, "", true, `{"index_patterns":["users"],"mappings":{"properties":{"Id":{"type":"keyword"}}},"settings":{"number_of_shards":2},"version":3}`},
+		{typeless, "", false, `{"index_patterns":["users"],"mappings":{"_doc":{"properties":{"Id":{"type":"keyword"}}}},"version":3}`},
+		{typeless, "", true, `{"index_patterns":["users"],"mappings":{"properties":{"Id":{"type":"keyword"}}},"version":3}`},
+		{typed, "users-policy", true, `{"index_patterns":["users"],"mappings":{"properties":{"Id":{"type":"keyword"}}},"settings":{"index.lifecycle.name":"users-policy","index.lifecycle.rollover_alias":"users","number_of_shards":2},"version":3}`},
+		{typeless, "users-policy", false, `{"index_patterns":["users"],"mappings":{"_doc":{"properties":{"Id":{"type":"keyword"}}}},"settings":{"index.lifecycle.name":"users-policy","index.lifecycle.rollover_alias":"users"},"version":3}`},
+	} {
+		body, version, err := templateBody(test.template, "users", "users", test.ilmPolicy, test.typeless)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != test.want || version != 3 {
+			t.Fatalf("unexpected template of version %d; got %s, want %s", version, body, test.want)
+		}
+	}
+}
+
+func TestIndexPattern(t *testing.T) {
+	for _, test := range []struct{ index, ilmPolicy, want string }{
+		{"tweets", "", "tweets"},
+		{"tweets-{yyyy.MM}-{dd}", "", "tweets-*-*"},
+		{"tweets", "tweets-policy", "tweets-*"},
+	} {
+		if pattern := indexPattern(test.index, test.ilmPolicy); pattern != test.want {
+			t.Fatalf("unexpected pattern of %s; got %s, want %s", test.index, pattern, test.want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package elastic
+
+// Index templates of users and tweets, installed on startup for indices of the configured names.
+// `index_patterns` is set from the configuration; bump `version` on every change, so that running pipelines
+// don't overwrite a newer template with an older one. Mappings are of elastic 6, with the `_doc` type; for elastic 7
+// and later they are installed without it.
+//
+// Fields added by enrichers with names in all languages (City, Country, etc.) are objects, and with one language
+// they are strings, so their mapping is left to elastic.
+
+const usersTemplate = `{
+  "version": 1,
+  "mappings": {
+    "_doc": {
+      "properties": {
+        "Id": {"type": "keyword"},
+        "Name": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}}
+      }
+    }
+  }
+}`
+
+const tweetsTemplate = `{
+  "version": 2,
+  "mappings": {
+    "_doc": {
+      "properties": {
+        "Message": {"type": "text"},
+        "User": {
+          "properties": {
+            "Id": {"type": "keyword"},
+            "Name": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}}
+          }
+        },
+        "Tags": {"type": "keyword"},
+        "RemoteAddress": {"type": "ip", "ignore_malformed": true},
+        "CountryIsoCode": {"type": "keyword"},
+        "ContinentCode": {"type": "keyword"},
+        "SubdivisionsIsoCodes": {"type": "keyword"},
+        "PostalCode": {"type": "keyword"},
+        "Location": {"type": "geo_point"},
+        "AccuracyRadius": {"type": "integer"},
+        "TimeZone": {"type": "keyword"},
+        "ASNumber": {"type": "long"},
+        "ASOrganization": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 256}}}
+      }
+    }
+  }
+}`
@@ -1,86 +1,305 @@
 package elastic
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/elastic/go-elasticsearch"
-	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"kafka-to-elastic-pipeline/config"
+	"kafka-to-elastic-pipeline/pkg/metrics"
 	"kafka-to-elastic-pipeline/pkg/types"
-	"strings"
+	"net/http"
+	"sync"
 	"time"
 )
 
 type bufferEntity struct {
 	esIndex string
-	data    []byte
+	action  string // one of config.Action* or actionDelete
+	script  string // for config.ActionScript
+	id      string // empty if generated by ES
+	data    []byte // nil for actionDelete
+	offset  types.Offset
 }
 
-func Write(ctx context.Context, es *elasticsearch.Client, usersChannel chan types.User, tweetsChannel chan types.EnrichedTweet, logger *zap.Logger) error {
-	tickChannel := time.NewTicker(config.ElasticForcedFlushInterval).C
-	lastFlushed := time.Now()
+// Tombstones delete documents
+const actionDelete = "delete"
+
+// Where and how records of a topic are written
+type destination struct {
+	index      *indexName
+	idStrategy string
+	action     string
+	script     string
+	tombstones string
+}
+
+// Write writes records to ES, each one to the index of its route, until the channel is closed, or `quit` is (then
+// the writer is not needed anymore, while others go on); then the buffer is flushed for the last time.
+// The buffer is flushed when it has `WorkerBuffer` objects or `MaxBulkBytes` bytes, or `ForcedFlushInterval` after
+// the first object was buffered, whichever happens first.
+// Bulk requests are sent in the background, up to `MaxInFlight` at once, while the next buffer is filled; when all of
+// them are in flight, the writer waits, and so stops reading the channels. So it does while the breaker is open,
+// unless objects are spilled (spill is nil if there is none).
+// The trigger (if any) makes the writer flush the buffer right away.
+// If objects of a request can't be handed to the failure sink, the writer returns the error.
+func Write(ctx context.Context, cfg config.Elastic, routes []config.Route, es *elasticsearch.Client, breaker *Breaker, spill *Spill, trigger *FlushTrigger, sink FailureSink, in chan *types.Record, quit <-chan struct{}, logger *zap.Logger) error {
+	destinations := map[string]destination{}
+	for _, route := range routes {
+		index, err := newIndexName(route.Index, route.Timestamp)
+		if err != nil {
+			return err
+		}
+		destinations[route.Name] = destination{index: index, idStrategy: route.ID, action: route.Action, script: route.Script, tombstones: route.Tombstones}
+	}
+
+	slots := make(chan *slot, cfg.MaxInFlight)
+	for i := 0; i < cfg.MaxInFlight; i++ {
+		slots <- &slot{}
+	}
+	var inFlight []*bulkInFlight
+	var sending sync.WaitGroup
+	defer sending.Wait() // requests in flight are finished, or canceled together with ctx, before the writer returns
+
+	// the first error of requests in flight; failed is closed once it is set
+	var flushErr error
+	var failOnce sync.Once
+	failed := make(chan struct{})
 
 	var buffer []bufferEntity
-	for {
+	bufferedBytes := 0
+	var deadline <-chan time.Time // nil while the buffer is empty
+
+	flushBuffer := func() {
+		bufferedBytes = 0
+		deadline = nil
+		if len(buffer) == 0 {
+			return
+		}
+
+		var free *slot
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return // objects are not acknowledged and are read again after restart
+		case free = <-slots:
+		}
+		free.buffer, buffer = buffer, free.buffer[:0]
 
-		case <-tickChannel:
-			if lastFlushed.Add(config.ElasticForcedFlushInterval).Unix() <= time.Now().Unix() {
-				// flush by tick signal only if last flash was at least `ElasticForcedFlushInterval` time ago
-				buffer, lastFlushed = flush(ctx, buffer, es, logger)
+		bulk := &bulkInFlight{done: make(chan struct{})}
+		var earlier []*bulkInFlight
+		if cfg.Ordering == config.OrderingPartition {
+			bulk.partitions = partitions(free.buffer)
+		}
+		running := inFlight[:0]
+		for _, other := range inFlight {
+			if other.finished() {
+				continue
+			}
+			running = append(running, other)
+			if bulk.follows(other) {
+				earlier = append(earlier, other)
 			}
+		}
+		inFlight = append(running, bulk)
 
-		case user := <-usersChannel:
-			bytes, err := json.Marshal(user)
+		metrics.BulksInFlight.Inc()
+		sending.Add(1)
+		go func() {
+			defer sending.Done()
+			for _, other := range earlier {
+				<-other.done
+			}
+			var err error
+			free.buffer, err = flush(ctx, cfg, free.buffer, &free.body, es, breaker, spill, sink, logger)
 			if err != nil {
-				return err
+				failOnce.Do(func() {
+					flushErr = err
+					close(failed)
+				})
 			}
-			buffer = append(buffer, bufferEntity{esIndex: config.ESUsersIndex, data: bytes})
+			metrics.BulksInFlight.Dec()
+			close(bulk.done)
+			slots <- free
+		}()
+	}
 
-		case tweet := <-tweetsChannel:
-			bytes, err := json.Marshal(tweet)
-			if err != nil {
-				return err
+	var triggered <-chan struct{} // nil without trigger
+	if trigger != nil {
+		triggered = trigger.triggered()
+	}
+
+	for in != nil {
+		var record *types.Record
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-failed:
+			return flushErr
+
+		case <-deadline:
+			flushBuffer()
+			continue
+
+		case <-triggered:
+			triggered = trigger.triggered()
+			flushBuffer()
+			continue
+
+		case <-quit:
+			in = nil
+			continue
+
+		case next, ok := <-in:
+			if !ok {
+				in = nil
+				continue
 			}
-			buffer = append(buffer, bufferEntity{esIndex: config.ESTweetsIndex, data: bytes})
+			record = next
 		}
 
-		if len(buffer) >= config.ElasticWorkerBuffer {
-			buffer, lastFlushed = flush(ctx, buffer, es, logger)
+		dest, ok := destinations[record.Route]
+		if !ok {
+			return errors.Errorf("record of unknown route %q", record.Route)
 		}
-	}
-}
 
-func flush(ctx context.Context, buffer []bufferEntity, es *elasticsearch.Client, logger *zap.Logger) ([]bufferEntity, time.Time) {
-	if len(buffer) > 0 {
-		logger.Info(fmt.Sprintf("writing %d objects to ES", len(buffer)))
-		var body strings.Builder
-		for _, el := range buffer {
-			body.WriteString(fmt.Sprintf("{\"index\" : { \"_index\" : \"%s\", \"_type\" : \"_doc\" }}\n", el.esIndex))
-			body.WriteString(string(el.data) + "\n")
+		entity, ok, err := newEntity(ctx, dest, record, sink)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
 		}
 
-		req := esapi.BulkRequest{
-			Body:    strings.NewReader(body.String()),
-			Refresh: "true", // this will make objects immediately searchable; convenient for dev, can be slow for prod
-			Pretty:  false,
+		size := entity.size()
+		if len(buffer) > 0 && bufferedBytes+size > cfg.MaxBulkBytes {
+			flushBuffer()
 		}
-		res, err := req.Do(ctx, es)
-		if err != nil {
-			logger.Error("error making bulk request", zap.Error(err))
+		if len(buffer) == 0 {
+			deadline = time.After(cfg.ForcedFlushInterval)
 		}
+		buffer = append(buffer, entity)
+		bufferedBytes += size
 
-		if res.IsError() {
-			logger.Error("error indexing tweet", zap.String("status", res.Status()))
+		if len(buffer) >= cfg.WorkerBuffer || bufferedBytes >= cfg.MaxBulkBytes {
+			flushBuffer()
 		}
-		if err := res.Body.Close(); err != nil {
-			logger.Error("failed to close response body", zap.Error(err))
+	}
+
+	flushBuffer()
+	sending.Wait()
+	select {
+	case <-failed:
+		return flushErr
+	default:
+		return nil
+	}
+}
+
+// FlushTrigger makes all writers flush their buffers right away, e.g. on request of the admin API
+type FlushTrigger struct {
+	mutex   sync.Mutex
+	trigger chan struct{} // closed to trigger flushes, and replaced by the next one
+}
+
+func NewFlushTrigger() *FlushTrigger {
+	return &FlushTrigger{trigger: make(chan struct{})}
+}
+
+// Flush triggers flushes of all writers
+func (t *FlushTrigger) Flush() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	close(t.trigger)
+	t.trigger = make(chan struct{})
+}
+
+// triggered returns a channel closed by the next Flush
+func (t *FlushTrigger) triggered() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.trigger
+}
+
+// What a bulk request in flight needs and the next one reuses: buffer of objects and body of the request.
+// Writer has `MaxInFlight` slots, so a request can only be sent when there is a free one.
+type slot struct {
+	buffer []bufferEntity
+	body   bytes.Buffer
+}
+
+// Bulk request in flight, and partitions its objects are read from (nil unless ordered by partition)
+type bulkInFlight struct {
+	partitions map[partition]bool
+	done       chan struct{} // closed once objects are written or handed to the failure sink
+}
+
+type partition struct {
+	topic string
+	id    int
+}
+
+func partitions(buffer []bufferEntity) map[partition]bool {
+	result := map[partition]bool{}
+	for _, el := range buffer {
+		result[partition{el.offset.Topic, el.offset.Partition}] = true
+	}
+	return result
+}
+
+// follows tells if the request has to wait for the earlier one, having objects of the same partitions
+func (b *bulkInFlight) follows(earlier *bulkInFlight) bool {
+	for p := range b.partitions {
+		if earlier.partitions[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bulkInFlight) finished() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Makes buffer entity of the record. Records that can't be encoded, get an index name or an ID by the strategy (or
+// tombstones that get no ID at all, or are not to be deleted) go to the failure sink right away, and no entity is returned. If the sink fails
+// too, the error is returned: the record can't be acknowledged, and committing offsets can't go on past it.
+func newEntity(ctx context.Context, dest destination, record *types.Record, sink FailureSink) (bufferEntity, bool, error) {
+	entity := bufferEntity{esIndex: dest.index.template, action: dest.action, script: dest.script, offset: record.Offset}
+
+	var err error
+	if record.Tombstone() && dest.tombstones == config.TombstonesFail {
+		err = errors.New("tombstone is not deleted: its route hands tombstones to the failure sink")
+	} else if record.Tombstone() {
+		entity.action = actionDelete
+	} else if entity.data, err = json.Marshal(record.Doc); err != nil {
+		err = errors.Wrap(err, "failed to encode document")
+	}
+
+	if err == nil {
+		var esIndex string
+		if esIndex, err = dest.index.resolve(record); err == nil {
+			entity.esIndex = esIndex
+			entity.id, err = documentID(dest.idStrategy, record, entity.data)
+		}
+	}
+	if err == nil && entity.id == "" && entity.action == actionDelete {
+		err = errors.New("failed to delete: tombstone gets no id by auto strategy")
+	}
+	if err != nil {
+		metrics.Documents.WithLabelValues(entity.esIndex, "failed").Inc()
+		if err := sink.Failed(ctx, entity.failure(bulkItemResult{Status: http.StatusBadRequest, Error: errorJSON(err.Error())})); err != nil {
+			return entity, false, errors.Wrapf(err, "failed to hand object of %s to failure sink", entity.esIndex)
 		}
-		buffer = nil
+		record.Offset.Ack()
+		return entity, false, nil
 	}
-	return buffer, time.Now()
+	return entity, true, nil
 }
@@ -9,46 +9,55 @@ import (
 	"go.uber.org/zap"
 	"kafka-to-elastic-pipeline/config"
 	"kafka-to-elastic-pipeline/pkg/types"
+	"math"
 	"math/rand"
+	"net/http"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 )
 
 func TestWrite(t *testing.T) {
-	usersCh := make(chan types.User)
-	enrichedTweetsCh := make(chan types.EnrichedTweet)
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+
+	recordsCh := make(chan *types.Record)
 
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		t.Fatalf("Failed to initilaize logger: %s", err)
 	}
 
-	es, err := elasticsearch.NewDefaultClient()
+	es, _, err := NewClient(cfg.Elastic, logger)
 	if err != nil {
 		t.Fatalf("Error creating the client: %s", err)
 	}
 
 	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, config.ElasticForcedFlushInterval+time.Second*5)
+	ctx, cancel := context.WithTimeout(ctx, cfg.Elastic.ForcedFlushInterval+time.Second*5)
 	defer cancel()
 
-	go Write(ctx, es, usersCh, enrichedTweetsCh, logger)
+	go Write(ctx, cfg.Elastic, cfg.Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, &logSink{logger: logger}, recordsCh, nil, logger)
 
 	rand.Seed(time.Now().Unix())
-	user := types.User{Name: fmt.Sprintf("User%f", rand.Float64())}
+	userName := fmt.Sprintf("User%f", rand.Float64())
+	user := &types.Record{Route: "users", Doc: map[string]interface{}{"Name": userName, "Id": userName}}
 	foundUser := false
 
-	tweet := types.EnrichedTweet{Message: fmt.Sprintf("Message%f", rand.Float64())}
+	tweetMessage := fmt.Sprintf("Message%f", rand.Float64())
+	tweet := &types.Record{Route: "tweets", Doc: map[string]interface{}{"Message": tweetMessage}}
 	foundTweet := false
 
 	select {
-	case usersCh <- user:
+	case recordsCh <- user:
 	case <-ctx.Done():
 		t.Fatal("failed to send data to writer")
 	}
 	select {
-	case enrichedTweetsCh <- tweet:
+	case recordsCh <- tweet:
 	case <-ctx.Done():
 		t.Fatal("failed to send data to writer")
 	}
@@ -59,10 +68,10 @@ func TestWrite(t *testing.T) {
 			t.Fatal("data not found in ES (timeout)")
 		default:
 			if !foundUser {
-				err, foundUser = findObject(ctx, es, config.ESUsersIndex, fmt.Sprintf(`{"match":{"Name":"%s"}}`, user.Name))
+				err, foundUser = findObject(ctx, es, cfg.Route("users").Index, fmt.Sprintf(`{"match":{"Name":"%s"}}`, userName))
 			}
 			if !foundTweet {
-				err, foundTweet = findObject(ctx, es, config.ESTweetsIndex, fmt.Sprintf(`{"match":{"Message":"%s"}}`, tweet.Message))
+				err, foundTweet = findObject(ctx, es, cfg.Route("tweets").Index, fmt.Sprintf(`{"match":{"Message":"%s"}}`, tweetMessage))
 			}
 			if foundUser && foundTweet {
 				return
@@ -72,25 +81,435 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+func TestWriteFlushesOnClose(t *testing.T) {
+	written := make(chan string, 10)
+	es, server := fakeBulk(t, func(doc string) int {
+		written <- doc
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	usersCh := make(chan *types.Record, 1)
+	usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Name": "last user", "Id": "1"}}
+	close(usersCh)
+
+	cfg := config.Default().Elastic
+	cfg.ForcedFlushInterval = time.Hour // only the final flush may write the user
+
+	if err := Write(context.Background(), cfg, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, &memorySink{}, usersCh, nil, zap.NewNop()); err != nil {
+		t.Fatalf("writer failed: %s", err)
+	}
+	select {
+	case doc := <-written:
+		if !strings.Contains(doc, "last user") {
+			t.Fatalf("unexpected document %s", doc)
+		}
+	default:
+		t.Fatal("buffer is not flushed")
+	}
+}
+
+func TestWriteFlushesBySizeAndTime(t *testing.T) {
+	written := make(chan string, 10)
+	es, server := fakeBulk(t, func(doc string) int {
+		written <- doc
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	write := func(cfg config.Elastic, users int) (chan *types.Record, chan error) {
+		usersCh := make(chan *types.Record)
+		done := make(chan error)
+		go func() {
+			done <- Write(context.Background(), cfg, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, &memorySink{}, usersCh, nil, zap.NewNop())
+		}()
+		for i := 0; i < users; i++ {
+			usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Name": fmt.Sprintf("user %d", i), "Id": strconv.Itoa(i)}}
+		}
+		return usersCh, done
+	}
+
+	t.Run("size", func(t *testing.T) {
+		cfg := config.Default().Elastic
+		cfg.MaxBulkBytes = 150 // a bit more than one user
+		cfg.ForcedFlushInterval = time.Hour
+
+		// Writer gets the third user only after it has handled the second one, which doesn't fit into the buffer
+		// with the first one
+		usersCh, done := write(cfg, 3)
+		select {
+		case doc := <-written:
+			if !strings.Contains(doc, "user 0") {
+				t.Fatalf("unexpected document %s", doc)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("buffer is not flushed by size")
+		}
+
+		close(usersCh)
+		if err := <-done; err != nil {
+			t.Fatalf("writer failed: %s", err)
+		}
+		if len(written) != 2 {
+			t.Fatalf("unexpected number of documents written; got %d, want 2", len(written))
+		}
+		<-written
+		<-written
+	})
+
+	t.Run("time", func(t *testing.T) {
+		cfg := config.Default().Elastic
+		cfg.ForcedFlushInterval = time.Millisecond * 50
+
+		usersCh, done := write(cfg, 1)
+		select {
+		case <-written:
+		case <-time.After(time.Second):
+			t.Fatal("buffer is not flushed by time")
+		}
+
+		close(usersCh)
+		if err := <-done; err != nil {
+			t.Fatalf("writer failed: %s", err)
+		}
+	})
+
+	t.Run("trigger", func(t *testing.T) {
+		cfg := config.Default().Elastic
+		cfg.ForcedFlushInterval = time.Hour
+		trigger := NewFlushTrigger()
+
+		usersCh := make(chan *types.Record)
+		done := make(chan error)
+		go func() {
+			done <- Write(context.Background(), cfg, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, trigger, &memorySink{}, usersCh, nil, zap.NewNop())
+		}()
+		// every trigger flushes the buffer, which is filled before it
+		for i := 0; i < 2; i++ {
+			usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Name": fmt.Sprintf("user %d", i), "Id": strconv.Itoa(i)}}
+			trigger.Flush()
+			select {
+			case doc := <-written:
+				if !strings.Contains(doc, fmt.Sprintf("user %d", i)) {
+					t.Fatalf("unexpected document %s", doc)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("buffer is not flushed by trigger")
+			}
+		}
+
+		close(usersCh)
+		if err := <-done; err != nil {
+			t.Fatalf("writer failed: %s", err)
+		}
+	})
+}
+
+func TestWriteBulksInFlight(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	es, server := fakeBulk(t, func(doc string) int {
+		started <- doc
+		<-release
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	for _, test := range []struct {
+		ordering   string
+		partitions []int // of the first two users
+		concurrent bool  // if requests of the first two users are in flight at once
+	}{
+		{config.OrderingNone, []int{0, 0}, true},
+		{config.OrderingPartition, []int{0, 1}, true},
+		{config.OrderingPartition, []int{0, 0}, false},
+	} {
+		test := test
+		t.Run(fmt.Sprintf("%s %v", test.ordering, test.partitions), func(t *testing.T) {
+			cfg := config.Default().Elastic
+			cfg.WorkerBuffer = 1
+			cfg.MaxInFlight = 2
+			cfg.Ordering = test.ordering
+
+			usersCh := make(chan *types.Record)
+			done := make(chan error)
+			go func() {
+				done <- Write(context.Background(), cfg, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, &memorySink{}, usersCh, nil, zap.NewNop())
+			}()
+			user := func(i, partition int) *types.Record {
+				return &types.Record{
+					Route:  "users",
+					Doc:    map[string]interface{}{"Name": fmt.Sprintf("user %d", i), "Id": strconv.Itoa(i)},
+					Offset: types.Offset{Topic: "users", Partition: partition, Offset: int64(i)},
+				}
+			}
+
+			usersCh <- user(0, test.partitions[0])
+			usersCh <- user(1, test.partitions[1])
+			<-started
+			select {
+			case <-started:
+				if !test.concurrent {
+					t.Fatal("request is sent before an earlier one of the same partition is finished")
+				}
+			case <-time.After(time.Millisecond * 50):
+				if test.concurrent {
+					t.Fatal("requests are not in flight at once")
+				}
+			}
+
+			// Both slots are taken, so the writer takes the third user, but not the fourth one
+			usersCh <- user(2, 2)
+			select {
+			case usersCh <- user(3, 3):
+				t.Fatal("writer reads channels while max requests are in flight")
+			case <-time.After(time.Millisecond * 50):
+			}
+
+			close(release)
+			usersCh <- user(3, 3)
+			close(usersCh)
+			if err := <-done; err != nil {
+				t.Fatalf("writer failed: %s", err)
+			}
+			for len(started) > 0 {
+				<-started
+			}
+			release = make(chan struct{})
+		})
+	}
+}
+
+func TestWriteRoutes(t *testing.T) {
+	// Objects are refused, so that the failure sink tells indices they were written to
+	es, server := fakeBulk(t, func(doc string) int {
+		return http.StatusBadRequest
+	})
+	defer server.Close()
+
+	routes := []config.Route{
+		{Name: "orders", Index: "orders-{yyyy}", Timestamp: config.TimestampKafka, ID: config.IDStrategyKey, Action: config.ActionIndex},
+		{Name: "payments", Index: "payments", Timestamp: config.TimestampKafka, ID: config.IDStrategyAuto, Action: config.ActionCreate},
+	}
+	in := make(chan *types.Record, 3)
+	in <- &types.Record{Route: "orders", Key: "order-1", Doc: map[string]interface{}{"Total": 10}, Time: time.Date(2019, 3, 12, 0, 0, 0, 0, time.UTC)}
+	in <- &types.Record{Route: "payments", Doc: map[string]interface{}{"Amount": 10}}
+	close(in)
+
+	sink := &memorySink{}
+	if err := Write(context.Background(), config.Default().Elastic, routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, sink, in, nil, zap.NewNop()); err != nil {
+		t.Fatalf("writer failed: %s", err)
+	}
+	if len(sink.objects) != 2 || sink.objects[0].Index != "orders-2019" || sink.objects[1].Index != "payments" {
+		t.Fatalf("records must be written to indices of their routes; got %+v", sink.objects)
+	}
+
+	in = make(chan *types.Record, 1)
+	in <- &types.Record{Route: "refunds", Doc: map[string]interface{}{"Amount": 10}}
+	close(in)
+	if err := Write(context.Background(), config.Default().Elastic, routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, sink, in, nil, zap.NewNop()); err == nil {
+		t.Fatal("expected error for record of unknown route")
+	}
+}
+
+func TestWriteFailsRecordsWithoutID(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		t.Fatalf("document without id must not be written: %s", doc)
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	acks := &ackCounter{acks: map[int64]int{}}
+	usersCh := make(chan *types.Record, 1)
+	usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Name": "anonymous"}, Offset: types.Offset{Offset: 7, Acker: acks}}
+	close(usersCh)
+
+	sink := &memorySink{}
+	if err := Write(context.Background(), config.Default().Elastic, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, sink, usersCh, nil, zap.NewNop()); err != nil {
+		t.Fatalf("writer failed: %s", err)
+	}
+	if len(sink.objects) != 1 || sink.objects[0].Status != http.StatusBadRequest || sink.objects[0].Offset != 7 {
+		t.Fatalf("record must go to failure sink; got %+v", sink.objects)
+	}
+	if acks.acks[7] != 1 {
+		t.Fatal("record handed to failure sink must be acknowledged")
+	}
+}
+
+func TestWriteFailsRecordsNotEncoded(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	acks := &ackCounter{acks: map[int64]int{}}
+	usersCh := make(chan *types.Record, 2)
+	usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Id": "1", "Score": math.NaN()}, Offset: types.Offset{Offset: 4, Acker: acks}}
+	usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Id": "2"}, Offset: types.Offset{Offset: 5, Acker: acks}}
+	close(usersCh)
+
+	sink := &memorySink{}
+	if err := Write(context.Background(), config.Default().Elastic, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, sink, usersCh, nil, zap.NewNop()); err != nil {
+		t.Fatalf("writer must go on after a record it can't encode; got %s", err)
+	}
+	if len(sink.objects) != 1 || sink.objects[0].Offset != 4 {
+		t.Fatalf("record must go to failure sink; got %+v", sink.objects)
+	}
+	if acks.acks[4] != 1 || acks.acks[5] != 1 {
+		t.Fatalf("both records must be acknowledged; got %v", acks.acks)
+	}
+}
+
+type brokenSink struct{}
+
+func (s brokenSink) Failed(ctx context.Context, object FailedObject) error {
+	return errors.New("disk is full")
+}
+
+func (s brokenSink) Close() error {
+	return nil
+}
+
+func TestWriteFailsWithFailureSink(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		t.Fatalf("document without id must not be written: %s", doc)
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	acks := &ackCounter{acks: map[int64]int{}}
+	usersCh := make(chan *types.Record, 1)
+	usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Name": "anonymous"}, Offset: types.Offset{Offset: 7, Acker: acks}}
+	close(usersCh)
+
+	err := Write(context.Background(), config.Default().Elastic, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, brokenSink{}, usersCh, nil, zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "disk is full") {
+		t.Fatalf("writer must fail when the failure sink does; got %v", err)
+	}
+	if acks.acks[7] != 0 {
+		t.Fatal("record not handed to failure sink must not be acknowledged")
+	}
+}
+
+func TestWriteFailsWithFailureSinkOfBulk(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		if strings.Contains(doc, `"malformed"`) {
+			return http.StatusBadRequest
+		}
+		return http.StatusCreated
+	})
+	defer server.Close()
+
+	acks := &ackCounter{acks: map[int64]int{}}
+	usersCh := make(chan *types.Record, 2)
+	usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Id": "1", "Name": "malformed"}, Offset: types.Offset{Offset: 1, Acker: acks}}
+	usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Id": "2"}, Offset: types.Offset{Offset: 2, Acker: acks}}
+	close(usersCh)
+
+	err := Write(context.Background(), config.Default().Elastic, config.Default().Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, brokenSink{}, usersCh, nil, zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "disk is full") {
+		t.Fatalf("writer must fail when the failure sink does; got %v", err)
+	}
+	if acks.acks[1] != 0 {
+		t.Fatal("record not handed to failure sink must not be acknowledged")
+	}
+}
+
+func TestWriteTombstones(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		if !strings.Contains(doc, `"delete"`) || !strings.Contains(doc, `"_id" : "user-1"`) {
+			t.Errorf("tombstone must delete the document; got %s", doc)
+		}
+		return http.StatusNotFound
+	})
+	defer server.Close()
+
+	acks := &ackCounter{acks: map[int64]int{}}
+	usersCh := make(chan *types.Record, 1)
+	usersCh <- &types.Record{Route: "users", Key: "user-1", Offset: types.Offset{Offset: 3, Acker: acks}}
+	close(usersCh)
+
+	cfg := config.Default()
+	cfg.Route("users").ID = config.IDStrategyKey
+	sink := &memorySink{}
+	if err := Write(context.Background(), cfg.Elastic, cfg.Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, sink, usersCh, nil, zap.NewNop()); err != nil {
+		t.Fatalf("writer failed: %s", err)
+	}
+	if len(sink.objects) != 0 || acks.acks[3] != 1 {
+		t.Fatalf("deleting a missing document must succeed; failed %+v, acks %v", sink.objects, acks.acks)
+	}
+}
+
+func TestWriteFailsTombstonesNotDeleted(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		t.Errorf("tombstone must not be written; got %s", doc)
+		return http.StatusOK
+	})
+	defer server.Close()
+
+	acks := &ackCounter{acks: map[int64]int{}}
+	in := make(chan *types.Record, 1)
+	in <- &types.Record{Route: "orders", Key: "order-1", Offset: types.Offset{Offset: 3, Acker: acks}}
+	close(in)
+
+	routes := []config.Route{{Name: "orders", Index: "orders-{yyyy}", Timestamp: "field:Created", ID: config.IDStrategyKey,
+		Action: config.ActionIndex, Tombstones: config.TombstonesFail}}
+	sink := &memorySink{}
+	if err := Write(context.Background(), config.Default().Elastic, routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, sink, in, nil, zap.NewNop()); err != nil {
+		t.Fatalf("writer failed: %s", err)
+	}
+	if len(sink.objects) != 1 || acks.acks[3] != 1 {
+		t.Fatalf("tombstone must go to failure sink; failed %+v, acks %v", sink.objects, acks.acks)
+	}
+}
+
+func TestWriteTombstonesOfDefaultUsersRoute(t *testing.T) {
+	es, server := fakeBulk(t, func(doc string) int {
+		if !strings.Contains(doc, `"delete"`) || !strings.Contains(doc, `"_id" : "42"`) {
+			t.Errorf("tombstone must delete the user with id of its key; got %s", doc)
+		}
+		return http.StatusOK
+	})
+	defer server.Close()
+
+	acks := &ackCounter{acks: map[int64]int{}}
+	usersCh := make(chan *types.Record, 1)
+	usersCh <- &types.Record{Route: "users", Key: "42", Offset: types.Offset{Offset: 8, Acker: acks}}
+	close(usersCh)
+
+	cfg := config.Default()
+	sink := &memorySink{}
+	if err := Write(context.Background(), cfg.Elastic, cfg.Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, sink, usersCh, nil, zap.NewNop()); err != nil {
+		t.Fatalf("writer failed: %s", err)
+	}
+	if len(sink.objects) != 0 || acks.acks[8] != 1 {
+		t.Fatalf("user must be deleted; failed %+v, acks %v", sink.objects, acks.acks)
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
-	usersCh := make(chan types.User)
-	enrichedTweetsCh := make(chan types.EnrichedTweet)
+	cfg, err := config.Load(nil)
+	if err != nil {
+		b.Fatalf("Failed to load config: %s", err)
+	}
+
+	usersCh := make(chan *types.Record)
 
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		b.Fatalf("Failed to initilaize logger: %s", err)
 	}
 
-	es, err := elasticsearch.NewDefaultClient()
+	es, _, err := NewClient(cfg.Elastic, logger)
 	if err != nil {
 		b.Fatalf("Error creating the client: %s", err)
 	}
 
 	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, config.ElasticForcedFlushInterval*2+time.Second*5)
+	ctx, cancel := context.WithTimeout(ctx, cfg.Elastic.ForcedFlushInterval*2+time.Second*5)
 	defer cancel()
 
-	go Write(ctx, es, usersCh, enrichedTweetsCh, logger)
+	go Write(ctx, cfg.Elastic, cfg.Routes, es, NewBreaker(es, time.Second, zap.NewNop()), nil, nil, &logSink{logger: logger}, usersCh, nil, logger)
 
 	for i := 0; i < b.N; i++ {
 		// We just write data to a source channel and hope it is written to ES
@@ -99,10 +518,10 @@ func BenchmarkWrite(b *testing.B) {
 		select {
 		case <-ctx.Done():
 			b.Fatal("timed out")
-		case usersCh <- types.User{Name: "some user"}:
+		case usersCh <- &types.Record{Route: "users", Doc: map[string]interface{}{"Name": "some user", "Id": strconv.Itoa(i)}}:
 		}
 	}
-	if b.N < 5*config.ElasticWorkerBuffer {
+	if b.N < 5*cfg.Elastic.WorkerBuffer {
 		b.Log("benchmark is not to be trusted (too few writes)")
 	} else {
 		b.Log("benchmark is trustworthy (enough writes)")
@@ -8,10 +8,17 @@ import (
 	"kafka-to-elastic-pipeline/pkg/types"
 )
 
-func CreateUsersInKafka(num int32) error {
+// Number of partitions of topics created by tests, to simulate potential prod setup
+const (
+	UsersPartitions  = 2
+	TweetsPartitions = 10
+)
+
+func CreateUsersInKafka(cfg config.Kafka, dialer *kafkaGo.Dialer, topic string, num int32) error {
 	kafkaUsersWriter := kafkaGo.NewWriter(kafkaGo.WriterConfig{
-		Brokers: config.KafkaBrokers,
-		Topic:   config.KafkaUsersTopic,
+		Brokers: cfg.Brokers,
+		Dialer:  dialer,
+		Topic:   topic,
 		Async:   true,
 	})
 	ctx := context.Background()
@@ -41,10 +48,11 @@ func CreateUsersInKafka(num int32) error {
 	return kafkaUsersWriter.Close()
 }
 
-func CreateTweetsInKafka(num int32) error {
+func CreateTweetsInKafka(cfg config.Kafka, dialer *kafkaGo.Dialer, topic string, num int32) error {
 	kafkaTweetsWriter := kafkaGo.NewWriter(kafkaGo.WriterConfig{
-		Brokers: config.KafkaBrokers,
-		Topic:   config.KafkaTweetsTopic,
+		Brokers: cfg.Brokers,
+		Dialer:  dialer,
+		Topic:   topic,
 		Async:   true,
 	})
 	ctx := context.Background()
@@ -0,0 +1,107 @@
+package test_data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SchemaRegistry is a local stand-in of Confluent schema registry, serving schemas registered by tests
+type SchemaRegistry struct {
+	*httptest.Server
+
+	mutex       sync.Mutex
+	schemas     map[int32]registeredSchema
+	subjects    map[string][]int32 // IDs of versions of subjects, from version 1
+	unavailable bool
+	requests    int64 // atomic
+}
+
+// SchemaReference refers to a version of a subject, e.g. an imported protobuf file
+type SchemaReference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+type registeredSchema struct {
+	Schema     string            `json:"schema"`
+	SchemaType string            `json:"schemaType,omitempty"` // empty for avro
+	References []SchemaReference `json:"references,omitempty"`
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	registry := &SchemaRegistry{schemas: map[int32]registeredSchema{}, subjects: map[string][]int32{}}
+	registry.Server = httptest.NewServer(http.HandlerFunc(registry.serve))
+	return registry
+}
+
+// Register adds a new version of the subject, and returns ID of the schema; schema type is AVRO, PROTOBUF or JSON
+func (r *SchemaRegistry) Register(subject, schemaType, schema string, references ...SchemaReference) int32 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if schemaType == "AVRO" {
+		schemaType = ""
+	}
+	id := int32(len(r.schemas) + 1)
+	r.schemas[id] = registeredSchema{Schema: schema, SchemaType: schemaType, References: references}
+	r.subjects[subject] = append(r.subjects[subject], id)
+	return id
+}
+
+// Requests returns the number of requests served so far
+func (r *SchemaRegistry) Requests() int {
+	return int(atomic.LoadInt64(&r.requests))
+}
+
+// SetUnavailable makes the registry answer 503 to all requests, or serve schemas again
+func (r *SchemaRegistry) SetUnavailable(unavailable bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.unavailable = unavailable
+}
+
+func (r *SchemaRegistry) serve(w http.ResponseWriter, request *http.Request) {
+	atomic.AddInt64(&r.requests, 1)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// /schemas/ids/{id} or /subjects/{subject}/versions/{version}
+	path := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	var id int32
+	switch {
+	case len(path) == 3 && path[0] == "schemas" && path[1] == "ids":
+		n, _ := strconv.Atoi(path[2])
+		id = int32(n)
+	case len(path) == 4 && path[0] == "subjects" && path[2] == "versions":
+		version, _ := strconv.Atoi(path[3])
+		if versions := r.subjects[path[1]]; version > 0 && version <= len(versions) {
+			id = versions[version-1]
+		}
+	}
+
+	schema, ok := r.schemas[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	json.NewEncoder(w).Encode(schema)
+}
+
+// WireFormat prepends the magic byte and schema ID to a message encoded by the schema, as Confluent serializers do
+func WireFormat(id int32, message []byte) []byte {
+	value := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(value[1:], uint32(id))
+	return append(value, message...)
+}